@@ -0,0 +1,131 @@
+package authz
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/karlseguin/ccache"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jtblin/kube2iam/metrics"
+)
+
+const maxResponseBytes = 1 << 20
+
+// Request is the decision request sent to the webhook for every credential issuance.
+type Request struct {
+	Pod            string `json:"pod"`
+	Namespace      string `json:"namespace"`
+	ServiceAccount string `json:"serviceAccount"`
+	Role           string `json:"role"`
+	ExternalID     string `json:"externalId"`
+	Node           string `json:"node"`
+}
+
+// Decision is the response expected from the webhook.
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Authorizer decides whether credentials may be issued for a request.
+type Authorizer interface {
+	Authorize(Request) Decision
+}
+
+// Webhook asks an external policy decision service whether credentials may be issued.
+type Webhook struct {
+	URL      string
+	FailOpen bool
+	CacheTTL time.Duration
+	Client   *http.Client
+	Cache    *ccache.Cache
+}
+
+// Authorize returns the decision for the given request. Decisions are cached for CacheTTL.
+// When the webhook cannot be reached or answers with an error, the request is allowed if
+// FailOpen is set and denied otherwise.
+func (w *Webhook) Authorize(req Request) Decision {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return w.failure(req, err)
+	}
+	key := string(body)
+
+	if w.CacheTTL > 0 {
+		if item := w.Cache.Get(key); item != nil && !item.Expired() {
+			decision := item.Value().(Decision)
+			metrics.AuthzDecisionCount.WithLabelValues(decisionLabel(decision), "cache").Inc()
+			return decision
+		}
+	}
+
+	decision, err := w.post(body)
+	if err != nil {
+		return w.failure(req, err)
+	}
+	if w.CacheTTL > 0 {
+		w.Cache.Set(key, decision, w.CacheTTL)
+	}
+	metrics.AuthzDecisionCount.WithLabelValues(decisionLabel(decision), "webhook").Inc()
+	return decision
+}
+
+func (w *Webhook) post(body []byte) (Decision, error) {
+	var decision Decision
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return decision, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Error closing authorization webhook response: %+v", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return decision, fmt.Errorf("authorization webhook returned status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBytes)).Decode(&decision); err != nil {
+		return decision, fmt.Errorf("unable to decode authorization webhook response: %s", err)
+	}
+	return decision, nil
+}
+
+func (w *Webhook) failure(req Request, err error) Decision {
+	log.WithFields(log.Fields{
+		"pod.name":     req.Pod,
+		"ns.name":      req.Namespace,
+		"pod.iam.role": req.Role,
+	}).Errorf("Authorization webhook failed (fail open: %t): %+v", w.FailOpen, err)
+
+	source := "fail_closed"
+	if w.FailOpen {
+		source = "fail_open"
+	}
+	decision := Decision{Allowed: w.FailOpen, Reason: fmt.Sprintf("authorization webhook unavailable: %s", err)}
+	metrics.AuthzDecisionCount.WithLabelValues(decisionLabel(decision), source).Inc()
+	return decision
+}
+
+func decisionLabel(decision Decision) string {
+	if decision.Allowed {
+		return "allow"
+	}
+	return "deny"
+}
+
+// NewWebhook returns a new Webhook authorizer.
+func NewWebhook(url string, timeout time.Duration, failOpen bool, cacheTTL time.Duration) *Webhook {
+	return &Webhook{
+		URL:      url,
+		FailOpen: failOpen,
+		CacheTTL: cacheTTL,
+		Client:   &http.Client{Timeout: timeout},
+		Cache:    ccache.New(ccache.Configure()),
+	}
+}
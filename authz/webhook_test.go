@@ -0,0 +1,125 @@
+package authz
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testRequest() Request {
+	return Request{
+		Pod:            "my-pod",
+		Namespace:      "payments",
+		ServiceAccount: "billing",
+		Role:           "arn:aws:iam::123456789012:role/billing",
+		ExternalID:     "tenant-a",
+		Node:           "node-1",
+	}
+}
+
+// newDecisionServer returns a webhook backend answering with the given decision and counting calls.
+func newDecisionServer(t *testing.T, decision Decision, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode decision request: %v", err)
+		}
+		if req != testRequest() {
+			t.Errorf("unexpected decision request %+v", req)
+		}
+		_ = json.NewEncoder(w).Encode(decision)
+	}))
+}
+
+func TestAuthorizeAllowed(t *testing.T) {
+	var calls int32
+	backend := newDecisionServer(t, Decision{Allowed: true}, &calls)
+	defer backend.Close()
+
+	w := NewWebhook(backend.URL, time.Second, false, 0)
+	if decision := w.Authorize(testRequest()); !decision.Allowed {
+		t.Errorf("expected allowed decision, got %+v", decision)
+	}
+}
+
+func TestAuthorizeDenied(t *testing.T) {
+	var calls int32
+	backend := newDecisionServer(t, Decision{Allowed: false, Reason: "not on the list"}, &calls)
+	defer backend.Close()
+
+	w := NewWebhook(backend.URL, time.Second, true, 0)
+	decision := w.Authorize(testRequest())
+	if decision.Allowed {
+		t.Error("expected denied decision")
+	}
+	if decision.Reason != "not on the list" {
+		t.Errorf("expected webhook reason, got %q", decision.Reason)
+	}
+}
+
+func TestAuthorizeCachesDecisions(t *testing.T) {
+	var calls int32
+	backend := newDecisionServer(t, Decision{Allowed: true}, &calls)
+	defer backend.Close()
+
+	w := NewWebhook(backend.URL, time.Second, false, time.Minute)
+	for i := 0; i < 3; i++ {
+		if decision := w.Authorize(testRequest()); !decision.Allowed {
+			t.Fatalf("expected allowed decision, got %+v", decision)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("expected 1 webhook call with caching, got %d", got)
+	}
+}
+
+func TestAuthorizeFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		failOpen bool
+	}{
+		{
+			name:     "server error fails closed",
+			handler:  func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) },
+			failOpen: false,
+		},
+		{
+			name:     "server error fails open",
+			handler:  func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) },
+			failOpen: true,
+		},
+		{
+			name:     "invalid body fails closed",
+			handler:  func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("not json")) },
+			failOpen: false,
+		},
+		{
+			name:     "timeout fails open",
+			handler:  func(w http.ResponseWriter, r *http.Request) { time.Sleep(200 * time.Millisecond) },
+			failOpen: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewServer(tt.handler)
+			defer backend.Close()
+
+			w := NewWebhook(backend.URL, 50*time.Millisecond, tt.failOpen, time.Minute)
+			decision := w.Authorize(testRequest())
+			if decision.Allowed != tt.failOpen {
+				t.Errorf("expected allowed=%t, got %+v", tt.failOpen, decision)
+			}
+			if decision.Reason == "" {
+				t.Error("expected a failure reason")
+			}
+			if w.Cache.ItemCount() != 0 {
+				t.Error("expected failures not to be cached")
+			}
+		})
+	}
+}
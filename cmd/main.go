@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
@@ -17,6 +21,14 @@ func addFlags(s *server.Server, fs *pflag.FlagSet) {
 	fs.StringVar(&s.KubeconfigPath, "kubeconfig", "", "Path to kubeconfig")
 	fs.StringVar(&s.APIServer, "api-server", s.APIServer, "Endpoint for the api server")
 	fs.StringVar(&s.APIToken, "api-token", s.APIToken, "Token to authenticate with the api server")
+	fs.StringVar(&s.APITokenFile, "api-token-file", s.APITokenFile, "File holding the token to authenticate with the api server, re-read when the token is rotated")
+	fs.StringVar(&s.APIClientCertFile, "api-client-cert", s.APIClientCertFile, "Client certificate file to authenticate with the api server")
+	fs.StringVar(&s.APIClientKeyFile, "api-client-key", s.APIClientKeyFile, "Client key file to authenticate with the api server")
+	fs.StringVar(&s.APICAFile, "api-ca-file", s.APICAFile, "Certificate authority file to verify the api server certificate")
+	fs.Float32Var(&s.APIQPS, "api-qps", s.APIQPS, "Maximum queries per second to the api server (0 uses the client-go default)")
+	fs.IntVar(&s.APIBurst, "api-burst", s.APIBurst, "Maximum burst of queries to the api server (0 uses the client-go default)")
+	fs.DurationVar(&s.APITimeout, "api-timeout", s.APITimeout, "Timeout of the pod lookups with the api server (0 disables the timeout)")
+	fs.StringVar(&s.KubeconfigContext, "kubeconfig-context", s.KubeconfigContext, "Context of the kubeconfig to use (default the current context)")
 	fs.StringVar(&s.AppPort, "app-port", s.AppPort, "Kube2iam server http port")
 	fs.StringVar(&s.MetricsPort, "metrics-port", s.MetricsPort, "Metrics server http port (default: same as kube2iam server port)")
 	fs.StringVar(&s.BaseRoleARN, "base-role-arn", s.BaseRoleARN, "Base role ARN")
@@ -27,17 +39,45 @@ func addFlags(s *server.Server, fs *pflag.FlagSet) {
 	fs.DurationVar(&s.IAMRoleSessionTTL, "iam-role-session-ttl", s.IAMRoleSessionTTL, "TTL for the assume role session")
 	fs.DurationVar(&s.IAMRoleErrorTTL, "iam-role-error-ttl", s.IAMRoleErrorTTL, "TTL for caching assume role errors")
 	fs.BoolVar(&s.Insecure, "insecure", false, "Kubernetes server should be accessed without verifying the TLS. Testing only")
-	fs.StringVar(&s.MetadataAddress, "metadata-addr", s.MetadataAddress, "Address for the ec2 metadata")
+	fs.StringVar(&s.MetadataAddress, "metadata-addr", s.MetadataAddress, "Address for the ec2 metadata, fd00:ec2::254 by default on IPv6 hosts")
 	fs.BoolVar(&s.AddIPTablesRule, "iptables", false, "Add iptables rule (also requires --host-ip)")
 	fs.BoolVar(&s.AutoDiscoverBaseArn, "auto-discover-base-arn", false, "Queries EC2 Metadata to determine the base ARN")
 	fs.BoolVar(&s.AutoDiscoverDefaultRole, "auto-discover-default-role", false, "Queries EC2 Metadata to determine the default Iam Role and base ARN, cannot be used with --default-role, overwrites any previous setting for --base-role-arn")
 	fs.StringVar(&s.HostInterface, "host-interface", "docker0", "Host interface for proxying AWS metadata")
 	fs.BoolVar(&s.NamespaceRestriction, "namespace-restrictions", false, "Enable namespace restrictions")
+	fs.BoolVar(&s.NamespaceRestrictionAudit, "namespace-restrictions-audit", false, "Evaluate namespace restrictions and report would-be denials without enforcing them")
 	fs.StringVar(&s.NamespaceRestrictionFormat, "namespace-restriction-format", s.NamespaceRestrictionFormat, "Namespace Restriction Format (glob/regexp)")
+	fs.DurationVar(&s.GrantExpiryWindow, "grant-expiry-window", s.GrantExpiryWindow, "Window before expiry in which time-bounded namespace role grants are reported as expiring")
+	fs.StringVar(&s.PolicyFile, "policy-file", s.PolicyFile, "Path to a YAML or JSON file of CEL policy rules evaluated for every role request")
+	fs.StringVar(&s.RoleAliasConfigMap, "role-alias-configmap", s.RoleAliasConfigMap, "ConfigMap (namespace/name) mapping role aliases to roles")
+	fs.StringVar(&s.RoleTemplate, "role-template", s.RoleTemplate, "Template of the role used when the annotation is not set, e.g. {{.Namespace}}-{{.ServiceAccount}}")
+	fs.StringVar(&s.NamespaceBaseARNKey, "namespace-base-role-arn-key", s.NamespaceBaseARNKey, "Namespace annotation key used to set the base role ARN of pods in the namespace")
+	fs.StringSliceVar(&s.AllowedAccountIDs, "allowed-account-ids", s.AllowedAccountIDs, "AWS account IDs that roles and namespace base role ARNs may reference (default all)")
+	fs.StringVar(&s.ExternalIDSource, "external-id-source", s.ExternalIDSource, "Source of external IDs (pod/namespace/derived)")
+	fs.StringVar(&s.NamespaceExternalIDKey, "namespace-external-id-key", s.NamespaceExternalIDKey, "Namespace annotation key used to retrieve the external ID with --external-id-source=namespace")
+	fs.StringVar(&s.ExternalIDSaltFile, "external-id-salt-file", s.ExternalIDSaltFile, "File holding the secret salt used to derive external IDs with --external-id-source=derived")
+	fs.BoolVar(&s.ExternalIDStrict, "external-id-strict", false, "Refuse credentials when the pod external ID annotation doesn't match the namespace external ID")
+	fs.StringVar(&s.OptOutRoleValue, "opt-out-role-value", s.OptOutRoleValue, "Role annotation value refusing AWS access to a pod without falling back to the default role, e.g. none")
+	fs.StringVar(&s.StrictNamespaceSelector, "strict-namespace-selector", s.StrictNamespaceSelector, "Label selector of namespaces where pods without a role annotation don't get the default role")
+	fs.StringVar(&s.AuthzWebhookURL, "authz-webhook-url", s.AuthzWebhookURL, "URL of an authorization webhook consulted before issuing credentials")
+	fs.DurationVar(&s.AuthzWebhookTimeout, "authz-webhook-timeout", s.AuthzWebhookTimeout, "Timeout for authorization webhook requests")
+	fs.DurationVar(&s.AuthzWebhookCacheTTL, "authz-webhook-cache-ttl", s.AuthzWebhookCacheTTL, "TTL for caching authorization webhook decisions (0 disables caching)")
+	fs.BoolVar(&s.AuthzWebhookFailOpen, "authz-webhook-fail-open", false, "Issue credentials when the authorization webhook is unavailable")
+	fs.StringVar(&s.NamespaceSelector, "namespace-selector", s.NamespaceSelector, "Label selector of the namespaces cached, other namespaces are handled as namespaces not found")
 	fs.StringVar(&s.NamespaceKey, "namespace-key", s.NamespaceKey, "Namespace annotation key used to retrieve the IAM roles allowed (value in annotation should be json array)")
 	fs.DurationVar(&s.CacheResyncPeriod, "cache-resync-period", s.CacheResyncPeriod, "Kubernetes caches resync period")
-	fs.BoolVar(&s.ResolveDupIPs, "resolve-duplicate-cache-ips", false, "Queries the k8s api server to find the source of truth when the pod cache contains multiple pods with the same IP")
+	fs.BoolVar(&s.ResolveDupIPs, "resolve-duplicate-cache-ips", false, "Picks the pod using an IP shared by several cached pods, querying the k8s api server for the node's pods when the cache can't tell them apart")
+	fs.DurationVar(&s.PodLookupWait, "pod-lookup-wait", s.PodLookupWait, "Time to wait for a pod missing from the cache to be indexed (0 disables waiting)")
+	fs.BoolVar(&s.PodAPILookup, "pod-api-lookup", false, "Look up pods still missing from the cache after --pod-lookup-wait with the k8s api server")
+	fs.DurationVar(&s.ShutdownDelay, "shutdown-delay", s.ShutdownDelay, "Time during which the healthchecks fail while requests are still served before shutting down")
+	fs.DurationVar(&s.ShutdownTimeout, "shutdown-timeout", s.ShutdownTimeout, "Time to wait for in-flight requests to complete on shutdown")
+	fs.BoolVar(&s.PreflightEnabled, "preflight", false, "Check the node identity at startup and periodically, failing the readiness check when it can't assume roles")
+	fs.StringVar(&s.PreflightCanaryRole, "preflight-canary-role", s.PreflightCanaryRole, "Role assumed by the preflight checks to check that the node identity can assume roles")
+	fs.BoolVar(&s.PreflightStrict, "preflight-strict", false, "Refuse to start when the preflight checks fail, including when the node identity is not in the account of --base-role-arn (implies --preflight)")
+	fs.DurationVar(&s.InformerStaleThreshold, "informer-stale-threshold", s.InformerStaleThreshold, "Time without activity after which the watch of an informer is restarted and the healthcheck fails until it recovers (0 disables)")
 	fs.StringVar(&s.HostIP, "host-ip", s.HostIP, "IP address of host")
+	fs.BoolVar(&s.HostNetworkAttribution, "hostnetwork-attribution", false, "Identify hostNetwork pods by the owner of the connecting socket (requires --host-ip and hostPID)")
+	fs.StringVar(&s.ProcfsRoot, "procfs-root", s.ProcfsRoot, "Mount point of the host procfs used by --hostnetwork-attribution")
 	fs.StringVar(&s.NodeName, "node", s.NodeName, "Name of the node where kube2iam is running")
 	fs.DurationVar(&s.BackoffMaxInterval, "backoff-max-interval", s.BackoffMaxInterval, "Max interval for backoff when querying for role.")
 	fs.DurationVar(&s.BackoffMaxElapsedTime, "backoff-max-elapsed-time", s.BackoffMaxElapsedTime, "Max elapsed time for backoff when querying for role.")
@@ -48,6 +88,15 @@ func addFlags(s *server.Server, fs *pflag.FlagSet) {
 	fs.BoolVar(&s.Version, "version", false, "Print the version and exits")
 }
 
+// imdsClient returns the client of the instance metadata service at the configured metadata address.
+func imdsClient(s *server.Server) iam.IMDSClient {
+	client, err := iam.NewIMDSClient(s.MetadataAddress)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	return client
+}
+
 func main() {
 	s := server.NewServer()
 	addFlags(s, pflag.CommandLine)
@@ -72,6 +121,11 @@ func main() {
 		version.PrintVersionAndExit()
 	}
 
+	if !pflag.CommandLine.Changed("metadata-addr") && iam.IsIPv6Address(s.HostIP) {
+		s.MetadataAddress = server.DefaultIPv6MetadataAddress
+		log.Infof("IPv6 host IP, using metadata address %s", s.MetadataAddress)
+	}
+
 	if s.BaseRoleARN != "" {
 		if !iam.IsValidBaseARN(s.BaseRoleARN) {
 			log.Fatalf("Invalid --base-role-arn specified, expected: %s", iam.ARNRegexp.String())
@@ -85,7 +139,7 @@ func main() {
 		if s.BaseRoleARN != "" {
 			log.Fatal("--auto-discover-base-arn cannot be used if --base-role-arn is specified")
 		}
-		arn, err := iam.GetBaseArn()
+		arn, err := iam.GetBaseArnWithClient(imdsClient(s))
 		if err != nil {
 			log.Fatalf("%s", err)
 		}
@@ -97,12 +151,13 @@ func main() {
 		if s.DefaultIAMRole != "" {
 			log.Fatalf("You cannot use --default-role and --auto-discover-default-role at the same time")
 		}
-		arn, err := iam.GetBaseArn()
+		client := imdsClient(s)
+		arn, err := iam.GetBaseArnWithClient(client)
 		if err != nil {
 			log.Fatalf("%s", err)
 		}
 		s.BaseRoleARN = arn
-		instanceIAMRole, err := iam.GetInstanceIAMRole()
+		instanceIAMRole, err := iam.GetInstanceIAMRoleWithClient(client)
 		if err != nil {
 			log.Fatalf("%s", err)
 		}
@@ -110,13 +165,26 @@ func main() {
 		log.Infof("Using instance IAMRole %s%s as default", s.BaseRoleARN, s.DefaultIAMRole)
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// Checked before redirecting the metadata requests of pods to kube2iam
+	if s.PreflightEnabled || s.PreflightStrict {
+		if err := s.Preflight(ctx); err != nil {
+			if s.PreflightStrict {
+				log.Fatalf("Preflight checks failed: %s", err)
+			}
+			log.Warnf("Preflight checks failed, kube2iam won't be ready until they pass: %s", err)
+		}
+	}
+
 	if s.AddIPTablesRule {
 		if err := iptables.AddRule(s.AppPort, s.MetadataAddress, s.HostInterface, s.HostIP); err != nil {
 			log.Fatalf("%s", err)
 		}
 	}
 
-	if err := s.Run(s.KubeconfigPath, s.APIServer, s.APIToken, s.NodeName, s.Insecure); err != nil {
+	if err := s.Run(ctx); err != nil {
 		log.Fatalf("%s", err)
 	}
 }
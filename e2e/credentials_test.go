@@ -133,7 +133,7 @@ func TestAnnotatedPodGetsCreds(t *testing.T) {
 // cannot obtain credentials. kube2iam returns HTTP 200 with an empty body (no role
 // name listed) rather than 404. This is because --base-role-arn is always set, and
 // RoleARN("") resolves to just the base ARN prefix — which is non-empty, so the
-// 404 code path in extractRoleARN is not reached. The security property still holds:
+// 404 code path in selectRoleARNs is not reached. The security property still holds:
 // an empty role list means no credentials can be fetched.
 func TestUnannotatedPodNoCredentials(t *testing.T) {
 	feature := features.New("unannotated_pod_denial").
@@ -0,0 +1,173 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkTimeout bounds the duration of a periodic check.
+const checkTimeout = 10 * time.Second
+
+var errNotPerformed = errors.New("check not yet performed")
+
+// Check returns an error when the component it checks is unhealthy.
+type Check func(ctx context.Context) error
+
+// Status is the last result of a check.
+type Status struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// Response is the verbose response of a registry handler.
+type Response struct {
+	Healthy bool     `json:"healthy"`
+	Checks  []Status `json:"checks"`
+}
+
+type check struct {
+	name     string
+	interval time.Duration
+	fn       Check
+
+	mu     sync.Mutex
+	status Status
+}
+
+func (c *check) run(ctx context.Context) Status {
+	status := Status{Name: c.name, Healthy: true, CheckedAt: time.Now()}
+	if err := c.fn(ctx); err != nil {
+		status.Healthy = false
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func (c *check) record(status Status) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !status.Healthy && (c.status.Healthy || c.status.CheckedAt.IsZero()) {
+		log.Warnf("Check %s failed: %s", c.name, status.Error)
+	}
+	c.status = status
+}
+
+// poll runs the check every interval until the context is done.
+func (c *check) poll(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, min(c.interval, checkTimeout))
+		status := c.run(checkCtx)
+		cancel()
+		c.record(status)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Registry holds named checks, each run with its own interval, and serves their results.
+type Registry struct {
+	mu     sync.Mutex
+	checks []*check
+	ctx    context.Context
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds a named check. Checks with an interval are run in the background once the registry is
+// started, requests being answered with their last result. Checks without interval are cheap checks run
+// on every request.
+func (r *Registry) Register(name string, interval time.Duration, fn Check) {
+	c := &check{
+		name:     name,
+		interval: interval,
+		fn:       fn,
+		status:   Status{Name: name, Error: errNotPerformed.Error()},
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks = append(r.checks, c)
+	if r.ctx != nil && interval > 0 {
+		go c.poll(r.ctx)
+	}
+}
+
+// Start runs the periodic checks, including the checks registered later, until the context is done.
+func (r *Registry) Start(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ctx = ctx
+	for _, c := range r.checks {
+		if c.interval > 0 {
+			go c.poll(ctx)
+		}
+	}
+}
+
+// Statuses returns the status of every check, running the checks without interval.
+func (r *Registry) Statuses(ctx context.Context) []Status {
+	r.mu.Lock()
+	checks := append([]*check(nil), r.checks...)
+	r.mu.Unlock()
+
+	statuses := make([]Status, 0, len(checks))
+	for _, c := range checks {
+		if c.interval <= 0 {
+			statuses = append(statuses, c.run(ctx))
+			continue
+		}
+		c.mu.Lock()
+		statuses = append(statuses, c.status)
+		c.mu.Unlock()
+	}
+	return statuses
+}
+
+// Handler returns a handler answering 200 when every check passes and 503 otherwise, with the failed
+// checks in the body, or with the status of every check as JSON with the verbose query parameter.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		statuses := r.Statuses(req.Context())
+		var failed []string
+		for _, status := range statuses {
+			if !status.Healthy {
+				failed = append(failed, fmt.Sprintf("%s: %s", status.Name, status.Error))
+			}
+		}
+		code := http.StatusOK
+		if len(failed) > 0 {
+			code = http.StatusServiceUnavailable
+		}
+
+		if _, verbose := req.URL.Query()["verbose"]; verbose {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			if err := json.NewEncoder(w).Encode(Response{Healthy: len(failed) == 0, Checks: statuses}); err != nil {
+				log.Errorf("Error sending json %+v", err)
+			}
+			return
+		}
+		if len(failed) > 0 {
+			http.Error(w, strings.Join(failed, "\n"), code)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+}
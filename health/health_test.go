@@ -0,0 +1,130 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// get serves a request to the registry handler.
+func get(r *Registry, target string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, target, nil))
+	return rw
+}
+
+// waitFor polls the condition until it holds or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// ---- Handler ----------------------------------------------------------------
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		checks       map[string]error
+		expectedCode int
+		expectedBody string
+	}{
+		{"no checks", nil, http.StatusOK, "ok"},
+		{"all pass", map[string]error{"a": nil, "b": nil}, http.StatusOK, "ok"},
+		{"one fails", map[string]error{"a": nil, "b": errors.New("unreachable")}, http.StatusServiceUnavailable, "b: unreachable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry()
+			for name, err := range tt.checks {
+				r.Register(name, 0, func(context.Context) error { return err })
+			}
+			rw := get(r, "/readyz")
+			if rw.Code != tt.expectedCode {
+				t.Errorf("expected %d, got %d", tt.expectedCode, rw.Code)
+			}
+			if !strings.Contains(rw.Body.String(), tt.expectedBody) {
+				t.Errorf("expected body to contain %q, got %q", tt.expectedBody, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandlerVerbose(t *testing.T) {
+	r := NewRegistry()
+	r.Register("pass", 0, func(context.Context) error { return nil })
+	r.Register("fail", 0, func(context.Context) error { return errors.New("boom") })
+
+	rw := get(r, "/readyz?verbose")
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", rw.Code)
+	}
+	var resp Response
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Healthy || len(resp.Checks) != 2 {
+		t.Fatalf("expected an unhealthy response with 2 checks, got %+v", resp)
+	}
+	if !resp.Checks[0].Healthy || resp.Checks[0].Name != "pass" {
+		t.Errorf("expected check pass to be healthy, got %+v", resp.Checks[0])
+	}
+	if resp.Checks[1].Healthy || resp.Checks[1].Error != "boom" {
+		t.Errorf("expected check fail to report its error, got %+v", resp.Checks[1])
+	}
+}
+
+// ---- Periodic checks --------------------------------------------------------
+
+func TestPeriodicCheck(t *testing.T) {
+	var calls atomic.Int32
+	var failing atomic.Bool
+	r := NewRegistry()
+	r.Register("periodic", 20*time.Millisecond, func(context.Context) error {
+		calls.Add(1)
+		if failing.Load() {
+			return errors.New("down")
+		}
+		return nil
+	})
+
+	if rw := get(r, "/readyz"); rw.Code != http.StatusServiceUnavailable || !strings.Contains(rw.Body.String(), errNotPerformed.Error()) {
+		t.Errorf("expected the check to fail before the registry is started, got %d: %q", rw.Code, rw.Body.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Start(ctx)
+	waitFor(t, 2*time.Second, func() bool { return get(r, "/readyz").Code == http.StatusOK })
+
+	failing.Store(true)
+	waitFor(t, 2*time.Second, func() bool { return get(r, "/readyz").Code == http.StatusServiceUnavailable })
+
+	// Requests are answered with the last result without running the check
+	before := calls.Load()
+	get(r, "/readyz")
+	if calls.Load() > before+1 {
+		t.Errorf("expected requests not to run periodic checks, got %d calls", calls.Load()-before)
+	}
+}
+
+func TestRegisterAfterStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := NewRegistry()
+	r.Start(ctx)
+	r.Register("late", time.Hour, func(context.Context) error { return nil })
+
+	waitFor(t, 2*time.Second, func() bool { return get(r, "/readyz").Code == http.StatusOK })
+}
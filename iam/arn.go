@@ -28,6 +28,27 @@ func (iam *Client) RoleARN(role string) string {
 	return fmt.Sprintf("%s%s", iam.BaseARN, role)
 }
 
+// RoleARNWithBase returns the full iam role ARN using the given base ARN,
+// or the client base ARN when base is empty.
+func (iam *Client) RoleARNWithBase(base, role string) string {
+	if base == "" {
+		return iam.RoleARN(role)
+	}
+	if strings.HasPrefix(strings.ToLower(role), fullArnPrefix) {
+		return role
+	}
+	return fmt.Sprintf("%s%s", base, role)
+}
+
+// AccountID returns the account ID of an ARN.
+func AccountID(arn string) (string, bool) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) < 6 || parts[0] != "arn" || parts[4] == "" {
+		return "", false
+	}
+	return parts[4], true
+}
+
 // GetBaseArn gets the base ARN from the metadata service.
 // If client is nil, a default IMDS client is created.
 func GetBaseArn() (string, error) {
@@ -87,6 +87,63 @@ func TestRoleARNNoBaseARN(t *testing.T) {
 	}
 }
 
+func TestRoleARNWithBase(t *testing.T) {
+	client := &Client{BaseARN: "arn:aws:iam::123456789012:role/"}
+
+	tests := []struct {
+		name     string
+		base     string
+		role     string
+		expected string
+	}{
+		{
+			name:     "empty base uses client base ARN",
+			role:     "my-role",
+			expected: "arn:aws:iam::123456789012:role/my-role",
+		},
+		{
+			name:     "base ARN is prepended",
+			base:     "arn:aws:iam::999999999999:role/",
+			role:     "my-role",
+			expected: "arn:aws:iam::999999999999:role/my-role",
+		},
+		{
+			name:     "full ARN is returned unchanged",
+			base:     "arn:aws:iam::999999999999:role/",
+			role:     "arn:aws:iam::111111111111:role/other",
+			expected: "arn:aws:iam::111111111111:role/other",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := client.RoleARNWithBase(tt.base, tt.role); got != tt.expected {
+				t.Errorf("RoleARNWithBase(%q, %q) = %q, want %q", tt.base, tt.role, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAccountID(t *testing.T) {
+	tests := []struct {
+		arn      string
+		expected string
+		ok       bool
+	}{
+		{arn: "arn:aws:iam::123456789012:role/my-role", expected: "123456789012", ok: true},
+		{arn: "arn:aws-cn:iam::999999999999:role/", expected: "999999999999", ok: true},
+		{arn: "my-role"},
+		{arn: "arn:aws:s3:::my-bucket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arn, func(t *testing.T) {
+			got, ok := AccountID(tt.arn)
+			if got != tt.expected || ok != tt.ok {
+				t.Errorf("AccountID(%q) = %q, %t, want %q, %t", tt.arn, got, ok, tt.expected, tt.ok)
+			}
+		})
+	}
+}
+
 func TestGetBaseArnWithClient(t *testing.T) {
 	mockIMDS := &MockIMDSClient{
 		GetIAMInfoFunc: func(ctx context.Context, params *imds.GetIAMInfoInput, optFns ...func(*imds.Options)) (*imds.GetIAMInfoOutput, error) {
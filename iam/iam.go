@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"hash/fnv"
 	"io"
+	"net/netip"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -19,17 +21,16 @@ import (
 	"github.com/karlseguin/ccache"
 )
 
-var cache = ccache.New(ccache.Configure())
-
-var errorCache = ccache.New(ccache.Configure())
-
 const (
 	maxSessNameLength = 64
+	// minSessionDuration is the shortest session STS issues, in seconds
+	minSessionDuration = 900
 )
 
 // STSClient represents the subset of sts.Client methods used by the iam package.
 type STSClient interface {
 	AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error)
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
 }
 
 // RegionClient represents the subset of ec2.Client methods used by the iam package.
@@ -43,6 +44,17 @@ type IMDSClient interface {
 	GetIAMInfo(ctx context.Context, params *imds.GetIAMInfoInput, optFns ...func(*imds.Options)) (*imds.GetIAMInfoOutput, error)
 }
 
+// CredentialsProvider issues the credentials of IAM roles. Client is the default provider, assuming
+// roles with AWS STS.
+type CredentialsProvider interface {
+	// AssumeRole returns the credentials of the role for the pod with the remote IP. Credentials are cached
+	// per role and external ID for the session TTL and errors for the error TTL.
+	AssumeRole(roleARN, externalID, remoteIP string, sessionTTL, errorTTL time.Duration) (*Credentials, error)
+	// EvictRoles removes the cached credentials of the roles matching the given function
+	// and returns the number of credentials evicted.
+	EvictRoles(match func(roleARN string) bool) int
+}
+
 // Client represents an IAM client.
 type Client struct {
 	BaseARN             string
@@ -53,6 +65,10 @@ type Client struct {
 	IMDS                IMDSClient
 	Cache               *ccache.Cache
 	ErrorCache          *ccache.Cache
+
+	// issued maps the cache keys of the cached credentials to their role ARN
+	issued    sync.Map
+	cacheOnce sync.Once
 }
 
 // Credentials represent the security Credentials response.
@@ -77,11 +93,37 @@ func getHash(text string) string {
 
 // newIMDSClient returns a default imds.Client from the AWS config.
 func newIMDSClient() (IMDSClient, error) {
+	return NewIMDSClient("")
+}
+
+// NewIMDSClient returns an imds.Client from the AWS config. When the metadata address is an IPv6
+// address, e.g. fd00:ec2::254 on IPv6-only nodes, the client uses it in IPv6 endpoint mode.
+func NewIMDSClient(metadataAddress string) (IMDSClient, error) {
 	cfg, err := config.LoadDefaultConfig(context.TODO())
 	if err != nil {
 		return nil, err
 	}
-	return imds.NewFromConfig(cfg), nil
+	if !IsIPv6Address(metadataAddress) {
+		return imds.NewFromConfig(cfg), nil
+	}
+	return imds.NewFromConfig(cfg, func(o *imds.Options) {
+		o.EndpointMode = imds.EndpointModeStateIPv6
+		o.Endpoint = "http://" + MetadataHost(metadataAddress)
+	}), nil
+}
+
+// IsIPv6Address returns whether an address, optionally bracketed, is an IPv6 address.
+func IsIPv6Address(address string) bool {
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(address, "["), "]"))
+	return err == nil && addr.Is6() && !addr.Is4In6()
+}
+
+// MetadataHost returns the metadata address as an URL host, i.e. with IPv6 addresses bracketed.
+func MetadataHost(address string) string {
+	if strings.HasPrefix(address, "[") || !IsIPv6Address(address) {
+		return address
+	}
+	return "[" + address + "]"
 }
 
 // getMetadataPath retrieves a path from the IMDS using the given client.
@@ -112,9 +154,17 @@ func getMetadataPath(client IMDSClient, path string) (string, error) {
 
 // GetInstanceIAMRole get instance IAM role from metadata service.
 func GetInstanceIAMRole() (string, error) {
-	client, err := newIMDSClient()
-	if err != nil {
-		return "", err
+	return GetInstanceIAMRoleWithClient(nil)
+}
+
+// GetInstanceIAMRoleWithClient gets the instance IAM role using the provided IMDSClient.
+func GetInstanceIAMRoleWithClient(client IMDSClient) (string, error) {
+	if client == nil {
+		var err error
+		client, err = newIMDSClient()
+		if err != nil {
+			return "", err
+		}
 	}
 	return getMetadataPath(client, "iam/security-credentials/")
 }
@@ -173,18 +223,26 @@ func IsValidRegion(promisedLand string, regions *ec2.DescribeRegionsOutput) bool
 	return false
 }
 
+// initCaches creates the caches not set on the client, e.g. on a Client not created with NewClient.
+func (iam *Client) initCaches() {
+	iam.cacheOnce.Do(func() {
+		if iam.Cache == nil {
+			iam.Cache = ccache.New(ccache.Configure())
+		}
+		if iam.ErrorCache == nil {
+			iam.ErrorCache = ccache.New(ccache.Configure())
+		}
+	})
+}
+
 func (iam *Client) getCache() *ccache.Cache {
-	if iam.Cache != nil {
-		return iam.Cache
-	}
-	return cache
+	iam.initCaches()
+	return iam.Cache
 }
 
 func (iam *Client) getErrorCache() *ccache.Cache {
-	if iam.ErrorCache != nil {
-		return iam.ErrorCache
-	}
-	return errorCache
+	iam.initCaches()
+	return iam.ErrorCache
 }
 
 // Regions list to validate input region name
@@ -215,11 +273,81 @@ func (iam *Client) getRegions() (*ec2.DescribeRegionsOutput, error) {
 	return regionsCache.Value().(*ec2.DescribeRegionsOutput), nil
 }
 
+// stsClient returns the STS client, using the regional STS endpoint of the configured region when valid.
+func (iam *Client) stsClient() (STSClient, error) {
+	regions, err := iam.getRegions()
+	if err != nil {
+		return nil, err
+	}
+	if iam.STS != nil {
+		return iam.STS, nil
+	}
+
+	var customSTSResolver = aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) { //nolint:staticcheck
+		if service == sts.ServiceID && IsValidRegion(region, regions) {
+			return aws.Endpoint{ //nolint:staticcheck
+				URL:           GetEndpointFromRegion(region),
+				SigningRegion: region,
+			}, nil
+		}
+
+		// returning EndpointNotFoundError will allow the service to fallback to it's default resolution
+		return aws.Endpoint{}, &aws.EndpointNotFoundError{} //nolint:staticcheck
+	})
+
+	cfg, err := config.LoadDefaultConfig(
+		context.TODO(),
+		config.WithEndpointResolverWithOptions(customSTSResolver), //nolint:staticcheck
+	)
+	if err != nil {
+		return nil, err
+	}
+	return sts.NewFromConfig(cfg), nil
+}
+
+// CallerIdentity returns the ARN of the identity kube2iam assumes roles with, checking that STS is
+// reachable and the node credentials are valid. It needs no IAM permission.
+func (iam *Client) CallerIdentity(ctx context.Context) (string, error) {
+	svc, err := iam.stsClient()
+	if err != nil {
+		return "", err
+	}
+	identity, err := svc.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(identity.Arn), nil
+}
+
+// CheckAssumeRole assumes the role with STS to check that the node may assume it. Unlike AssumeRole,
+// the credentials and errors are not cached, so that every check calls STS and pods never get the
+// credentials of a check.
+func (iam *Client) CheckAssumeRole(ctx context.Context, roleARN, remoteIP string) error {
+	svc, err := iam.stsClient()
+	if err != nil {
+		return err
+	}
+	_, err = svc.AssumeRole(ctx, &sts.AssumeRoleInput{
+		DurationSeconds: aws.Int32(minSessionDuration),
+		RoleArn:         aws.String(roleARN),
+		RoleSessionName: aws.String(sessionName(roleARN, remoteIP)),
+	})
+	return err
+}
+
+// credentialsKey returns the cache key of the credentials of a role assumed with an external ID. Credentials
+// are never shared between external IDs, so that a pod doesn't get the credentials obtained with the external
+// ID of another namespace, STS only checking the external ID when the role is assumed.
+func credentialsKey(roleARN, externalID string) string {
+	return roleARN + "|" + externalID
+}
+
 // AssumeRole returns an IAM role Credentials using AWS STS.
 func (iam *Client) AssumeRole(roleARN, externalID string, remoteIP string, sessionTTL time.Duration, errorTTL time.Duration) (*Credentials, error) {
+	key := credentialsKey(roleARN, externalID)
 	hitCache := true
-	item, err := iam.getCache().Fetch(roleARN, sessionTTL, func() (interface{}, error) {
-		errItem := iam.getErrorCache().Get(roleARN)
+	item, err := iam.getCache().Fetch(key, sessionTTL, func() (interface{}, error) {
+		errItem := iam.getErrorCache().Get(key)
 		if errItem != nil && !errItem.Expired() {
 			return nil, errItem.Value().(error)
 		}
@@ -234,37 +362,12 @@ func (iam *Client) AssumeRole(roleARN, externalID string, remoteIP string, sessi
 		timer := metrics.NewFunctionTimer(metrics.IamRequestSec, lvsProducer, nil)
 		defer timer.ObserveDuration()
 
-		regions, err := iam.getRegions()
+		svc, err := iam.stsClient()
 		if err != nil {
-			iam.getErrorCache().Set(roleARN, err, errorTTL)
+			iam.getErrorCache().Set(key, err, errorTTL)
 			return nil, err
 		}
 
-		var customSTSResolver = aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) { //nolint:staticcheck
-			if service == sts.ServiceID && IsValidRegion(region, regions) {
-				return aws.Endpoint{ //nolint:staticcheck
-					URL:           GetEndpointFromRegion(region),
-					SigningRegion: region,
-				}, nil
-			}
-
-			// returning EndpointNotFoundError will allow the service to fallback to it's default resolution
-			return aws.Endpoint{}, &aws.EndpointNotFoundError{} //nolint:staticcheck
-		})
-
-		svc := iam.STS
-		if svc == nil {
-			cfg, err := config.LoadDefaultConfig(
-				context.TODO(),
-				config.WithEndpointResolverWithOptions(customSTSResolver), //nolint:staticcheck
-			)
-			if err != nil {
-				iam.getErrorCache().Set(roleARN, err, errorTTL)
-				return nil, err
-			}
-			svc = sts.NewFromConfig(cfg)
-		}
-
 		assumeRoleInput := sts.AssumeRoleInput{
 			DurationSeconds: aws.Int32(int32(sessionTTL.Seconds() * 2)),
 			RoleArn:         aws.String(roleARN),
@@ -280,7 +383,7 @@ func (iam *Client) AssumeRole(roleARN, externalID string, remoteIP string, sessi
 		// https://github.com/aws/aws-sdk-go-v2/blob/credentials/v1.12.10/credentials/stscreds/assume_role_provider.go#L270
 		resp, err := svc.AssumeRole(context.TODO(), &assumeRoleInput)
 		if err != nil {
-			iam.getErrorCache().Set(roleARN, err, errorTTL)
+			iam.getErrorCache().Set(key, err, errorTTL)
 			return nil, err
 		}
 
@@ -300,14 +403,35 @@ func (iam *Client) AssumeRole(roleARN, externalID string, remoteIP string, sessi
 	if err != nil {
 		return nil, err
 	}
+	iam.issued.Store(key, roleARN)
 	return item.Value().(*Credentials), nil
 }
 
+// EvictRoles removes the cached credentials of the roles matching the given function, whatever the
+// external ID they were assumed with, and returns the number of credentials evicted. Credentials that
+// already expired are removed but not counted.
+func (iam *Client) EvictRoles(match func(roleARN string) bool) int {
+	evicted := 0
+	iam.issued.Range(func(key, roleARN interface{}) bool {
+		if match(roleARN.(string)) {
+			if item := iam.getCache().Get(key.(string)); item != nil && !item.Expired() {
+				evicted++
+			}
+			iam.getCache().Delete(key.(string))
+			iam.issued.Delete(key)
+		}
+		return true
+	})
+	return evicted
+}
+
 // NewClient returns a new IAM client.
 func NewClient(baseARN string, regional bool) *Client {
 	return &Client{
 		BaseARN:             baseARN,
 		Endpoint:            "sts.amazonaws.com",
 		UseRegionalEndpoint: regional,
+		Cache:               ccache.New(ccache.Configure()),
+		ErrorCache:          ccache.New(ccache.Configure()),
 	}
 }
@@ -41,13 +41,18 @@ var validEc2Regions = ec2.DescribeRegionsOutput{
 // ---- mock clients -----------------------------------------------------------
 
 type MockSTSClient struct {
-	AssumeRoleFunc func(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error)
+	AssumeRoleFunc        func(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error)
+	GetCallerIdentityFunc func(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
 }
 
 func (m *MockSTSClient) AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
 	return m.AssumeRoleFunc(ctx, params, optFns...)
 }
 
+func (m *MockSTSClient) GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	return m.GetCallerIdentityFunc(ctx, params, optFns...)
+}
+
 type MockRegionClient struct {
 	DescribeRegionsFunc func(ctx context.Context, params *ec2.DescribeRegionsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error)
 }
@@ -354,6 +359,216 @@ func TestAssumeRoleCache(t *testing.T) {
 	}
 }
 
+func TestCallerIdentity(t *testing.T) {
+	iamClient := newTestIAMClient()
+	iamClient.STS = &MockSTSClient{
+		GetCallerIdentityFunc: func(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+			return &sts.GetCallerIdentityOutput{Arn: stringPointer("arn:aws:sts::123456789012:assumed-role/node/i-0123")}, nil
+		},
+	}
+
+	arn, err := iamClient.CallerIdentity(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if arn != "arn:aws:sts::123456789012:assumed-role/node/i-0123" {
+		t.Errorf("unexpected caller identity %q", arn)
+	}
+
+	iamClient.STS = &MockSTSClient{
+		GetCallerIdentityFunc: func(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+			return nil, errors.New("ExpiredToken")
+		},
+	}
+	if _, err := iamClient.CallerIdentity(context.Background()); err == nil {
+		t.Error("expected error when STS fails, got nil")
+	}
+}
+
+func TestCheckAssumeRoleNotCached(t *testing.T) {
+	callCount := 0
+	var stsErr error
+	iamClient := newTestIAMClient()
+	iamClient.STS = &MockSTSClient{
+		AssumeRoleFunc: func(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+			callCount++
+			if stsErr != nil {
+				return nil, stsErr
+			}
+			return &sts.AssumeRoleOutput{
+				Credentials: &ststypes.Credentials{
+					AccessKeyId:     stringPointer("AKIAEXAMPLE"),
+					SecretAccessKey: stringPointer("secret"),
+					SessionToken:    stringPointer("token"),
+					Expiration:      aws.Time(time.Now().Add(time.Hour)),
+				},
+			}, nil
+		},
+	}
+
+	roleARN := "arn:aws:iam::123456789012:role/canary"
+	if err := iamClient.CheckAssumeRole(context.Background(), roleARN, "1.2.3.4"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stsErr = errors.New("AccessDenied")
+	if err := iamClient.CheckAssumeRole(context.Background(), roleARN, "1.2.3.4"); err == nil {
+		t.Error("expected the second check to call STS and fail, got nil")
+	}
+	if callCount != 2 {
+		t.Errorf("expected STS to be called for every check, got %d calls", callCount)
+	}
+	key := credentialsKey(roleARN, "")
+	if iamClient.Cache.Get(key) != nil || iamClient.ErrorCache.Get(key) != nil {
+		t.Error("expected the credentials and errors of checks not to be cached")
+	}
+}
+
+func TestAssumeRoleCachePerClient(t *testing.T) {
+	callCount := 0
+	stsClient := &MockSTSClient{
+		AssumeRoleFunc: func(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+			callCount++
+			return &sts.AssumeRoleOutput{
+				Credentials: &ststypes.Credentials{
+					AccessKeyId:     stringPointer("AKIAEXAMPLE"),
+					SecretAccessKey: stringPointer("secret"),
+					SessionToken:    stringPointer("token"),
+					Expiration:      aws.Time(time.Now().Add(time.Hour)),
+				},
+			}, nil
+		},
+	}
+
+	roleARN := "arn:aws:iam::123456789012:role/per-client-role"
+	for i := 0; i < 2; i++ {
+		// Clients not created with NewClient get their own caches
+		iamClient := &Client{STS: stsClient, Region: newTestIAMClient().Region}
+		for j := 0; j < 2; j++ {
+			if _, err := iamClient.AssumeRole(roleARN, "", "1.2.3.4", time.Hour, time.Minute); err != nil {
+				t.Fatalf("AssumeRole failed: %v", err)
+			}
+		}
+	}
+
+	if callCount != 2 {
+		t.Errorf("expected STS to be called once per client, got %d calls", callCount)
+	}
+}
+
+func TestAssumeRoleCachePerExternalID(t *testing.T) {
+	var externalIDs []string
+	iamClient := newTestIAMClient()
+	iamClient.STS = &MockSTSClient{
+		AssumeRoleFunc: func(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+			externalIDs = append(externalIDs, aws.ToString(params.ExternalId))
+			return &sts.AssumeRoleOutput{
+				Credentials: &ststypes.Credentials{
+					AccessKeyId:     stringPointer("AKIA" + aws.ToString(params.ExternalId)),
+					SecretAccessKey: stringPointer("secret"),
+					SessionToken:    stringPointer("token"),
+					Expiration:      aws.Time(time.Now().Add(time.Hour)),
+				},
+			}, nil
+		},
+	}
+
+	// Pods of two namespaces assuming the same role with their namespace external ID, and twice each
+	roleARN := "arn:aws:iam::123456789012:role/shared-role"
+	for i := 0; i < 2; i++ {
+		for _, externalID := range []string{"namespace-a", "namespace-b", ""} {
+			creds, err := iamClient.AssumeRole(roleARN, externalID, "1.2.3.4", time.Hour, time.Minute)
+			if err != nil {
+				t.Fatalf("AssumeRole failed: %v", err)
+			}
+			if creds.AccessKeyID != "AKIA"+externalID {
+				t.Errorf("expected the credentials assumed with external ID %q, got %s", externalID, creds.AccessKeyID)
+			}
+		}
+	}
+	if strings.Join(externalIDs, ",") != "namespace-a,namespace-b," {
+		t.Errorf("expected STS to be called once per external ID, got %q", externalIDs)
+	}
+
+	if evicted := iamClient.EvictRoles(func(arn string) bool { return arn == roleARN }); evicted != 3 {
+		t.Errorf("expected the credentials of every external ID to be evicted, got %d", evicted)
+	}
+}
+
+func TestAssumeRoleErrorCachePerExternalID(t *testing.T) {
+	iamClient := newTestIAMClient()
+	iamClient.STS = &MockSTSClient{
+		AssumeRoleFunc: func(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+			if aws.ToString(params.ExternalId) != "namespace-a" {
+				return nil, errors.New("AccessDenied")
+			}
+			return &sts.AssumeRoleOutput{
+				Credentials: &ststypes.Credentials{
+					AccessKeyId:     stringPointer("AKIAEXAMPLE"),
+					SecretAccessKey: stringPointer("secret"),
+					SessionToken:    stringPointer("token"),
+					Expiration:      aws.Time(time.Now().Add(time.Hour)),
+				},
+			}, nil
+		},
+	}
+
+	roleARN := "arn:aws:iam::123456789012:role/shared-role"
+	if _, err := iamClient.AssumeRole(roleARN, "namespace-b", "1.2.3.4", time.Hour, time.Minute); err == nil {
+		t.Fatal("expected an error with the wrong external ID")
+	}
+	if _, err := iamClient.AssumeRole(roleARN, "namespace-a", "1.2.3.4", time.Hour, time.Minute); err != nil {
+		t.Errorf("expected the error of another external ID not to be cached for namespace-a, got %v", err)
+	}
+}
+
+func TestEvictRoles(t *testing.T) {
+	callCount := 0
+	iamClient := newTestIAMClient()
+	iamClient.STS = &MockSTSClient{
+		AssumeRoleFunc: func(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+			callCount++
+			return &sts.AssumeRoleOutput{
+				Credentials: &ststypes.Credentials{
+					AccessKeyId:     stringPointer("AKIAEXAMPLE"),
+					SecretAccessKey: stringPointer("secret"),
+					SessionToken:    stringPointer("token"),
+					Expiration:      aws.Time(time.Now().Add(time.Hour)),
+				},
+			}, nil
+		},
+	}
+
+	contractor := "arn:aws:iam::123456789012:role/contractor-reader"
+	other := "arn:aws:iam::123456789012:role/other"
+	for _, roleARN := range []string{contractor, other} {
+		if _, err := iamClient.AssumeRole(roleARN, "", "1.2.3.4", time.Hour, time.Minute); err != nil {
+			t.Fatalf("AssumeRole failed: %v", err)
+		}
+	}
+
+	evicted := iamClient.EvictRoles(func(roleARN string) bool { return strings.Contains(roleARN, "contractor") })
+	if evicted != 1 {
+		t.Errorf("expected 1 role evicted, got %d", evicted)
+	}
+	for _, roleARN := range []string{contractor, other} {
+		if _, err := iamClient.AssumeRole(roleARN, "", "1.2.3.4", time.Hour, time.Minute); err != nil {
+			t.Fatalf("AssumeRole failed: %v", err)
+		}
+	}
+	if callCount != 3 {
+		t.Errorf("expected STS to be called again for the evicted role only, got %d calls", callCount)
+	}
+
+	// Expired credentials are removed without being counted
+	if _, err := iamClient.AssumeRole("arn:aws:iam::123456789012:role/expired", "", "1.2.3.4", time.Millisecond, time.Minute); err != nil {
+		t.Fatalf("AssumeRole failed: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if evicted := iamClient.EvictRoles(func(roleARN string) bool { return true }); evicted != 2 {
+		t.Errorf("expected the 2 live credentials to be counted, got %d", evicted)
+	}
+}
+
 func TestAssumeRoleRegionError(t *testing.T) {
 	iamClient := &Client{
 		Cache:      ccache.New(ccache.Configure()),
@@ -481,6 +696,49 @@ func TestGetInstanceIdError(t *testing.T) {
 	}
 }
 
+func TestGetInstanceIAMRoleWithClient(t *testing.T) {
+	mockClient := &MockIMDSClient{
+		GetMetadataFunc: func(ctx context.Context, params *imds.GetMetadataInput, optFns ...func(*imds.Options)) (*imds.GetMetadataOutput, error) {
+			if params.Path != "iam/security-credentials/" {
+				return nil, errors.New("unexpected path: " + params.Path)
+			}
+			return mockMetadataOutput("node-role"), nil
+		},
+	}
+
+	role, err := GetInstanceIAMRoleWithClient(mockClient)
+	if err != nil {
+		t.Fatalf("GetInstanceIAMRoleWithClient failed: %v", err)
+	}
+	if role != "node-role" {
+		t.Errorf("expected role node-role, got %s", role)
+	}
+}
+
+func TestMetadataHost(t *testing.T) {
+	tests := []struct {
+		address      string
+		expectedHost string
+		expectedIPv6 bool
+	}{
+		{"169.254.169.254", "169.254.169.254", false},
+		{"169.254.169.254:8080", "169.254.169.254:8080", false},
+		{"fd00:ec2::254", "[fd00:ec2::254]", true},
+		{"[fd00:ec2::254]", "[fd00:ec2::254]", true},
+		{"[fd00:ec2::254]:8080", "[fd00:ec2::254]:8080", false},
+		{"::ffff:169.254.169.254", "::ffff:169.254.169.254", false},
+		{"metadata.local", "metadata.local", false},
+	}
+	for _, tt := range tests {
+		if got := MetadataHost(tt.address); got != tt.expectedHost {
+			t.Errorf("MetadataHost(%q) = %q, want %q", tt.address, got, tt.expectedHost)
+		}
+		if got := IsIPv6Address(tt.address); got != tt.expectedIPv6 {
+			t.Errorf("IsIPv6Address(%q) = %t, want %t", tt.address, got, tt.expectedIPv6)
+		}
+	}
+}
+
 func TestGetMetadataPathEmptyBody(t *testing.T) {
 	mockClient := &MockIMDSClient{
 		GetMetadataFunc: func(ctx context.Context, params *imds.GetMetadataInput, optFns ...func(*imds.Options)) (*imds.GetMetadataOutput, error) {
@@ -2,7 +2,9 @@ package iptables
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"net/netip"
 	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
@@ -15,19 +17,61 @@ func AddRule(appPort, metadataAddress, hostInterface, hostIP string) error {
 		return err
 	}
 
+	ipt, err := newIPTables(metadataAddress, hostIP)
+	if err != nil {
+		return err
+	}
+
+	return ipt.AppendUnique("nat", "PREROUTING", ruleSpec(appPort, metadataAddress, hostInterface, hostIP)...)
+}
+
+// RuleExists returns whether the rule added by AddRule is present in the host's nat table.
+func RuleExists(appPort, metadataAddress, hostInterface, hostIP string) (bool, error) {
+	ipt, err := newIPTables(metadataAddress, hostIP)
+	if err != nil {
+		return false, err
+	}
+
+	return ipt.Exists("nat", "PREROUTING", ruleSpec(appPort, metadataAddress, hostInterface, hostIP)...)
+}
+
+// newIPTables returns the iptables handle of the IP family of the host IP.
+func newIPTables(metadataAddress, hostIP string) (*iptables.IPTables, error) {
 	if hostIP == "" {
-		return errors.New("--host-ip must be set")
+		return nil, errors.New("--host-ip must be set")
 	}
 
-	ipt, err := iptables.New()
+	protocol, err := ruleProtocol(metadataAddress, hostIP)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return iptables.NewWithProtocol(protocol)
+}
+
+// ruleProtocol returns the iptables protocol of the rule, ip6tables being used for IPv6 host IPs.
+func ruleProtocol(metadataAddress, hostIP string) (iptables.Protocol, error) {
+	host, err := netip.ParseAddr(hostIP)
+	if err != nil {
+		return iptables.ProtocolIPv4, fmt.Errorf("invalid --host-ip %q: %s", hostIP, err)
+	}
+	host = host.Unmap()
+	// The metadata address may be a hostname, only IP addresses can be checked against the host IP family
+	if metadata, err := netip.ParseAddr(metadataAddress); err == nil && metadata.Unmap().Is4() != host.Is4() {
+		return iptables.ProtocolIPv4, fmt.Errorf("metadata address %s and host IP %s are not of the same IP family", metadataAddress, hostIP)
+	}
+	if host.Is4() {
+		return iptables.ProtocolIPv4, nil
 	}
+	return iptables.ProtocolIPv6, nil
+}
 
-	return ipt.AppendUnique(
-		"nat", "PREROUTING", "-p", "tcp", "-d", metadataAddress, "--dport", "80",
-		"-j", "DNAT", "--to-destination", hostIP+":"+appPort, "-i", hostInterface,
-	)
+// ruleSpec returns the DNAT rule redirecting metadata requests to kube2iam.
+func ruleSpec(appPort, metadataAddress, hostInterface, hostIP string) []string {
+	return []string{
+		"-p", "tcp", "-d", metadataAddress, "--dport", "80",
+		"-j", "DNAT", "--to-destination", net.JoinHostPort(hostIP, appPort), "-i", hostInterface,
+	}
 }
 
 // checkInterfaceExists validates the interface passed exists for the given system.
@@ -2,7 +2,10 @@ package iptables
 
 import (
 	"runtime"
+	"strings"
 	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
 )
 
 func TestCheckInterfaceExistsFailsWithBogusInterface(t *testing.T) {
@@ -36,6 +39,47 @@ func TestCheckInterfaceExistsPassesWithPlus(t *testing.T) {
 	}
 }
 
+func TestRuleProtocol(t *testing.T) {
+	tests := []struct {
+		name            string
+		metadataAddress string
+		hostIP          string
+		expected        iptables.Protocol
+		expectErr       bool
+	}{
+		{"IPv4", "169.254.169.254", "10.0.0.1", iptables.ProtocolIPv4, false},
+		{"IPv6", "fd00:ec2::254", "2600:1f14::1", iptables.ProtocolIPv6, false},
+		{"metadata hostname", "metadata.local", "2600:1f14::1", iptables.ProtocolIPv6, false},
+		{"mixed families", "169.254.169.254", "2600:1f14::1", iptables.ProtocolIPv4, true},
+		{"invalid host IP", "169.254.169.254", "node-1", iptables.ProtocolIPv4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ruleProtocol(tt.metadataAddress, tt.hostIP)
+			if tt.expectErr {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected protocol %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestRuleSpecIPv6Destination(t *testing.T) {
+	spec := ruleSpec("8181", "fd00:ec2::254", "eni+", "2600:1f14::1")
+	expected := "-p tcp -d fd00:ec2::254 --dport 80 -j DNAT --to-destination [2600:1f14::1]:8181 -i eni+"
+	if got := strings.Join(spec, " "); got != expected {
+		t.Errorf("expected rule %q, got %q", expected, got)
+	}
+}
+
 func TestAddRule(t *testing.T) {
 	t.Skip()
 }
@@ -0,0 +1,32 @@
+package k8s
+
+import (
+	"github.com/jtblin/kube2iam/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/tools/cache"
+)
+
+// cacheSizeReporter keeps the number of cached objects of a resource up to date before passing
+// the events on to the resource handler. The informer updates its store before calling its handler.
+type cacheSizeReporter struct {
+	cache.ResourceEventHandler
+	size prometheus.Gauge
+}
+
+func newCacheSizeReporter(resource string, handler cache.ResourceEventHandler) *cacheSizeReporter {
+	size := metrics.CacheObjects.WithLabelValues(resource)
+	size.Set(0)
+	return &cacheSizeReporter{ResourceEventHandler: handler, size: size}
+}
+
+// OnAdd is called when an object is added.
+func (r *cacheSizeReporter) OnAdd(obj interface{}, isInInitialList bool) {
+	r.size.Inc()
+	r.ResourceEventHandler.OnAdd(obj, isInInitialList)
+}
+
+// OnDelete is called when an object is deleted.
+func (r *cacheSizeReporter) OnDelete(obj interface{}) {
+	r.size.Dec()
+	r.ResourceEventHandler.OnDelete(obj)
+}
@@ -0,0 +1,98 @@
+package k8s
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/jtblin/kube2iam/version"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// ClientOptions configures the connection to the api server and the client behavior.
+type ClientOptions struct {
+	// KubeconfigPath and KubeconfigContext select a kubeconfig, the default context being used when the
+	// context is empty. Without kubeconfig, Host is used with a token or a client certificate, and the
+	// in-cluster configuration otherwise.
+	KubeconfigPath    string
+	KubeconfigContext string
+	Host              string
+	Token             string
+	// TokenFile is re-read periodically so that rotated tokens are picked up.
+	TokenFile string
+	CertFile  string
+	KeyFile   string
+	CAFile    string
+	Insecure  bool
+	// QPS and Burst limit the requests to the api server, client-go defaults being used when zero.
+	QPS   float32
+	Burst int
+	// Timeout bounds the requests made outside of the informers, e.g. pod lookups. Informers keep their
+	// own timeouts as watches are long-running requests.
+	Timeout time.Duration
+	// UserAgent defaults to kube2iam with its version.
+	UserAgent     string
+	NodeName      string
+	ResolveDupIPs bool
+}
+
+// UserAgent returns the default user agent of kube2iam requests to the api server.
+func UserAgent() string {
+	v := version.Version
+	if v == "" {
+		v = "unknown"
+	}
+	return fmt.Sprintf("kube2iam/%s (%s/%s)", v, runtime.GOOS, runtime.GOARCH)
+}
+
+// restConfig builds the client configuration from the options.
+func restConfig(opts ClientOptions) (*rest.Config, error) {
+	config, err := baseConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	// Honor the CLI flags as overrides
+	if opts.TokenFile != "" {
+		config.BearerToken = ""
+		config.BearerTokenFile = opts.TokenFile
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		config.CertData, config.KeyData = nil, nil
+		config.CertFile, config.KeyFile = opts.CertFile, opts.KeyFile
+	}
+	if opts.CAFile != "" {
+		config.CAData = nil
+		config.CAFile = opts.CAFile
+	}
+	if opts.Insecure {
+		config.Insecure = true
+	}
+	if opts.QPS > 0 {
+		config.QPS = opts.QPS
+	}
+	if opts.Burst > 0 {
+		config.Burst = opts.Burst
+	}
+	config.UserAgent = opts.UserAgent
+	if config.UserAgent == "" {
+		config.UserAgent = UserAgent()
+	}
+	return config, nil
+}
+
+func baseConfig(opts ClientOptions) (*rest.Config, error) {
+	if opts.KubeconfigPath != "" || opts.KubeconfigContext != "" {
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		loadingRules.ExplicitPath = opts.KubeconfigPath
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: opts.KubeconfigContext}
+		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+	}
+	if opts.Host != "" && (opts.Token != "" || opts.TokenFile != "" || opts.CertFile != "") {
+		return &rest.Config{
+			Host:        opts.Host,
+			BearerToken: opts.Token,
+		}, nil
+	}
+	return rest.InClusterConfig()
+}
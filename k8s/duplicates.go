@@ -0,0 +1,98 @@
+package k8s
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jtblin/kube2iam/metrics"
+	v1 "k8s.io/api/core/v1"
+)
+
+// unresolvedIPTTL is how long an IP shared by pods that couldn't be told apart is answered
+// without querying the api server again.
+const unresolvedIPTTL = 10 * time.Second
+
+// unresolvedIPs negatively caches the IPs that couldn't be resolved with the api server.
+type unresolvedIPs struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func (u *unresolvedIPs) add(IP string, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.expires == nil {
+		u.expires = make(map[string]time.Time)
+	}
+	for ip, expires := range u.expires {
+		if !now.Before(expires) {
+			delete(u.expires, ip)
+		}
+	}
+	u.expires[IP] = now.Add(unresolvedIPTTL)
+}
+
+func (u *unresolvedIPs) contains(IP string, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	expires, ok := u.expires[IP]
+	return ok && now.Before(expires)
+}
+
+// resolveDuplicatedIP picks the pod using an IP shared by several indexed pods. The decision is made from
+// the cached pods first, and only when they can't be told apart from the pods of the node listed with the
+// api server. IPs that can't be resolved either way are negatively cached for a short period.
+func (k8s *Client) resolveDuplicatedIP(IP string, indexed []*v1.Pod) (*v1.Pod, error) {
+	if pod := selectDuplicatedPod(indexed); pod != nil {
+		return pod, nil
+	}
+
+	now := time.Now()
+	if k8s.unresolvedIPs.contains(IP, now) {
+		return nil, fmt.Errorf("%d pods with the ip %s indexed and none could be picked recently", len(indexed), IP)
+	}
+
+	podList, err := k8s.listPodsByIP(IP)
+	metrics.K8sAPIDupReqCount.Inc()
+	if err != nil {
+		k8s.unresolvedIPs.add(IP, now)
+		return nil, fmt.Errorf("resolveDuplicatedIP: Error retriving the pod with IP %s from the k8s api", IP)
+	}
+	listed := make([]*v1.Pod, len(podList.Items))
+	for i := range podList.Items {
+		listed[i] = &podList.Items[i]
+	}
+	if pod := selectDuplicatedPod(listed); pod != nil {
+		metrics.K8sAPIDupReqSuccesCount.Inc()
+		return pod, nil
+	}
+	k8s.unresolvedIPs.add(IP, now)
+	return nil, fmt.Errorf("more than a pod with the same IP has been indexed, this can happen when pods have hostNetwork: true")
+}
+
+// selectDuplicatedPod returns the pod actually using an IP shared by several pods: the most recently
+// started running pod which isn't on the host network nor terminating. It returns nil when there is none.
+func selectDuplicatedPod(pods []*v1.Pod) *v1.Pod {
+	var selected *v1.Pod
+	for _, pod := range pods {
+		if pod.Spec.HostNetwork || pod.Status.Phase != v1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if selected == nil || startedAfter(pod, selected) {
+			selected = pod
+		}
+	}
+	return selected
+}
+
+// startedAfter returns whether pod a started after pod b, pods without start time being the oldest.
+func startedAfter(a, b *v1.Pod) bool {
+	if a.Status.StartTime == nil {
+		return false
+	}
+	if b.Status.StartTime == nil {
+		return true
+	}
+	return a.Status.StartTime.After(b.Status.StartTime.Time)
+}
@@ -0,0 +1,183 @@
+package k8s
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jtblin/kube2iam/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// informerHealth tracks the activity of an informer so that a watch silently no longer delivering
+// events is detected, and restarts the watch when it goes stale. It records the resyncs of the
+// informer before passing the events on to the resource handler.
+type informerHealth struct {
+	cache.ResourceEventHandler
+	resource string
+	// lastActivity is the unix time in nanoseconds of the last list, watch start, event or resync.
+	lastActivity atomic.Int64
+	lastEvent    prometheus.Gauge
+	lastResync   prometheus.Gauge
+
+	mu    sync.Mutex
+	watch watch.Interface
+}
+
+func newInformerHealth(resource string, handler cache.ResourceEventHandler) *informerHealth {
+	h := &informerHealth{
+		ResourceEventHandler: handler,
+		resource:             resource,
+		lastEvent:            metrics.InformerLastEvent.WithLabelValues(resource),
+		lastResync:           metrics.InformerLastResync.WithLabelValues(resource),
+	}
+	h.touch(time.Now())
+	return h
+}
+
+// OnUpdate is called when an object is modified, or when the informer resyncs with the object unchanged.
+func (h *informerHealth) OnUpdate(oldObj, newObj interface{}) {
+	if isResync(oldObj, newObj) {
+		h.recordResync(time.Now())
+	}
+	h.ResourceEventHandler.OnUpdate(oldObj, newObj)
+}
+
+func isResync(oldObj, newObj interface{}) bool {
+	oldMeta, err := meta.Accessor(oldObj)
+	if err != nil {
+		return false
+	}
+	newMeta, err := meta.Accessor(newObj)
+	if err != nil {
+		return false
+	}
+	return oldMeta.GetResourceVersion() == newMeta.GetResourceVersion()
+}
+
+func (h *informerHealth) touch(now time.Time) {
+	h.lastActivity.Store(now.UnixNano())
+}
+
+func (h *informerHealth) recordEvent(now time.Time) {
+	h.touch(now)
+	h.lastEvent.Set(float64(now.UnixNano()) / 1e9)
+}
+
+func (h *informerHealth) recordResync(now time.Time) {
+	h.touch(now)
+	h.lastResync.Set(float64(now.UnixNano()) / 1e9)
+}
+
+// stale returns whether the informer had no activity for longer than the threshold.
+func (h *informerHealth) stale(now time.Time, threshold time.Duration) bool {
+	return now.Sub(time.Unix(0, h.lastActivity.Load())) > threshold
+}
+
+// listerWatcher returns a cache.ListerWatcher recording the lists, watches and events of lw.
+func (h *informerHealth) listerWatcher(lw cache.ListerWatcher) cache.ListerWatcher {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			list, err := lw.List(options)
+			if err == nil {
+				h.recordResync(time.Now())
+			}
+			return list, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			w, err := lw.Watch(options)
+			if err != nil {
+				return nil, err
+			}
+			h.touch(time.Now())
+			observed := newObservedWatch(w, h)
+			h.mu.Lock()
+			h.watch = observed
+			h.mu.Unlock()
+			return observed, nil
+		},
+	}
+}
+
+// restartWatch stops the current watch so that the informer starts a new one from the last resource
+// version seen. Events missed by the stale watch are then delivered by the new watch, or the informer
+// lists the resource again when the resource version is too old. It returns false without watch.
+func (h *informerHealth) restartWatch() bool {
+	h.mu.Lock()
+	w := h.watch
+	h.watch = nil
+	h.mu.Unlock()
+	if w == nil {
+		return false
+	}
+	w.Stop()
+	return true
+}
+
+// monitor restarts the watch of the informer when it goes stale, until the context is done.
+func (h *informerHealth) monitor(ctx context.Context, threshold time.Duration) {
+	ticker := time.NewTicker(threshold / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if h.stale(now, threshold) && h.restartWatch() {
+				log.Warnf("No activity of the %s informer for more than %s, restarting its watch", h.resource, threshold)
+				metrics.InformerWatchRestarts.WithLabelValues(h.resource).Inc()
+			}
+		}
+	}
+}
+
+// observedWatch passes on the events of a watch, recording them as activity of the informer.
+type observedWatch struct {
+	watch.Interface
+	result   chan watch.Event
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newObservedWatch(w watch.Interface, h *informerHealth) *observedWatch {
+	observed := &observedWatch{
+		Interface: w,
+		result:    make(chan watch.Event),
+		stopped:   make(chan struct{}),
+	}
+	go func() {
+		defer close(observed.result)
+		for event := range w.ResultChan() {
+			if event.Type != watch.Error {
+				// Bookmarks count as events, they show the watch is alive in quiet clusters
+				h.recordEvent(time.Now())
+			}
+			select {
+			case observed.result <- event:
+			case <-observed.stopped:
+				return
+			}
+		}
+	}()
+	return observed
+}
+
+// ResultChan returns the channel of the events of the watch.
+func (w *observedWatch) ResultChan() <-chan watch.Event {
+	return w.result
+}
+
+// Stop stops the watch.
+func (w *observedWatch) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopped)
+		w.Interface.Stop()
+	})
+}
@@ -3,36 +3,61 @@ package k8s
 import (
 	"context"
 	"fmt"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/jtblin/kube2iam"
 	"github.com/jtblin/kube2iam/metrics"
+	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	selector "k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
 	podIPIndexName     = "byPodIP"
+	podUIDIndexName    = "byPodUID"
 	namespaceIndexName = "byName"
+	nodeIndexName      = "byNodeName"
 )
 
 // Client represents a kubernetes client.
 type Client struct {
 	*kubernetes.Clientset
+	metadataClient      metadata.Interface
 	namespaceController cache.Controller
 	namespaceIndexer    cache.Indexer
 	podController       cache.Controller
 	podIndexer          cache.Indexer
+	nodeController      cache.Controller
+	nodeIndexer         cache.Indexer
 	nodeName            string
+	namespaceSelector   string
+	requestTimeout      time.Duration
 	resolveDupIPs       bool
+	podWaiters          podWaiters
+	podLookupWait       time.Duration
+	podAPILookup        bool
+	unresolvedIPs       unresolvedIPs
+	podsNotFound        unresolvedIPs
+	staleThreshold      time.Duration
+	informersMu         sync.Mutex
+	informers           []*informerHealth
 }
 
+const (
+	podLookupCache    = "cache"
+	podLookupWait     = "wait"
+	podLookupAPI      = "api"
+	podLookupNotFound = "not_found"
+)
+
 // Returns a cache.ListWatch that gets all changes to pods.
 func (k8s *Client) createPodLW() *cache.ListWatch {
 	fieldSelector := selector.Everything()
@@ -42,41 +67,142 @@ func (k8s *Client) createPodLW() *cache.ListWatch {
 	return cache.NewListWatchFromClient(k8s.Clientset.CoreV1().RESTClient(), "pods", v1.NamespaceAll, fieldSelector)
 }
 
-// WatchForPods watches for pod changes.
-func (k8s *Client) WatchForPods(podEventLogger cache.ResourceEventHandler, resyncPeriod time.Duration) cache.InformerSynced {
+// WatchForPods watches for pod changes until the context is done. Cached pods only hold the fields used
+// to map them to roles and the given annotations, or all annotations when annotationKeys is nil.
+func (k8s *Client) WatchForPods(ctx context.Context, podEventLogger cache.ResourceEventHandler, resyncPeriod time.Duration, annotationKeys []string) cache.InformerSynced {
+	health := newInformerHealth("pods", &podIndexNotifier{
+		ResourceEventHandler: newCacheSizeReporter("pods", podEventLogger),
+		waiters:              &k8s.podWaiters,
+	})
 	podStore, podController := cache.NewInformerWithOptions(cache.InformerOptions{
-		ListerWatcher: k8s.createPodLW(),
+		ListerWatcher: health.listerWatcher(k8s.createPodLW()),
 		ObjectType:    &v1.Pod{},
 		ResyncPeriod:  resyncPeriod,
-		Handler:       podEventLogger,
-		Indexers:      cache.Indexers{podIPIndexName: kube2iam.PodIPIndexFunc},
+		Handler:       health,
+		Indexers:      cache.Indexers{podIPIndexName: kube2iam.PodIPIndexFunc, podUIDIndexName: kube2iam.PodUIDIndexFunc},
+		Transform:     kube2iam.NewPodTransform(annotationKeys),
 	})
 	k8s.podIndexer = podStore.(cache.Indexer)
 	k8s.podController = podController
-	go k8s.podController.Run(wait.NeverStop)
+	k8s.runInformer(ctx, podController, health)
 	return k8s.podController.HasSynced
 }
 
-// returns a cache.ListWatch of namespaces.
+// returns a cache.ListWatch of the metadata of namespaces.
 func (k8s *Client) createNamespaceLW() *cache.ListWatch {
-	return cache.NewListWatchFromClient(k8s.Clientset.CoreV1().RESTClient(), "namespaces", v1.NamespaceAll, selector.Everything())
+	namespaces := k8s.metadataClient.Resource(v1.SchemeGroupVersion.WithResource("namespaces"))
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = k8s.namespaceSelector
+			return namespaces.List(context.TODO(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = k8s.namespaceSelector
+			return namespaces.Watch(context.TODO(), options)
+		},
+	}
 }
 
-// WatchForNamespaces watches for namespaces changes.
-func (k8s *Client) WatchForNamespaces(nsEventLogger cache.ResourceEventHandler, resyncPeriod time.Duration) cache.InformerSynced {
+// WatchForNamespaces watches for namespaces changes until the context is done, limited to the namespaces
+// matching the label selector when set. Only the metadata of namespaces is watched, cached namespaces hold
+// their name, labels and annotations.
+func (k8s *Client) WatchForNamespaces(ctx context.Context, nsEventLogger cache.ResourceEventHandler, resyncPeriod time.Duration, labelSelector string) cache.InformerSynced {
+	k8s.namespaceSelector = labelSelector
+	health := newInformerHealth("namespaces", newCacheSizeReporter("namespaces", nsEventLogger))
 	nsStore, nsController := cache.NewInformerWithOptions(cache.InformerOptions{
-		ListerWatcher: k8s.createNamespaceLW(),
-		ObjectType:    &v1.Namespace{},
+		ListerWatcher: health.listerWatcher(k8s.createNamespaceLW()),
+		ObjectType:    &metav1.PartialObjectMetadata{},
 		ResyncPeriod:  resyncPeriod,
-		Handler:       nsEventLogger,
+		Handler:       health,
 		Indexers:      cache.Indexers{namespaceIndexName: kube2iam.NamespaceIndexFunc},
+		Transform:     kube2iam.NamespaceFromMetadata,
 	})
 	k8s.namespaceIndexer = nsStore.(cache.Indexer)
 	k8s.namespaceController = nsController
-	go k8s.namespaceController.Run(wait.NeverStop)
+	k8s.runInformer(ctx, nsController, health)
 	return k8s.namespaceController.HasSynced
 }
 
+// Returns a cache.ListWatch of nodes, limited to the current node when known.
+func (k8s *Client) createNodeLW() *cache.ListWatch {
+	fieldSelector := selector.Everything()
+	if k8s.nodeName != "" {
+		fieldSelector = selector.OneTermEqualSelector("metadata.name", k8s.nodeName)
+	}
+	return cache.NewListWatchFromClient(k8s.Clientset.CoreV1().RESTClient(), "nodes", v1.NamespaceAll, fieldSelector)
+}
+
+// WatchForNodes watches for node changes until the context is done.
+func (k8s *Client) WatchForNodes(ctx context.Context, nodeEventLogger cache.ResourceEventHandler, resyncPeriod time.Duration) cache.InformerSynced {
+	health := newInformerHealth("nodes", newCacheSizeReporter("nodes", nodeEventLogger))
+	nodeStore, nodeController := cache.NewInformerWithOptions(cache.InformerOptions{
+		ListerWatcher: health.listerWatcher(k8s.createNodeLW()),
+		ObjectType:    &v1.Node{},
+		ResyncPeriod:  resyncPeriod,
+		Handler:       health,
+		Indexers:      cache.Indexers{nodeIndexName: kube2iam.NodeIndexFunc},
+	})
+	k8s.nodeIndexer = nodeStore.(cache.Indexer)
+	k8s.nodeController = nodeController
+	k8s.runInformer(ctx, nodeController, health)
+	return k8s.nodeController.HasSynced
+}
+
+// WatchForConfigMap watches a single configmap for changes until the context is done.
+func (k8s *Client) WatchForConfigMap(ctx context.Context, namespace, name string, cmEventHandler cache.ResourceEventHandler, resyncPeriod time.Duration) cache.InformerSynced {
+	health := newInformerHealth("configmaps", newCacheSizeReporter("configmaps", cmEventHandler))
+	_, cmController := cache.NewInformerWithOptions(cache.InformerOptions{
+		ListerWatcher: health.listerWatcher(cache.NewListWatchFromClient(k8s.Clientset.CoreV1().RESTClient(), "configmaps", namespace, selector.OneTermEqualSelector("metadata.name", name))),
+		ObjectType:    &v1.ConfigMap{},
+		ResyncPeriod:  resyncPeriod,
+		Handler:       health,
+	})
+	k8s.runInformer(ctx, cmController, health)
+	return cmController.HasSynced
+}
+
+// EnableStalenessDetection restarts the watch of informers without activity for longer than the
+// threshold, and reports them as stale until they recover. Informers are active when their watch
+// delivers events or bookmarks, is restarted, or when they list their resource or resync.
+func (k8s *Client) EnableStalenessDetection(threshold time.Duration) {
+	k8s.staleThreshold = threshold
+}
+
+// runInformer runs the informer until the context is done, monitoring its watch when staleness
+// detection is enabled. The informer is no longer reported by StaleInformers once stopped.
+func (k8s *Client) runInformer(ctx context.Context, controller cache.Controller, health *informerHealth) {
+	k8s.informersMu.Lock()
+	k8s.informers = append(k8s.informers, health)
+	k8s.informersMu.Unlock()
+	go func() {
+		controller.RunWithContext(ctx)
+		k8s.informersMu.Lock()
+		k8s.informers = slices.DeleteFunc(k8s.informers, func(h *informerHealth) bool { return h == health })
+		k8s.informersMu.Unlock()
+	}()
+	if k8s.staleThreshold > 0 {
+		go health.monitor(ctx, k8s.staleThreshold)
+	}
+}
+
+// StaleInformers returns the resources of the informers without activity for longer than the
+// staleness threshold, or nil when staleness detection is disabled.
+func (k8s *Client) StaleInformers() []string {
+	if k8s.staleThreshold <= 0 {
+		return nil
+	}
+	k8s.informersMu.Lock()
+	defer k8s.informersMu.Unlock()
+	var stale []string
+	now := time.Now()
+	for _, health := range k8s.informers {
+		if health.stale(now, k8s.staleThreshold) {
+			stale = append(stale, health.resource)
+		}
+	}
+	return stale
+}
+
 // ListPodIPs returns the underlying set of pods being managed/indexed
 func (k8s *Client) ListPodIPs() []string {
 	// Decided to simply dump this and leave it up to consumer
@@ -87,6 +213,9 @@ func (k8s *Client) ListPodIPs() []string {
 
 // ListNamespaces returns the underlying set of namespaces being managed/indexed
 func (k8s *Client) ListNamespaces() []string {
+	if k8s.namespaceIndexer == nil {
+		return nil
+	}
 	return k8s.namespaceIndexer.ListIndexFuncValues(namespaceIndexName)
 }
 
@@ -101,9 +230,114 @@ func (k8s *Client) PodByIP(IP string) (*v1.Pod, error) {
 
 	if len(pods) == 0 {
 		metrics.PodNotFoundInCache.Inc()
-		return nil, fmt.Errorf("pod with specificed IP %q not found", IP)
+		return k8s.podByIPFallback(IP)
+	}
+
+	metrics.PodLookupCount.WithLabelValues(podLookupCache).Inc()
+	return k8s.podFromIndexed(IP, pods)
+}
+
+// EnablePodLookupFallback makes lookups of pods missing from the cache wait for the pod to be indexed,
+// and then look the pod up with the api server when apiLookup is set.
+func (k8s *Client) EnablePodLookupFallback(wait time.Duration, apiLookup bool) {
+	k8s.podLookupWait = wait
+	k8s.podAPILookup = apiLookup
+}
+
+// podByIPFallback looks up a pod missing from the cache, e.g. a pod calling the metadata API as soon
+// as it starts, before the informer has indexed it. IPs not found with the api server are not looked up
+// with it again for a short period.
+func (k8s *Client) podByIPFallback(IP string) (*v1.Pod, error) {
+	if k8s.podLookupWait > 0 {
+		if pods := k8s.waitForPodIP(IP, k8s.podLookupWait); len(pods) > 0 {
+			metrics.PodLookupCount.WithLabelValues(podLookupWait).Inc()
+			return k8s.podFromIndexed(IP, pods)
+		}
+	}
+	if k8s.podAPILookup && !k8s.podsNotFound.contains(IP, time.Now()) {
+		pod, err := k8s.podByIPFromAPI(IP)
+		if err == nil {
+			metrics.PodLookupCount.WithLabelValues(podLookupAPI).Inc()
+			return pod, nil
+		}
+		k8s.podsNotFound.add(IP, time.Now())
+		log.Debugf("Pod with IP %s not found with the api server: %s", IP, err)
+	}
+	metrics.PodLookupCount.WithLabelValues(podLookupNotFound).Inc()
+	if k8s.podLookupWait > 0 || k8s.podAPILookup {
+		// The fallback already waited for the pod, retrying the lookup would only wait again
+		return nil, fmt.Errorf("%w: no pod with IP %q", kube2iam.ErrPodNotFound, IP)
+	}
+	return nil, fmt.Errorf("pod with specificed IP %q not found", IP)
+}
+
+// waitForPodIP waits up to the timeout for a pod with the IP to be indexed and returns the indexed pods.
+func (k8s *Client) waitForPodIP(IP string, timeout time.Duration) []interface{} {
+	indexed, cancel := k8s.podWaiters.wait(IP)
+	defer cancel()
+
+	// The pod may have been indexed before the waiter was registered
+	if pods, err := k8s.podIndexer.ByIndex(podIPIndexName, IP); err == nil && len(pods) > 0 {
+		return pods
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-indexed:
+	case <-timer.C:
+		return nil
+	}
+	pods, err := k8s.podIndexer.ByIndex(podIPIndexName, IP)
+	if err != nil {
+		return nil
 	}
+	return pods
+}
+
+// listPodsByIP queries the api server for the pods with the IP, scoped to the node when known.
+func (k8s *Client) listPodsByIP(IP string) (*v1.PodList, error) {
+	fieldSelector := selector.OneTermEqualSelector("status.podIP", IP)
+	if k8s.nodeName != "" {
+		fieldSelector = selector.AndSelectors(selector.OneTermEqualSelector("spec.nodeName", k8s.nodeName), fieldSelector)
+	}
+	ctx := context.Background()
+	if k8s.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k8s.requestTimeout)
+		defer cancel()
+	}
+	return k8s.Clientset.CoreV1().Pods(v1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fieldSelector.String(),
+	})
+}
+
+// podByIPFromAPI queries the api server for the pod with the IP.
+func (k8s *Client) podByIPFromAPI(IP string) (*v1.Pod, error) {
+	podList, err := k8s.listPodsByIP(IP)
+	if err != nil {
+		return nil, err
+	}
+	var active []*v1.Pod
+	for i := range podList.Items {
+		if pod := &podList.Items[i]; pod.Status.Phase != v1.PodSucceeded && pod.Status.Phase != v1.PodFailed {
+			active = append(active, pod)
+		}
+	}
+	if len(active) == 1 {
+		return active[0], nil
+	}
+	// Like with duplicated IPs in the cache, hostNetwork pods can't be told apart by IP
+	for _, pod := range active {
+		if !pod.Spec.HostNetwork {
+			return pod, nil
+		}
+	}
+	return nil, fmt.Errorf("%d running pods with IP %s", len(active), IP)
+}
 
+// podFromIndexed returns the pod with the IP among the indexed pods.
+func (k8s *Client) podFromIndexed(IP string, pods []interface{}) (*v1.Pod, error) {
 	if len(pods) == 1 {
 		return pods[0].(*v1.Pod), nil
 	}
@@ -115,79 +349,89 @@ func (k8s *Client) PodByIP(IP string) (*v1.Pod, error) {
 		}
 		return nil, fmt.Errorf("%d pods (%v) with the ip %s indexed", len(pods), podNames, IP)
 	}
-	pod, err := resolveDuplicatedIP(k8s, IP)
-	if err != nil {
-		return nil, err
+	indexed := make([]*v1.Pod, len(pods))
+	for i, pod := range pods {
+		indexed[i] = pod.(*v1.Pod)
 	}
-	return pod, nil
+	return k8s.resolveDuplicatedIP(IP, indexed)
 }
 
-// resolveDuplicatedIP queries the k8s api server trying to make a decision based on NON cached data
-// If the indexed pods all have HostNetwork = true the function return nil and the error message.
-// If we retrive a running pod that doesn't have HostNetwork = true and it is in Running state will return that.
-func resolveDuplicatedIP(k8s *Client, IP string) (*v1.Pod, error) {
-	runningPodList, err := k8s.Clientset.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{
-		FieldSelector: selector.OneTermEqualSelector("status.podIP", IP).String(),
-	})
-	metrics.K8sAPIDupReqCount.Inc()
+// PodByUID provides the representation of the pod itself being cached keyed off of it's UID.
+func (k8s *Client) PodByUID(UID string) (*v1.Pod, error) {
+	pods, err := k8s.podIndexer.ByIndex(podUIDIndexName, UID)
 	if err != nil {
-		return nil, fmt.Errorf("resolveDuplicatedIP: Error retriving the pod with IP %s from the k8s api", IP)
+		return nil, err
 	}
-	for _, pod := range runningPodList.Items {
-		if !pod.Spec.HostNetwork && string(pod.Status.Phase) == "Running" {
-			metrics.K8sAPIDupReqSuccesCount.Inc()
-			return &pod, nil
-		}
+
+	if len(pods) == 0 {
+		metrics.PodNotFoundInCache.Inc()
+		return nil, fmt.Errorf("pod with specified UID %q not found", UID)
 	}
-	error := fmt.Errorf("more than a pod with the same IP has been indexed, this can happen when pods have hostNetwork: true")
-	return nil, error
+
+	return pods[0].(*v1.Pod), nil
 }
 
 // NamespaceByName retrieves a namespace by it's given name.
-// Returns an error if there are no namespaces available
+// Returns kube2iam.ErrNamespaceNotWatched when namespaces are not watched, and an error when the namespace
+// isn't cached, including when it doesn't match the namespace selector as it may not be indexed yet.
 func (k8s *Client) NamespaceByName(namespaceName string) (*v1.Namespace, error) {
+	if k8s.namespaceIndexer == nil {
+		return nil, kube2iam.ErrNamespaceNotWatched
+	}
+
 	namespace, err := k8s.namespaceIndexer.ByIndex(namespaceIndexName, namespaceName)
 	if err != nil {
 		return nil, err
 	}
 
 	if len(namespace) == 0 {
+		if k8s.namespaceSelector != "" {
+			return nil, fmt.Errorf("namespace %s was not found with selector %q", namespaceName, k8s.namespaceSelector)
+		}
 		return nil, fmt.Errorf("namespace was not found")
 	}
 
 	return namespace[0].(*v1.Namespace), nil
 }
 
+// NodeByName retrieves a node by it's given name.
+// Returns an error if nodes are not being watched or the node is not found.
+func (k8s *Client) NodeByName(nodeName string) (*v1.Node, error) {
+	if k8s.nodeIndexer == nil {
+		return nil, fmt.Errorf("nodes are not being watched")
+	}
+
+	nodes, err := k8s.nodeIndexer.ByIndex(nodeIndexName, nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("node %s was not found", nodeName)
+	}
+
+	return nodes[0].(*v1.Node), nil
+}
+
 // NewClient returns a new kubernetes client.
-func NewClient(kubeconfigPath, host, token, nodeName string, insecure, resolveDupIPs bool) (*Client, error) {
-	var config *rest.Config
-	var err error
-	if kubeconfigPath != "" {
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfigPath)
-		if err != nil {
-			return nil, err
-		}
-		// Honor the CLI flag as an override
-		if insecure {
-			config.Insecure = true
-		}
-	} else if host != "" && token != "" {
-		config = &rest.Config{
-			Host:        host,
-			BearerToken: token,
-			TLSClientConfig: rest.TLSClientConfig{
-				Insecure: insecure,
-			},
-		}
-	} else {
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			return nil, err
-		}
+func NewClient(opts ClientOptions) (*Client, error) {
+	config, err := restConfig(opts)
+	if err != nil {
+		return nil, err
 	}
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, err
 	}
-	return &Client{Clientset: client, nodeName: nodeName, resolveDupIPs: resolveDupIPs}, nil
+	metadataClient, err := metadata.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		Clientset:      client,
+		metadataClient: metadataClient,
+		nodeName:       opts.NodeName,
+		resolveDupIPs:  opts.ResolveDupIPs,
+		requestTimeout: opts.Timeout,
+	}, nil
 }
@@ -1,12 +1,26 @@
 package k8s
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jtblin/kube2iam"
+	"github.com/jtblin/kube2iam/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 )
 
@@ -14,13 +28,15 @@ import (
 
 const (
 	testPodIPIndexName     = "byPodIP"
+	testPodUIDIndexName    = "byPodUID"
 	testNamespaceIndexName = "byName"
 )
 
 // newPodIndexer creates a pod Indexer pre-populated with the given pods.
 func newPodIndexer(pods ...*v1.Pod) cache.Indexer {
 	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{
-		testPodIPIndexName: kube2iam.PodIPIndexFunc,
+		testPodIPIndexName:  kube2iam.PodIPIndexFunc,
+		testPodUIDIndexName: kube2iam.PodUIDIndexFunc,
 	})
 	for _, p := range pods {
 		_ = indexer.Add(p)
@@ -76,6 +92,22 @@ func TestPodByIPFound(t *testing.T) {
 	}
 }
 
+func TestPodByIPSecondaryFamily(t *testing.T) {
+	pod := runningPod("dual-stack", "default", "10.0.0.1")
+	pod.Status.PodIPs = []v1.PodIP{{IP: "10.0.0.1"}, {IP: "fd00::1"}}
+	client := newTestClient(newPodIndexer(pod), newNamespaceIndexer(), false)
+
+	for _, ip := range []string{"10.0.0.1", "fd00::1"} {
+		got, err := client.PodByIP(ip)
+		if err != nil {
+			t.Fatalf("PodByIP(%q) returned unexpected error: %v", ip, err)
+		}
+		if got.Name != "dual-stack" {
+			t.Errorf("expected pod name 'dual-stack' for %q, got %q", ip, got.Name)
+		}
+	}
+}
+
 func TestPodByIPNotFound(t *testing.T) {
 	client := newTestClient(newPodIndexer(), newNamespaceIndexer(), false)
 
@@ -98,24 +130,228 @@ func TestPodByIPDuplicateResolveDupIPsDisabled(t *testing.T) {
 }
 
 // TestPodByIPDuplicateResolveDupIPsEnabled exercises the resolveDupIPs=true code path.
-// When multiple pods share an IP, the non-hostNetwork running pod should be returned.
-// Because we can't inject the Clientset API call in a unit test without a full fake server,
-// we verify that when resolveDupIPs=true and the api server is unreachable, the error
-// message reflects an API lookup attempt (not the "multiple pods indexed" message).
+// When multiple pods share an IP, the newest non-hostNetwork running pod that isn't terminating
+// is picked from the cache without querying the api server.
+func TestPodByIPDuplicateResolveDupIPsEnabled(t *testing.T) {
+	now := time.Now()
+	hostNetwork := runningPod("host-agent", "kube-system", "10.0.0.6")
+	hostNetwork.Spec.HostNetwork = true
+	older := runningPod("older", "default", "10.0.0.6")
+	older.Status.StartTime = &metav1.Time{Time: now.Add(-time.Hour)}
+	newer := runningPod("newer", "default", "10.0.0.6")
+	newer.Status.StartTime = &metav1.Time{Time: now.Add(-time.Minute)}
+	terminating := runningPod("terminating", "default", "10.0.0.6")
+	terminating.Status.StartTime = &metav1.Time{Time: now}
+	terminating.DeletionTimestamp = &metav1.Time{Time: now}
+	pending := runningPod("pending", "default", "10.0.0.6")
+	pending.Status.Phase = v1.PodPending
+
+	// No Clientset: the api server must not be queried
+	client := newTestClient(newPodIndexer(hostNetwork, older, newer, terminating, pending), newNamespaceIndexer(), true)
+
+	got, err := client.PodByIP("10.0.0.6")
+	if err != nil {
+		t.Fatalf("PodByIP returned unexpected error: %v", err)
+	}
+	if got.Name != "newer" {
+		t.Errorf("expected pod name 'newer', got %q", got.Name)
+	}
+}
+
+// TestPodByIPDuplicateResolveDupIPsEnabledAPIError verifies that duplicates the cache can't resolve are
+// looked up with the api server scoped to the node, and that unresolved IPs are negatively cached.
 func TestPodByIPDuplicateResolveDupIPsEnabledAPIError(t *testing.T) {
-	pod1 := runningPod("pod-a", "default", "10.0.0.6")
-	pod2 := runningPod("pod-b", "default", "10.0.0.6")
+	pod1 := runningPod("pod-a", "kube-system", "10.0.0.7")
+	pod1.Spec.HostNetwork = true
+	pod2 := runningPod("pod-b", "kube-system", "10.0.0.7")
+	pod2.Spec.HostNetwork = true
+
+	requests := 0
+	var fieldSelector string
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fieldSelector = r.URL.Query().Get("fieldSelector")
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+	}))
+	defer apiServer.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: apiServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(newPodIndexer(pod1, pod2), newNamespaceIndexer(), true)
+	client.Clientset = clientset
+	client.nodeName = "node-1"
+
+	if _, err := client.PodByIP("10.0.0.7"); err == nil {
+		t.Fatal("expected error for unresolvable duplicate IP, got nil")
+	}
+	if requests == 0 {
+		t.Fatal("expected the api server to be queried")
+	}
+	if expected := "spec.nodeName=node-1,status.podIP=10.0.0.7"; fieldSelector != expected {
+		t.Errorf("expected field selector %q, got %q", expected, fieldSelector)
+	}
+	requestsAfterFirstLookup := requests
+	for i := 0; i < 2; i++ {
+		if _, err := client.PodByIP("10.0.0.7"); err == nil {
+			t.Fatal("expected error for unresolvable duplicate IP, got nil")
+		}
+	}
+	if requests != requestsAfterFirstLookup {
+		t.Errorf("expected unresolved IP to be negatively cached, got %d more api requests", requests-requestsAfterFirstLookup)
+	}
+}
+
+func TestUnresolvedIPsExpire(t *testing.T) {
+	var unresolved unresolvedIPs
+	now := time.Now()
+	unresolved.add("10.0.0.8", now)
+	if !unresolved.contains("10.0.0.8", now.Add(unresolvedIPTTL-time.Second)) {
+		t.Error("expected IP to be negatively cached")
+	}
+	if unresolved.contains("10.0.0.8", now.Add(unresolvedIPTTL)) {
+		t.Error("expected negatively cached IP to expire")
+	}
+}
+
+// ---- PodByIP fallback tests -------------------------------------------------
+
+func TestPodByIPWaitsForIndexedPod(t *testing.T) {
+	indexer := newPodIndexer()
+	client := newTestClient(indexer, newNamespaceIndexer(), false)
+	client.EnablePodLookupFallback(5*time.Second, false)
+	notifier := &podIndexNotifier{ResourceEventHandler: cache.ResourceEventHandlerFuncs{}, waiters: &client.podWaiters}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pod := runningPod("new-pod", "default", "10.0.0.7")
+		_ = indexer.Add(pod)
+		notifier.OnAdd(pod, false)
+	}()
+
+	start := time.Now()
+	got, err := client.PodByIP("10.0.0.7")
+	if err != nil {
+		t.Fatalf("PodByIP returned unexpected error: %v", err)
+	}
+	if got.Name != "new-pod" {
+		t.Errorf("expected pod name 'new-pod', got %q", got.Name)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the lookup to return once the pod is indexed, took %s", elapsed)
+	}
+	if len(client.podWaiters.waiters) != 0 {
+		t.Errorf("expected no waiters left, got %v", client.podWaiters.waiters)
+	}
+}
+
+func TestPodByIPWaitTimeout(t *testing.T) {
+	client := newTestClient(newPodIndexer(), newNamespaceIndexer(), false)
+	client.EnablePodLookupFallback(20*time.Millisecond, false)
+
+	if _, err := client.PodByIP("10.0.0.8"); err == nil {
+		t.Fatal("expected error for pod never indexed, got nil")
+	}
+	if len(client.podWaiters.waiters) != 0 {
+		t.Errorf("expected no waiters left, got %v", client.podWaiters.waiters)
+	}
+}
+
+func TestPodByIPAPILookup(t *testing.T) {
+	var fieldSelector string
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fieldSelector = r.URL.Query().Get("fieldSelector")
+		pods := v1.PodList{Items: []v1.Pod{
+			*runningPod("finished", "default", "10.0.0.9"),
+			*runningPod("new-pod", "default", "10.0.0.9"),
+		}}
+		pods.Items[0].Status.Phase = v1.PodSucceeded
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(pods)
+	}))
+	defer apiServer.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: apiServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(newPodIndexer(), newNamespaceIndexer(), false)
+	client.Clientset = clientset
+	client.nodeName = "node-1"
+	client.EnablePodLookupFallback(time.Millisecond, true)
+
+	got, err := client.PodByIP("10.0.0.9")
+	if err != nil {
+		t.Fatalf("PodByIP returned unexpected error: %v", err)
+	}
+	if got.Name != "new-pod" {
+		t.Errorf("expected pod name 'new-pod', got %q", got.Name)
+	}
+	if expected := "spec.nodeName=node-1,status.podIP=10.0.0.9"; fieldSelector != expected {
+		t.Errorf("expected field selector %q, got %q", expected, fieldSelector)
+	}
+}
+
+func TestPodByIPNotFoundWithFallback(t *testing.T) {
+	lists := 0
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lists++
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v1.PodList{})
+	}))
+	defer apiServer.Close()
 
-	// Nil Clientset — calling Pods().List() will panic, which we don't reach in the
-	// indexer-only code path. But resolveDupIPs=true will call resolveDuplicatedIP,
-	// which calls the Clientset. Using a nil Clientset causes a nil dereference.
-	// We test just the duplicate detection path with resolveDupIPs=false instead
-	// and cover the resolution via integration tests.
-	_ = pod1
-	_ = pod2
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: apiServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(newPodIndexer(), newNamespaceIndexer(), false)
+	client.Clientset = clientset
+	client.EnablePodLookupFallback(time.Millisecond, true)
+
+	notFound := testutil.ToFloat64(metrics.PodLookupCount.WithLabelValues(podLookupNotFound))
+	for i := 0; i < 3; i++ {
+		if _, err := client.PodByIP("10.0.0.10"); !errors.Is(err, kube2iam.ErrPodNotFound) {
+			t.Fatalf("expected ErrPodNotFound, got %v", err)
+		}
+	}
+	if lists != 1 {
+		t.Errorf("expected the api server miss to be cached, got %d lists", lists)
+	}
+	if got := testutil.ToFloat64(metrics.PodLookupCount.WithLabelValues(podLookupNotFound)); got != notFound+3 {
+		t.Errorf("expected a not found lookup per call, got %v", got-notFound)
+	}
 
-	// Covered separately; integration test validates the full flow.
-	t.Skip("resolveDuplicatedIP requires a fake API server — covered in integration tests")
+	// Without fallback, the lookup is retried by the caller
+	client.EnablePodLookupFallback(0, false)
+	if _, err := client.PodByIP("10.0.0.10"); err == nil || errors.Is(err, kube2iam.ErrPodNotFound) {
+		t.Errorf("expected a retryable error without fallback, got %v", err)
+	}
+}
+
+// ---- PodByUID tests ---------------------------------------------------------
+
+func TestPodByUID(t *testing.T) {
+	agent := runningPod("node-agent", "kube-system", "192.168.0.10")
+	agent.UID = "3f1c2a7e-8d4b-4c3a-9e2f-1a2b3c4d5e6f"
+	agent.Spec.HostNetwork = true
+	other := runningPod("other-agent", "kube-system", "192.168.0.10")
+	other.UID = "9b8a7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d"
+	other.Spec.HostNetwork = true
+	client := newTestClient(newPodIndexer(agent, other), newNamespaceIndexer(), false)
+
+	got, err := client.PodByUID(string(agent.UID))
+	if err != nil {
+		t.Fatalf("PodByUID returned unexpected error: %v", err)
+	}
+	if got.Name != "node-agent" {
+		t.Errorf("expected pod name 'node-agent', got %q", got.Name)
+	}
+
+	if _, err := client.PodByUID("unknown"); err == nil {
+		t.Error("expected error for unknown UID, got nil")
+	}
 }
 
 // ---- ListPodIPs tests -------------------------------------------------------
@@ -184,6 +420,16 @@ func TestNamespaceByNameFound(t *testing.T) {
 	}
 }
 
+func TestNamespaceByNameNotWatched(t *testing.T) {
+	client := &Client{}
+	if _, err := client.NamespaceByName("default"); !errors.Is(err, kube2iam.ErrNamespaceNotWatched) {
+		t.Errorf("expected ErrNamespaceNotWatched, got %v", err)
+	}
+	if names := client.ListNamespaces(); len(names) != 0 {
+		t.Errorf("expected no namespaces, got %v", names)
+	}
+}
+
 func TestNamespaceByNameNotFound(t *testing.T) {
 	client := newTestClient(newPodIndexer(), newNamespaceIndexer(), false)
 
@@ -193,6 +439,255 @@ func TestNamespaceByNameNotFound(t *testing.T) {
 	}
 }
 
+func TestWatchForNamespacesMetadataOnly(t *testing.T) {
+	var accept, labelSelector string
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sendInitialEvents") == "true" {
+			// Streaming lists are not supported, the reflector falls back to a list
+			http.Error(w, "streaming lists are not supported", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("watch") == "true" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		accept = r.Header.Get("Accept")
+		labelSelector = r.URL.Query().Get("labelSelector")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"kind":"PartialObjectMetadataList","apiVersion":"meta.k8s.io/v1","metadata":{"resourceVersion":"1"},
+"items":[{"kind":"PartialObjectMetadata","apiVersion":"meta.k8s.io/v1","metadata":{"name":"team-a","resourceVersion":"1",
+"labels":{"team":"a"},"annotations":{"iam.amazonaws.com/allowed-roles":"[\"role-a\"]"},
+"managedFields":[{"manager":"kubectl","operation":"Apply"}]}}]}`))
+	}))
+	defer func() {
+		apiServer.CloseClientConnections()
+		apiServer.Close()
+	}()
+
+	metadataClient, err := metadata.NewForConfig(&rest.Config{Host: apiServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{metadataClient: metadataClient}
+	synced := client.WatchForNamespaces(t.Context(), cache.ResourceEventHandlerFuncs{}, time.Hour, "team")
+	if !cache.WaitForCacheSync(testStopCh(t, 5*time.Second), synced) {
+		t.Fatal("namespace cache did not sync")
+	}
+
+	ns, err := client.NamespaceByName("team-a")
+	if err != nil {
+		t.Fatalf("NamespaceByName returned unexpected error: %v", err)
+	}
+	if ns.GetLabels()["team"] != "a" || ns.GetAnnotations()["iam.amazonaws.com/allowed-roles"] != `["role-a"]` {
+		t.Errorf("expected namespace labels and annotations to be kept, got %+v", ns.ObjectMeta)
+	}
+	if len(ns.ManagedFields) != 0 {
+		t.Errorf("expected managed fields to be dropped, got %v", ns.ManagedFields)
+	}
+	if size := testutil.ToFloat64(metrics.CacheObjects.WithLabelValues("namespaces")); size != 1 {
+		t.Errorf("expected 1 cached namespace reported, got %v", size)
+	}
+	if !strings.Contains(accept, "PartialObjectMetadata") {
+		t.Errorf("expected a metadata-only request, got Accept %q", accept)
+	}
+	if labelSelector != "team" {
+		t.Errorf("expected namespaces to be listed with the label selector, got %q", labelSelector)
+	}
+	// A namespace missing from the cache may match the selector but not be indexed yet
+	if _, err := client.NamespaceByName("kube-system"); err == nil || errors.Is(err, kube2iam.ErrNamespaceNotWatched) {
+		t.Errorf("expected a lookup error for a namespace outside the selector, got %v", err)
+	}
+}
+
+// testStopCh returns a channel closed after the timeout or at the end of the test.
+func testStopCh(t *testing.T, timeout time.Duration) <-chan struct{} {
+	stopCh := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() { close(stopCh) })
+	t.Cleanup(func() { timer.Stop() })
+	return stopCh
+}
+
+// ---- Informer health tests -------------------------------------------------
+
+func TestInformerHealthStale(t *testing.T) {
+	health := newInformerHealth("test-stale", cache.ResourceEventHandlerFuncs{})
+	now := time.Now()
+
+	if health.stale(now, time.Minute) {
+		t.Error("expected a new informer not to be stale")
+	}
+	if !health.stale(now.Add(2*time.Minute), time.Minute) {
+		t.Error("expected an informer without activity for 2m to be stale")
+	}
+
+	health.recordEvent(now.Add(2 * time.Minute))
+	if health.stale(now.Add(2*time.Minute), time.Minute) {
+		t.Error("expected an informer with a recent event not to be stale")
+	}
+	if ts := testutil.ToFloat64(metrics.InformerLastEvent.WithLabelValues("test-stale")); ts != float64(now.Add(2*time.Minute).UnixNano())/1e9 {
+		t.Errorf("expected the last event time to be reported, got %v", ts)
+	}
+}
+
+func TestInformerHealthResync(t *testing.T) {
+	updates := 0
+	health := newInformerHealth("test-resync", cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) { updates++ },
+	})
+	metrics.InformerLastResync.WithLabelValues("test-resync").Set(0)
+
+	oldPod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", ResourceVersion: "1"}}
+	newPod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", ResourceVersion: "2"}}
+	health.OnUpdate(oldPod, newPod)
+	if ts := testutil.ToFloat64(metrics.InformerLastResync.WithLabelValues("test-resync")); ts != 0 {
+		t.Errorf("expected a modification not to be reported as a resync, got %v", ts)
+	}
+
+	health.OnUpdate(newPod, newPod)
+	if ts := testutil.ToFloat64(metrics.InformerLastResync.WithLabelValues("test-resync")); ts == 0 {
+		t.Error("expected the resync to be reported")
+	}
+	if updates != 2 {
+		t.Errorf("expected both updates to be passed on to the handler, got %d", updates)
+	}
+}
+
+func TestStaleInformers(t *testing.T) {
+	fresh := newInformerHealth("pods", cache.ResourceEventHandlerFuncs{})
+	stale := newInformerHealth("namespaces", cache.ResourceEventHandlerFuncs{})
+	stale.touch(time.Now().Add(-time.Hour))
+	client := &Client{informers: []*informerHealth{fresh, stale}}
+
+	if got := client.StaleInformers(); got != nil {
+		t.Errorf("expected no stale informers with staleness detection disabled, got %v", got)
+	}
+	client.EnableStalenessDetection(time.Minute)
+	if got := client.StaleInformers(); len(got) != 1 || got[0] != "namespaces" {
+		t.Errorf("expected the namespaces informer to be stale, got %v", got)
+	}
+}
+
+// blockingController runs until its context is done.
+type blockingController struct {
+	cache.Controller
+}
+
+func (blockingController) RunWithContext(ctx context.Context) { <-ctx.Done() }
+
+func TestStoppedInformersAreNotReported(t *testing.T) {
+	client := &Client{}
+	client.EnableStalenessDetection(time.Minute)
+	stopped := newInformerHealth("pods", cache.ResourceEventHandlerFuncs{})
+	ctx, cancel := context.WithCancel(context.Background())
+	client.runInformer(ctx, blockingController{}, stopped)
+	running := newInformerHealth("pods", cache.ResourceEventHandlerFuncs{})
+	client.runInformer(t.Context(), blockingController{}, running)
+
+	// The informers of a stopped server go stale, they must not fail the informers of the next run
+	stopped.touch(time.Now().Add(-time.Hour))
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(client.StaleInformers()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the stopped informer not to be reported, got %v", client.StaleInformers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.informersMu.Lock()
+	defer client.informersMu.Unlock()
+	if len(client.informers) != 1 || client.informers[0] != running {
+		t.Errorf("expected only the running informer to be tracked, got %d informers", len(client.informers))
+	}
+}
+
+func TestStaleWatchIsRestarted(t *testing.T) {
+	var mu sync.Mutex
+	watches := 0
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sendInitialEvents") == "true" {
+			http.Error(w, "streaming lists are not supported", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("watch") == "true" {
+			mu.Lock()
+			watches++
+			mu.Unlock()
+			// The watch never delivers events
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"kind":"PartialObjectMetadataList","apiVersion":"meta.k8s.io/v1","metadata":{"resourceVersion":"1"},"items":[]}`))
+	}))
+	defer func() {
+		apiServer.CloseClientConnections()
+		apiServer.Close()
+	}()
+
+	metadataClient, err := metadata.NewForConfig(&rest.Config{Host: apiServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarts := testutil.ToFloat64(metrics.InformerWatchRestarts.WithLabelValues("namespaces"))
+	client := &Client{metadataClient: metadataClient}
+	client.EnableStalenessDetection(200 * time.Millisecond)
+	synced := client.WatchForNamespaces(t.Context(), cache.ResourceEventHandlerFuncs{}, time.Hour, "")
+	if !cache.WaitForCacheSync(testStopCh(t, 5*time.Second), synced) {
+		t.Fatal("namespace cache did not sync")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := watches
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the stale watch to be restarted, got %d watches", n)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(metrics.InformerWatchRestarts.WithLabelValues("namespaces")); got <= restarts {
+		t.Errorf("expected the watch restart to be reported, got %v", got)
+	}
+}
+
+// ---- NodeByName tests -------------------------------------------------------
+
+func TestNodeByName(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{
+		nodeIndexName: kube2iam.NodeIndexFunc,
+	})
+	_ = indexer.Add(node)
+	client := &Client{nodeIndexer: indexer}
+
+	got, err := client.NodeByName("node-1")
+	if err != nil {
+		t.Fatalf("NodeByName returned unexpected error: %v", err)
+	}
+	if got.Name != "node-1" {
+		t.Errorf("expected node name 'node-1', got %q", got.Name)
+	}
+
+	if _, err := client.NodeByName("node-2"); err == nil {
+		t.Error("expected error for missing node, got nil")
+	}
+}
+
+func TestNodeByNameNotWatched(t *testing.T) {
+	client := newTestClient(newPodIndexer(), newNamespaceIndexer(), false)
+	if _, err := client.NodeByName("node-1"); err == nil {
+		t.Error("expected error when nodes are not watched, got nil")
+	}
+}
+
 // ---- ListNamespaces tests ---------------------------------------------------
 
 func TestListNamespaces(t *testing.T) {
@@ -221,11 +716,18 @@ clusters:
 - cluster:
     server: https://1.2.3.4
   name: test
+- cluster:
+    server: https://5.6.7.8
+  name: other
 contexts:
 - context:
     cluster: test
     user: test
   name: test
+- context:
+    cluster: other
+    user: test
+  name: other
 current-context: test
 kind: Config
 preferences: {}
@@ -242,7 +744,7 @@ users:
 	}
 
 	// Test loading valid kubeconfig
-	client, err := NewClient(tmpFile.Name(), "", "", "node", false, false)
+	client, err := NewClient(ClientOptions{KubeconfigPath: tmpFile.Name(), NodeName: "node"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -255,8 +757,90 @@ users:
 }
 
 func TestNewClientKubeconfigNotFound(t *testing.T) {
-	_, err := NewClient("/non/existent/path", "", "", "node", false, false)
+	_, err := NewClient(ClientOptions{KubeconfigPath: "/non/existent/path", NodeName: "node"})
 	if err == nil {
 		t.Fatal("expected error for non-existent kubeconfig, got nil")
 	}
 }
+
+func TestRestConfig(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	content := `
+apiVersion: v1
+clusters:
+- cluster:
+    server: https://1.2.3.4
+  name: test
+- cluster:
+    server: https://5.6.7.8
+  name: other
+contexts:
+- context:
+    cluster: test
+    user: test
+  name: test
+- context:
+    cluster: other
+    user: test
+  name: other
+current-context: test
+kind: Config
+users:
+- name: test
+  user:
+    token: secret
+`
+	if err := os.WriteFile(kubeconfig, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := restConfig(ClientOptions{KubeconfigPath: kubeconfig})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.Host != "https://1.2.3.4" {
+		t.Errorf("expected the current context host, got %q", config.Host)
+	}
+	if config.UserAgent != UserAgent() || !strings.HasPrefix(config.UserAgent, "kube2iam/") {
+		t.Errorf("expected the kube2iam user agent, got %q", config.UserAgent)
+	}
+
+	config, err = restConfig(ClientOptions{
+		KubeconfigPath:    kubeconfig,
+		KubeconfigContext: "other",
+		TokenFile:         "/var/run/secrets/token",
+		CertFile:          "/etc/kube2iam/tls.crt",
+		KeyFile:           "/etc/kube2iam/tls.key",
+		CAFile:            "/etc/kube2iam/ca.crt",
+		QPS:               50,
+		Burst:             100,
+		UserAgent:         "custom",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.Host != "https://5.6.7.8" {
+		t.Errorf("expected the host of the selected context, got %q", config.Host)
+	}
+	if config.BearerToken != "" || config.BearerTokenFile != "/var/run/secrets/token" {
+		t.Errorf("expected the token file to replace the token, got %q and %q", config.BearerToken, config.BearerTokenFile)
+	}
+	if config.CertFile != "/etc/kube2iam/tls.crt" || config.KeyFile != "/etc/kube2iam/tls.key" || config.CAFile != "/etc/kube2iam/ca.crt" {
+		t.Errorf("expected client certificate files to be set, got %+v", config.TLSClientConfig)
+	}
+	if config.QPS != 50 || config.Burst != 100 || config.UserAgent != "custom" {
+		t.Errorf("expected QPS 50, burst 100 and user agent custom, got %v, %d and %q", config.QPS, config.Burst, config.UserAgent)
+	}
+
+	if _, err := restConfig(ClientOptions{KubeconfigPath: kubeconfig, KubeconfigContext: "missing"}); err == nil {
+		t.Error("expected error for unknown context, got nil")
+	}
+
+	config, err = restConfig(ClientOptions{Host: "https://9.9.9.9", TokenFile: "/var/run/secrets/token"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.Host != "https://9.9.9.9" || config.BearerTokenFile != "/var/run/secrets/token" {
+		t.Errorf("expected the api server host and token file, got %q and %q", config.Host, config.BearerTokenFile)
+	}
+}
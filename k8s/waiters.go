@@ -0,0 +1,81 @@
+package k8s
+
+import (
+	"sync"
+
+	"github.com/jtblin/kube2iam"
+	"k8s.io/client-go/tools/cache"
+)
+
+// podWaiters signals the lookups waiting for a pod IP to be indexed.
+type podWaiters struct {
+	mu      sync.Mutex
+	waiters map[string][]chan struct{}
+}
+
+// wait registers a waiter for the IP, the returned channel is closed once a pod with the IP is indexed.
+// The returned function unregisters the waiter.
+func (w *podWaiters) wait(IP string) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.waiters == nil {
+		w.waiters = make(map[string][]chan struct{})
+	}
+	w.waiters[IP] = append(w.waiters[IP], ch)
+	return ch, func() { w.cancel(IP, ch) }
+}
+
+func (w *podWaiters) cancel(IP string, ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	waiters := w.waiters[IP]
+	for i, waiter := range waiters {
+		if waiter == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(w.waiters, IP)
+	} else {
+		w.waiters[IP] = waiters
+	}
+}
+
+// notify wakes up the waiters of the given IPs.
+func (w *podWaiters) notify(IPs []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, IP := range IPs {
+		for _, ch := range w.waiters[IP] {
+			close(ch)
+		}
+		delete(w.waiters, IP)
+	}
+}
+
+// podIndexNotifier wakes up the waiters of the IPs of pods being indexed before passing
+// the events on to the pod handler. The informer indexes pods before calling its handler.
+type podIndexNotifier struct {
+	cache.ResourceEventHandler
+	waiters *podWaiters
+}
+
+// OnAdd is called when a pod is added.
+func (n *podIndexNotifier) OnAdd(obj interface{}, isInInitialList bool) {
+	n.notify(obj)
+	n.ResourceEventHandler.OnAdd(obj, isInInitialList)
+}
+
+// OnUpdate is called when a pod is modified.
+func (n *podIndexNotifier) OnUpdate(oldObj, newObj interface{}) {
+	n.notify(newObj)
+	n.ResourceEventHandler.OnUpdate(oldObj, newObj)
+}
+
+func (n *podIndexNotifier) notify(obj interface{}) {
+	if IPs, err := kube2iam.PodIPIndexFunc(obj); err == nil && len(IPs) > 0 {
+		n.waiters.notify(IPs)
+	}
+}
@@ -0,0 +1,123 @@
+package mappings
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// RoleAlias is the target of an alias, optionally limited to some namespaces.
+type RoleAlias struct {
+	ARN        string   `json:"arn"`
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// AliasRegistry resolves role aliases to roles. It is kept up to date by the events
+// of a ConfigMap where each key is an alias and each value either a role or a JSON
+// object of the form {"arn": "...", "namespaces": ["..."]}.
+type AliasRegistry struct {
+	mu      sync.RWMutex
+	aliases map[string]RoleAlias
+}
+
+// Resolve returns the role an alias points to for the given namespace.
+func (a *AliasRegistry) Resolve(alias, namespace string) (string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	target, ok := a.aliases[alias]
+	if !ok {
+		return "", false
+	}
+	if len(target.Namespaces) == 0 {
+		return target.ARN, true
+	}
+	for _, ns := range target.Namespaces {
+		if ns == namespace {
+			return target.ARN, true
+		}
+	}
+	return "", false
+}
+
+// Aliases returns a copy of the registered aliases.
+func (a *AliasRegistry) Aliases() map[string]RoleAlias {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	aliases := make(map[string]RoleAlias, len(a.aliases))
+	for k, v := range a.aliases {
+		aliases[k] = v
+	}
+	return aliases
+}
+
+func (a *AliasRegistry) update(cm *v1.ConfigMap) {
+	aliases := make(map[string]RoleAlias, len(cm.Data))
+	for alias, value := range cm.Data {
+		value = strings.TrimSpace(value)
+		if !strings.HasPrefix(value, "{") {
+			aliases[alias] = RoleAlias{ARN: value}
+			continue
+		}
+		var target RoleAlias
+		if err := json.Unmarshal([]byte(value), &target); err != nil || target.ARN == "" {
+			log.Errorf("Unable to decode role alias %s in configmap %s/%s ( value is '%s' ) with error: %v", alias, cm.Namespace, cm.Name, value, err)
+			continue
+		}
+		aliases[alias] = target
+	}
+
+	a.mu.Lock()
+	a.aliases = aliases
+	a.mu.Unlock()
+	log.Infof("Loaded %d role aliases from configmap %s/%s", len(aliases), cm.Namespace, cm.Name)
+}
+
+// OnAdd is called when the alias configmap is added.
+func (a *AliasRegistry) OnAdd(obj interface{}, isInInitialList bool) {
+	cm, ok := obj.(*v1.ConfigMap)
+	if !ok {
+		log.Errorf("Expected ConfigMap but OnAdd handler received %+v", obj)
+		return
+	}
+	a.update(cm)
+}
+
+// OnUpdate is called when the alias configmap is modified.
+func (a *AliasRegistry) OnUpdate(oldObj, newObj interface{}) {
+	cm, ok := newObj.(*v1.ConfigMap)
+	if !ok {
+		log.Errorf("Expected ConfigMap but OnUpdate handler received %+v %+v", oldObj, newObj)
+		return
+	}
+	a.update(cm)
+}
+
+// OnDelete is called when the alias configmap is deleted, all aliases are removed.
+func (a *AliasRegistry) OnDelete(obj interface{}) {
+	cm, ok := obj.(*v1.ConfigMap)
+	if !ok {
+		if deletedObj, dok := obj.(cache.DeletedFinalStateUnknown); dok {
+			cm, ok = deletedObj.Obj.(*v1.ConfigMap)
+		}
+	}
+	if !ok {
+		log.Errorf("Expected ConfigMap but OnDelete handler received %+v", obj)
+		return
+	}
+
+	a.mu.Lock()
+	a.aliases = map[string]RoleAlias{}
+	a.mu.Unlock()
+	log.Warnf("Role alias configmap %s/%s deleted, removed all role aliases", cm.Namespace, cm.Name)
+}
+
+// NewAliasRegistry returns an empty AliasRegistry.
+func NewAliasRegistry() *AliasRegistry {
+	return &AliasRegistry{aliases: map[string]RoleAlias{}}
+}
@@ -0,0 +1,105 @@
+package mappings
+
+import (
+	"testing"
+
+	"github.com/jtblin/kube2iam/iam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func aliasConfigMap(data map[string]string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "role-aliases", Namespace: "kube-system"},
+		Data:       data,
+	}
+}
+
+func TestAliasRegistryResolve(t *testing.T) {
+	registry := NewAliasRegistry()
+	registry.OnAdd(aliasConfigMap(map[string]string{
+		"billing-reader": "arn:aws:iam::999999999999:role/billing/reader",
+		"payments-admin": `{"arn": "payments/admin", "namespaces": ["payments"]}`,
+		"broken":         `{"arn": `,
+	}), true)
+
+	tests := []struct {
+		alias     string
+		namespace string
+		expected  string
+		found     bool
+	}{
+		{"billing-reader", "default", "arn:aws:iam::999999999999:role/billing/reader", true},
+		{"payments-admin", "payments", "payments/admin", true},
+		{"payments-admin", "default", "", false},
+		{"broken", "default", "", false},
+		{"unknown", "default", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.alias+"/"+tt.namespace, func(t *testing.T) {
+			got, found := registry.Resolve(tt.alias, tt.namespace)
+			if got != tt.expected || found != tt.found {
+				t.Errorf("Resolve(%q, %q) = (%q, %t), want (%q, %t)", tt.alias, tt.namespace, got, found, tt.expected, tt.found)
+			}
+		})
+	}
+}
+
+func TestAliasRegistryUpdateAndDelete(t *testing.T) {
+	registry := NewAliasRegistry()
+	old := aliasConfigMap(map[string]string{"reader": "reader-v1"})
+	registry.OnAdd(old, true)
+
+	updated := aliasConfigMap(map[string]string{"reader": "reader-v2"})
+	registry.OnUpdate(old, updated)
+	if got, _ := registry.Resolve("reader", "default"); got != "reader-v2" {
+		t.Errorf("expected updated alias 'reader-v2', got %q", got)
+	}
+
+	registry.OnDelete(cache.DeletedFinalStateUnknown{Key: "kube-system/role-aliases", Obj: updated})
+	if _, found := registry.Resolve("reader", "default"); found {
+		t.Error("expected aliases to be removed when the configmap is deleted")
+	}
+
+	// Should not panic; logs an error
+	registry.OnAdd("not-a-configmap", false)
+	registry.OnUpdate("old", "new")
+	registry.OnDelete("not-a-configmap")
+}
+
+func TestExtractRoleARNWithAlias(t *testing.T) {
+	registry := NewAliasRegistry()
+	registry.OnAdd(aliasConfigMap(map[string]string{
+		"billing-reader": "arn:aws:iam::999999999999:role/billing/reader",
+		"payments-admin": `{"arn": "payments/admin", "namespaces": ["payments"]}`,
+	}), true)
+
+	rp := NewRoleMapper(roleKey, externalIDKey, "", false, namespaceKey, &iam.Client{BaseARN: defaultBaseRole}, &storeMock{}, "glob", WithRoleAliases(registry))
+
+	tests := []struct {
+		annotation  string
+		namespace   string
+		expectedARN string
+	}{
+		{"billing-reader", "default", "arn:aws:iam::999999999999:role/billing/reader"},
+		{"payments-admin", "payments", defaultBaseRole + "payments/admin"},
+		{"payments-admin", "default", defaultBaseRole + "payments-admin"},
+		{"plain-role", "default", defaultBaseRole + "plain-role"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.annotation+"/"+tt.namespace, func(t *testing.T) {
+			pod := &v1.Pod{}
+			pod.Namespace = tt.namespace
+			pod.Annotations = map[string]string{roleKey: tt.annotation}
+
+			got, err := rp.extractRoleARNs(pod)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != 1 || got[0] != tt.expectedARN {
+				t.Errorf("expected %q, got %v", tt.expectedARN, got)
+			}
+		})
+	}
+}
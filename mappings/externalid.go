@@ -0,0 +1,77 @@
+package mappings
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ExternalIDSourcePod reads the external ID from the pod annotation.
+	ExternalIDSourcePod = "pod"
+	// ExternalIDSourceNamespace reads the external ID from the namespace annotation.
+	ExternalIDSourceNamespace = "namespace"
+	// ExternalIDSourceDerived derives the external ID from the namespace name and a secret salt.
+	ExternalIDSourceDerived = "derived"
+)
+
+// ErrExternalIDMismatch is returned when a pod annotation doesn't match the external ID of its namespace.
+var ErrExternalIDMismatch = errors.New("external ID of pod does not match its namespace")
+
+// ValidExternalIDSource checks that the external ID source is supported.
+func ValidExternalIDSource(source string) bool {
+	switch source {
+	case ExternalIDSourcePod, ExternalIDSourceNamespace, ExternalIDSourceDerived:
+		return true
+	}
+	return false
+}
+
+// WithExternalIDSource takes external IDs from the namespace instead of the pod. With the namespace
+// source the external ID is read from the namespaceKey annotation, with the derived source it is an
+// HMAC of the namespace name keyed by salt. Values in pod annotations are ignored unless strict is
+// set, in which case a pod annotation that differs from the namespace external ID is refused.
+func WithExternalIDSource(source, namespaceKey string, salt []byte, strict bool) Option {
+	return func(r *RoleMapper) {
+		r.externalIDSource = source
+		r.namespaceExternalIDKey = namespaceKey
+		r.externalIDSalt = salt
+		r.externalIDStrict = strict
+	}
+}
+
+// namespaceExternalID returns the external ID controlled by the namespace.
+func (r *RoleMapper) namespaceExternalID(namespace string) string {
+	if r.externalIDSource == ExternalIDSourceDerived {
+		mac := hmac.New(sha256.New, r.externalIDSalt)
+		mac.Write([]byte(namespace))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	ns, err := r.store.NamespaceByName(namespace)
+	if err != nil {
+		log.Debugf("Unable to find an indexed namespace of %s", namespace)
+		return ""
+	}
+	return ns.GetAnnotations()[r.namespaceExternalIDKey]
+}
+
+// resolveExternalID returns the external ID of a pod given the value of its annotation.
+func (r *RoleMapper) resolveExternalID(podExternalID, namespace string) (string, error) {
+	if r.externalIDSource == "" || r.externalIDSource == ExternalIDSourcePod {
+		return podExternalID, nil
+	}
+
+	externalID := r.namespaceExternalID(namespace)
+	if podExternalID != "" && !hmac.Equal([]byte(podExternalID), []byte(externalID)) {
+		if r.externalIDStrict {
+			return "", fmt.Errorf("%w %s", ErrExternalIDMismatch, namespace)
+		}
+		log.Warnf("Ignoring external ID annotation of pod in namespace %s", namespace)
+	}
+	return externalID, nil
+}
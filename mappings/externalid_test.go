@@ -0,0 +1,81 @@
+package mappings
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jtblin/kube2iam/iam"
+	v1 "k8s.io/api/core/v1"
+)
+
+func newExternalIDMapper(podExternalID string, opt Option) *RoleMapper {
+	pod := &v1.Pod{}
+	pod.Namespace = "tenant-a"
+	if podExternalID != "" {
+		pod.Annotations = map[string]string{externalIDKey: podExternalID}
+	}
+	ns := &v1.Namespace{}
+	ns.Name = "tenant-a"
+	ns.Annotations = map[string]string{"nsExternalIDKey": "tenant-a-id"}
+
+	store := &storeMock{
+		pods:  map[string]*v1.Pod{"10.0.2.1": pod},
+		nsMap: map[string]*v1.Namespace{"tenant-a": ns},
+	}
+	return NewRoleMapper(roleKey, externalIDKey, "", false, namespaceKey, &iam.Client{BaseARN: defaultBaseRole}, store, "glob", opt)
+}
+
+func TestGetExternalIDMappingSource(t *testing.T) {
+	salt := []byte("s3cr3t")
+	derived := (&RoleMapper{externalIDSource: ExternalIDSourceDerived, externalIDSalt: salt}).namespaceExternalID("tenant-a")
+
+	tests := []struct {
+		name          string
+		source        string
+		strict        bool
+		podExternalID string
+		expected      string
+		mismatch      bool
+	}{
+		{name: "pod source uses annotation", source: ExternalIDSourcePod, podExternalID: "claimed", expected: "claimed"},
+		{name: "namespace source", source: ExternalIDSourceNamespace, expected: "tenant-a-id"},
+		{name: "namespace source ignores pod value", source: ExternalIDSourceNamespace, podExternalID: "claimed", expected: "tenant-a-id"},
+		{name: "namespace source strict match", source: ExternalIDSourceNamespace, strict: true, podExternalID: "tenant-a-id", expected: "tenant-a-id"},
+		{name: "namespace source strict mismatch", source: ExternalIDSourceNamespace, strict: true, podExternalID: "claimed", mismatch: true},
+		{name: "derived source", source: ExternalIDSourceDerived, expected: derived},
+		{name: "derived source strict mismatch", source: ExternalIDSourceDerived, strict: true, podExternalID: "claimed", mismatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newExternalIDMapper(tt.podExternalID, WithExternalIDSource(tt.source, "nsExternalIDKey", salt, tt.strict))
+			externalID, err := rp.GetExternalIDMapping("10.0.2.1")
+			if tt.mismatch {
+				if !errors.Is(err, ErrExternalIDMismatch) {
+					t.Errorf("expected ErrExternalIDMismatch, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if externalID != tt.expected {
+				t.Errorf("expected external ID %q, got %q", tt.expected, externalID)
+			}
+		})
+	}
+}
+
+func TestDerivedExternalID(t *testing.T) {
+	rp := &RoleMapper{externalIDSource: ExternalIDSourceDerived, externalIDSalt: []byte("s3cr3t")}
+	first := rp.namespaceExternalID("tenant-a")
+	if first != rp.namespaceExternalID("tenant-a") {
+		t.Error("expected derived external IDs to be deterministic")
+	}
+	if first == rp.namespaceExternalID("tenant-b") {
+		t.Error("expected derived external IDs to differ between namespaces")
+	}
+	other := &RoleMapper{externalIDSource: ExternalIDSourceDerived, externalIDSalt: []byte("other")}
+	if first == other.namespaceExternalID("tenant-a") {
+		t.Error("expected derived external IDs to depend on the salt")
+	}
+}
@@ -0,0 +1,136 @@
+package mappings
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/jtblin/kube2iam"
+	"github.com/jtblin/kube2iam/metrics"
+)
+
+// CheckGrantExpiry exports the number of grants of each namespace expiring within the window
+// and evicts the cached credentials of the roles whose grants expired since the previous check.
+// It is meant to be called periodically from a single goroutine.
+func (r *RoleMapper) CheckGrantExpiry(window time.Duration) {
+	now := r.now()
+	metrics.NamespaceRoleGrantsExpiring.Reset()
+	var inUse map[string]bool
+
+	for _, name := range r.store.ListNamespaces() {
+		ns, err := r.store.NamespaceByName(name)
+		if err != nil {
+			continue
+		}
+		baseARN, err := r.baseARNOf(ns)
+		if err != nil {
+			continue
+		}
+
+		expiring := 0
+		for _, grant := range kube2iam.GetNamespaceRoleGrants(ns, r.namespaceKey) {
+			if grant.Expires == nil {
+				continue
+			}
+			if grant.Expires.After(now) {
+				if grant.Expires.Before(now.Add(window)) {
+					expiring++
+				}
+				continue
+			}
+			if grant.Expires.After(r.lastGrantCheck) {
+				if inUse == nil {
+					inUse = r.rolesInUse()
+				}
+				pattern := r.iam.RoleARNWithBase(baseARN, grant.Role)
+				evicted := r.credentials.EvictRoles(func(roleARN string) bool {
+					return r.matchRolePattern(pattern, roleARN) && !inUse[roleARN]
+				})
+				metrics.IamCacheEvictionCount.WithLabelValues("grant_expired").Add(float64(evicted))
+				log.Warnf("Grant of role %s on namespace %s expired at %s, evicted %d cached credentials.", grant.Role, name, grant.Expires.Format(time.RFC3339), evicted)
+			}
+		}
+		if expiring > 0 {
+			metrics.NamespaceRoleGrantsExpiring.WithLabelValues(name).Set(float64(expiring))
+		}
+	}
+	r.lastGrantCheck = now
+}
+
+// RevokeNamespaceGrants evicts the cached credentials of the roles matching revoked grants
+// of a namespace that are not allowed in the namespace anymore, nor used by other pods.
+func (r *RoleMapper) RevokeNamespaceGrants(ns *v1.Namespace, revoked []kube2iam.RoleGrant) {
+	if !r.namespaceRestriction {
+		return
+	}
+	// The namespace may have been deleted from the cache
+	baseARN, err := r.baseARNOf(ns)
+	if err != nil {
+		baseARN = r.iam.BaseARN
+	}
+	inUse := r.rolesInUse()
+	for _, grant := range revoked {
+		pattern := r.iam.RoleARNWithBase(baseARN, grant.Role)
+		evicted := r.credentials.EvictRoles(func(roleARN string) bool {
+			return r.matchRolePattern(pattern, roleARN) && !inUse[roleARN] && !r.roleAllowedInNamespace(roleARN, ns.GetName())
+		})
+		metrics.IamCacheEvictionCount.WithLabelValues("namespace_changed").Add(float64(evicted))
+		log.Infof("Grant of role %s on namespace %s revoked, evicted %d cached credentials.", grant.Role, ns.GetName(), evicted)
+	}
+}
+
+// RevokePodRoles evicts the cached credentials of the roles a pod lost when its role annotation changed,
+// unless other pods use them.
+func (r *RoleMapper) RevokePodRoles(oldPod, newPod *v1.Pod) {
+	oldRoles, err := r.extractRoleARNs(oldPod)
+	if err != nil {
+		return
+	}
+	kept := map[string]bool{}
+	if newRoles, err := r.extractRoleARNs(newPod); err == nil {
+		for _, role := range newRoles {
+			kept[role] = true
+		}
+	}
+	var inUse map[string]bool
+	for _, role := range oldRoles {
+		if kept[role] {
+			continue
+		}
+		if inUse == nil {
+			inUse = r.rolesInUse()
+		}
+		if inUse[role] {
+			log.Infof("Role %s of pod %s/%s revoked, keeping the cached credentials used by other pods.", role, oldPod.GetNamespace(), oldPod.GetName())
+			continue
+		}
+		revoked := role
+		evicted := r.credentials.EvictRoles(func(roleARN string) bool { return roleARN == revoked })
+		metrics.IamCacheEvictionCount.WithLabelValues("pod_changed").Add(float64(evicted))
+		log.Infof("Role %s of pod %s/%s revoked, evicted %d cached credentials.", role, oldPod.GetNamespace(), oldPod.GetName(), evicted)
+	}
+}
+
+// rolesInUse returns the roles of the indexed pods that they may still assume, so that the credentials
+// they share with a pod or namespace losing a role aren't evicted. The store holds the updated objects
+// when handlers are called.
+func (r *RoleMapper) rolesInUse() map[string]bool {
+	inUse := map[string]bool{}
+	for _, ip := range r.store.ListPodIPs() {
+		pod, err := r.store.PodByIP(ip)
+		if err != nil {
+			continue
+		}
+		roles, err := r.extractRoleARNs(pod)
+		if err != nil {
+			continue
+		}
+		for _, role := range roles {
+			if !r.namespaceRestriction || r.roleAllowedInNamespace(role, pod.GetNamespace()) {
+				inUse[role] = true
+			}
+		}
+	}
+	return inUse
+}
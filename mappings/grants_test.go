@@ -0,0 +1,245 @@
+package mappings
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/karlseguin/ccache"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/jtblin/kube2iam"
+	"github.com/jtblin/kube2iam/iam"
+	"github.com/jtblin/kube2iam/metrics"
+)
+
+// countingSTS returns credentials and counts the calls made to AssumeRole.
+type countingSTS struct {
+	calls int
+}
+
+func (c *countingSTS) AssumeRole(_ context.Context, _ *sts.AssumeRoleInput, _ ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	c.calls++
+	return &sts.AssumeRoleOutput{Credentials: &ststypes.Credentials{
+		AccessKeyId:     aws.String("AKIAEXAMPLE"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}}, nil
+}
+
+func (c *countingSTS) GetCallerIdentity(_ context.Context, _ *sts.GetCallerIdentityInput, _ ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	return &sts.GetCallerIdentityOutput{}, nil
+}
+
+type emptyRegions struct{}
+
+func (emptyRegions) DescribeRegions(_ context.Context, _ *ec2.DescribeRegionsInput, _ ...func(*ec2.Options)) (*ec2.DescribeRegionsOutput, error) {
+	return &ec2.DescribeRegionsOutput{}, nil
+}
+
+func grantNamespace(name string, grants string) *v1.Namespace {
+	ns := &v1.Namespace{}
+	ns.Name = name
+	ns.Annotations = map[string]string{namespaceKey: grants}
+	return ns
+}
+
+func TestRoleAllowedInNamespaceGrantPeriod(t *testing.T) {
+	now := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	store := &storeMock{nsMap: map[string]*v1.Namespace{
+		"default": grantNamespace("default", `[
+			{"role": "expired", "expires": "2024-01-01T00:00:00Z"},
+			{"role": "future", "notBefore": "2024-02-01T00:00:00Z"},
+			{"role": "current", "notBefore": "2024-01-01T00:00:00Z", "expires": "2024-02-01T00:00:00Z"},
+			"permanent"
+		]`),
+	}}
+	rp := NewRoleMapper(roleKey, externalIDKey, "", true, namespaceKey, &iam.Client{BaseARN: defaultBaseRole}, store, "glob")
+	rp.now = func() time.Time { return now }
+
+	for role, expected := range map[string]bool{
+		"expired":   false,
+		"future":    false,
+		"current":   true,
+		"permanent": true,
+	} {
+		if got := rp.roleAllowedInNamespace(defaultBaseRole+role, "default"); got != expected {
+			t.Errorf("role %s: expected allowed=%t, got %t", role, expected, got)
+		}
+	}
+}
+
+func newEvictionTestIAMClient(stsClient *countingSTS) *iam.Client {
+	return &iam.Client{
+		BaseARN: defaultBaseRole,
+		Cache:   ccache.New(ccache.Configure()),
+		STS:     stsClient,
+		Region:  emptyRegions{},
+	}
+}
+
+func assumeRoles(t *testing.T, iamClient *iam.Client, roleARNs ...string) {
+	t.Helper()
+	for _, roleARN := range roleARNs {
+		if _, err := iamClient.AssumeRole(roleARN, "", "10.0.5.1", time.Hour, 0); err != nil {
+			t.Fatalf("AssumeRole failed: %v", err)
+		}
+	}
+}
+
+func TestRevokeNamespaceGrants(t *testing.T) {
+	stsClient := &countingSTS{}
+	iamClient := newEvictionTestIAMClient(stsClient)
+	ns := grantNamespace("default", `["app-reader"]`)
+	store := &storeMock{nsMap: map[string]*v1.Namespace{"default": ns}}
+	rp := NewRoleMapper(roleKey, externalIDKey, "", true, namespaceKey, iamClient, store, "glob")
+
+	roles := []string{defaultBaseRole + "app-reader", defaultBaseRole + "app-writer", defaultBaseRole + "other"}
+	assumeRoles(t, iamClient, roles...)
+
+	// The annotation was tightened from app-* to app-reader
+	rp.RevokeNamespaceGrants(ns, []kube2iam.RoleGrant{{Role: "app-*"}})
+
+	assumeRoles(t, iamClient, roles...)
+	if stsClient.calls != 4 {
+		t.Errorf("expected only app-writer to be evicted, got %d STS calls", stsClient.calls)
+	}
+}
+
+func TestRevokePodRoles(t *testing.T) {
+	stsClient := &countingSTS{}
+	iamClient := newEvictionTestIAMClient(stsClient)
+	rp := NewRoleMapper(roleKey, externalIDKey, "", false, namespaceKey, iamClient, &storeMock{}, "glob")
+
+	oldPod := &v1.Pod{}
+	oldPod.Annotations = map[string]string{roleKey: `["reader", "writer"]`}
+	newPod := oldPod.DeepCopy()
+	newPod.Annotations[roleKey] = "reader"
+
+	roles := []string{defaultBaseRole + "reader", defaultBaseRole + "writer"}
+	assumeRoles(t, iamClient, roles...)
+	rp.RevokePodRoles(oldPod, newPod)
+	assumeRoles(t, iamClient, roles...)
+	if stsClient.calls != 3 {
+		t.Errorf("expected only writer to be evicted, got %d STS calls", stsClient.calls)
+	}
+}
+
+func TestRevokeRolesUsedByOtherPods(t *testing.T) {
+	newPod := func(ns, role string) *v1.Pod {
+		pod := &v1.Pod{}
+		pod.Namespace = ns
+		pod.Annotations = map[string]string{roleKey: role}
+		return pod
+	}
+	stsClient := &countingSTS{}
+	iamClient := newEvictionTestIAMClient(stsClient)
+	tightened := grantNamespace("default", `["app-reader"]`)
+	store := &storeMock{
+		pods: map[string]*v1.Pod{
+			"10.0.5.2": newPod("default", "reader"),
+			"10.0.5.3": newPod("other", "writer"),
+			"10.0.5.4": newPod("other", "app-writer"),
+			"10.0.5.5": newPod("default", "app-writer"),
+		},
+		nsMap: map[string]*v1.Namespace{
+			"default": tightened,
+			"other":   grantNamespace("other", `["writer", "app-writer"]`),
+		},
+	}
+	rp := NewRoleMapper(roleKey, externalIDKey, "", true, namespaceKey, iamClient, store, "glob")
+
+	roles := []string{defaultBaseRole + "writer", defaultBaseRole + "app-writer"}
+	assumeRoles(t, iamClient, roles...)
+
+	// The pod at 10.0.5.2 dropped writer, which the pod at 10.0.5.3 still uses
+	oldPod := newPod("default", `["reader", "writer"]`)
+	rp.RevokePodRoles(oldPod, store.pods["10.0.5.2"])
+	// The default namespace lost app-writer, which the other namespace still grants to its pod
+	rp.RevokeNamespaceGrants(tightened, []kube2iam.RoleGrant{{Role: "app-*"}})
+
+	assumeRoles(t, iamClient, roles...)
+	if stsClient.calls != 2 {
+		t.Errorf("expected the credentials used by other pods to be kept, got %d STS calls", stsClient.calls)
+	}
+}
+
+// evictionRecorder implements iam.CredentialsProvider and records the roles evicted.
+type evictionRecorder struct {
+	roles   []string
+	evicted []string
+}
+
+func (e *evictionRecorder) AssumeRole(_, _, _ string, _, _ time.Duration) (*iam.Credentials, error) {
+	return &iam.Credentials{}, nil
+}
+
+func (e *evictionRecorder) EvictRoles(match func(roleARN string) bool) int {
+	for _, role := range e.roles {
+		if match(role) {
+			e.evicted = append(e.evicted, role)
+		}
+	}
+	return len(e.evicted)
+}
+
+func TestRevokePodRolesCredentialsProvider(t *testing.T) {
+	provider := &evictionRecorder{roles: []string{defaultBaseRole + "reader", defaultBaseRole + "writer"}}
+	iamClient := newEvictionTestIAMClient(&countingSTS{})
+	rp := NewRoleMapper(roleKey, externalIDKey, "", false, namespaceKey, iamClient, &storeMock{}, "glob", WithCredentialsProvider(provider))
+
+	oldPod := &v1.Pod{}
+	oldPod.Annotations = map[string]string{roleKey: `["reader", "writer"]`}
+	newPod := oldPod.DeepCopy()
+	newPod.Annotations[roleKey] = "reader"
+
+	rp.RevokePodRoles(oldPod, newPod)
+	if len(provider.evicted) != 1 || provider.evicted[0] != defaultBaseRole+"writer" {
+		t.Errorf("expected writer to be evicted from the provider, got %v", provider.evicted)
+	}
+}
+
+func TestCheckGrantExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	stsClient := &countingSTS{}
+	iamClient := newEvictionTestIAMClient(stsClient)
+	store := &storeMock{
+		nsList: []string{"contractors", "stable"},
+		nsMap: map[string]*v1.Namespace{
+			"contractors": grantNamespace("contractors", fmt.Sprintf(`[
+				{"role": "contractor-*", "expires": %q},
+				{"role": "soon", "expires": %q},
+				{"role": "later", "expires": %q}
+			]`, now.Add(time.Minute).Format(time.RFC3339), now.Add(2*time.Hour).Format(time.RFC3339), now.Add(48*time.Hour).Format(time.RFC3339))),
+			"stable": grantNamespace("stable", `["reader"]`),
+		},
+	}
+	rp := NewRoleMapper(roleKey, externalIDKey, "", true, namespaceKey, iamClient, store, "glob")
+	rp.now = func() time.Time { return now }
+
+	rp.CheckGrantExpiry(24 * time.Hour)
+	if got := testutil.ToFloat64(metrics.NamespaceRoleGrantsExpiring.WithLabelValues("contractors")); got != 2 {
+		t.Errorf("expected 2 grants expiring within the window, got %v", got)
+	}
+
+	roles := []string{defaultBaseRole + "contractor-writer", defaultBaseRole + "reader"}
+	assumeRoles(t, iamClient, roles...)
+
+	now = now.Add(time.Hour)
+	rp.CheckGrantExpiry(24 * time.Hour)
+	if got := testutil.ToFloat64(metrics.NamespaceRoleGrantsExpiring.WithLabelValues("contractors")); got != 1 {
+		t.Errorf("expected 1 grant expiring within the window, got %v", got)
+	}
+
+	assumeRoles(t, iamClient, roles...)
+	if stsClient.calls != 3 {
+		t.Errorf("expected only the credentials of the expired grant to be evicted, got %d STS calls", stsClient.calls)
+	}
+}
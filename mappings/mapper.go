@@ -1,16 +1,23 @@
 package mappings
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
+	"text/template"
+	"time"
 
 	glob "github.com/ryanuber/go-glob"
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
 	"github.com/jtblin/kube2iam"
 	"github.com/jtblin/kube2iam/iam"
+	"github.com/jtblin/kube2iam/metrics"
+	"github.com/jtblin/kube2iam/policy"
 )
 
 // RoleMapper handles relevant logic around associating IPs with a given IAM role
@@ -20,49 +27,256 @@ type RoleMapper struct {
 	iamExternalIDKey           string
 	namespaceKey               string
 	namespaceRestriction       bool
+	namespaceRestrictionAudit  bool
 	iam                        *iam.Client
-	store                      store
+	credentials                iam.CredentialsProvider
+	store                      Store
 	namespaceRestrictionFormat string
+	policy                     *policy.Policy
+	aliases                    *AliasRegistry
+	roleTemplate               *template.Template
+	namespaceBaseARNKey        string
+	allowedAccounts            map[string]bool
+	externalIDSource           string
+	namespaceExternalIDKey     string
+	externalIDSalt             []byte
+	externalIDStrict           bool
+	optOutValue                string
+	strictNamespaces           labels.Selector
+	now                        func() time.Time
+	socketResolver             PodUIDResolver
+	nodeIP                     string
+	lastGrantCheck             time.Time
 }
 
-type store interface {
+const (
+	outcomeAnnotation      = "annotation"
+	outcomeTemplate        = "template"
+	outcomeDefaultRole     = "default_role"
+	outcomeOptOut          = "opt_out"
+	outcomeStrictNamespace = "strict_namespace"
+	outcomeNoRole          = "no_role"
+	outcomeRefused         = "refused"
+)
+
+var (
+	// ErrRoleOptOut is returned for pods annotated to have no AWS access.
+	ErrRoleOptOut = errors.New("pod opted out of AWS access")
+	// ErrStrictNamespace is returned for pods without a role annotation in a strict namespace.
+	ErrStrictNamespace = errors.New("default role refused in strict namespace")
+	// ErrNoRole is returned for pods without a role annotation when there is no default role.
+	ErrNoRole = errors.New("unable to find role")
+)
+
+// Option configures optional RoleMapper behaviour.
+type Option func(*RoleMapper)
+
+// WithPolicy evaluates the given CEL policy for every role mapping.
+func WithPolicy(p *policy.Policy) Option {
+	return func(r *RoleMapper) {
+		r.policy = p
+	}
+}
+
+// Store gives access to the pods, namespaces and nodes mapped to roles, e.g. the caches of k8s.Client.
+type Store interface {
 	ListPodIPs() []string
 	PodByIP(string) (*v1.Pod, error)
+	PodByUID(string) (*v1.Pod, error)
 	ListNamespaces() []string
 	NamespaceByName(string) (*v1.Namespace, error)
+	NodeByName(string) (*v1.Node, error)
+}
+
+// WithCredentialsProvider evicts the cached credentials of revoked roles from the given provider,
+// the provider issuing credentials when it isn't the IAM client.
+func WithCredentialsProvider(p iam.CredentialsProvider) Option {
+	return func(r *RoleMapper) {
+		if p != nil {
+			r.credentials = p
+		}
+	}
+}
+
+// WithNamespaceRestrictionAudit evaluates namespace restrictions without enforcing them,
+// would-be denials are logged and counted instead.
+func WithNamespaceRestrictionAudit(audit bool) Option {
+	return func(r *RoleMapper) {
+		r.namespaceRestrictionAudit = audit
+	}
+}
+
+// WithRoleAliases resolves pod role annotations through the given alias registry.
+func WithRoleAliases(aliases *AliasRegistry) Option {
+	return func(r *RoleMapper) {
+		r.aliases = aliases
+	}
+}
+
+// WithRoleTemplate derives the role of pods without a role annotation from their metadata,
+// before falling back to the default role.
+func WithRoleTemplate(tmpl *template.Template) Option {
+	return func(r *RoleMapper) {
+		r.roleTemplate = tmpl
+	}
+}
+
+// WithNamespaceBaseARN reads the base ARN of roles from the given namespace annotation,
+// so that pods of a namespace can use role names from another account.
+func WithNamespaceBaseARN(key string) Option {
+	return func(r *RoleMapper) {
+		r.namespaceBaseARNKey = key
+	}
+}
+
+// WithAllowedAccounts restricts the roles and namespace base ARNs to the given accounts.
+func WithAllowedAccounts(accountIDs []string) Option {
+	return func(r *RoleMapper) {
+		if len(accountIDs) == 0 {
+			return
+		}
+		r.allowedAccounts = make(map[string]bool, len(accountIDs))
+		for _, id := range accountIDs {
+			r.allowedAccounts[id] = true
+		}
+	}
+}
+
+// WithOptOutValue refuses credentials immediately to pods whose role annotation has the given value.
+func WithOptOutValue(value string) Option {
+	return func(r *RoleMapper) {
+		r.optOutValue = value
+	}
+}
+
+// WithStrictNamespaces refuses the default role to pods without a role annotation
+// in namespaces matching the selector.
+func WithStrictNamespaces(selector labels.Selector) Option {
+	return func(r *RoleMapper) {
+		r.strictNamespaces = selector
+	}
 }
 
 // RoleMappingResult represents the relevant information for a given mapping request
 type RoleMappingResult struct {
-	Role      string
-	IP        string
-	Namespace string
+	Role           string
+	Roles          []string
+	BaseARN        string
+	IP             string
+	Namespace      string
+	PodName        string
+	ServiceAccount string
+	NodeName       string
+	PolicyRule     string
+	// Outcome reports how the roles were chosen
+	Outcome string
+}
+
+// Permits returns whether the role ARN is one of the roles the pod may assume.
+func (r *RoleMappingResult) Permits(roleARN string) bool {
+	if roleARN == r.Role {
+		return true
+	}
+	for _, role := range r.Roles {
+		if roleARN == role {
+			return true
+		}
+	}
+	return false
 }
 
-// GetRoleMapping returns the normalized iam RoleMappingResult based on IP address
+// GetRoleMapping returns the normalized iam RoleMappingResult based on IP address.
 func (r *RoleMapper) GetRoleMapping(IP string) (*RoleMappingResult, error) {
-	pod, err := r.store.PodByIP(IP)
+	return r.GetRoleMappingForConnection(IP, 0)
+}
+
+// GetRoleMappingForConnection returns the normalized iam RoleMappingResult based on the
+// source address of a connection, the port is used to attribute connections from the node IP.
+// When the pod lists several roles the first one is the primary role, it must be
+// permitted while the other roles are dropped when they are not.
+func (r *RoleMapper) GetRoleMappingForConnection(IP string, port int) (*RoleMappingResult, error) {
+	pod, err := r.podForConnection(IP, port)
 	// If attempting to get a Pod that maps to multiple IPs
 	if err != nil {
 		return nil, err
 	}
 
-	role, err := r.extractRoleARN(pod)
+	roles, baseARN, outcome, err := r.selectRoleARNs(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	decision, err := r.checkRole(roles[0], pod, IP)
 	if err != nil {
 		return nil, err
 	}
+	permitted := []string{roles[0]}
+	for _, role := range roles[1:] {
+		if _, err := r.checkRole(role, pod, IP); err != nil {
+			log.Warnf("Ignoring additional role of pod at %s: %s", IP, err)
+			continue
+		}
+		permitted = append(permitted, role)
+	}
+
+	return &RoleMappingResult{
+		Role:           roles[0],
+		Roles:          permitted,
+		BaseARN:        baseARN,
+		Namespace:      pod.GetNamespace(),
+		IP:             IP,
+		PodName:        pod.GetName(),
+		ServiceAccount: pod.Spec.ServiceAccountName,
+		NodeName:       pod.Spec.NodeName,
+		PolicyRule:     decision.Rule,
+		Outcome:        outcome,
+	}, nil
+}
+
+// MappingOutcome returns how the roles of a role mapping were chosen, or why none were: the pod opted out,
+// is in a strict namespace or has no role, or the request was refused for any other reason.
+func MappingOutcome(result *RoleMappingResult, err error) string {
+	switch {
+	case err == nil:
+		return result.Outcome
+	case errors.Is(err, ErrRoleOptOut):
+		return outcomeOptOut
+	case errors.Is(err, ErrStrictNamespace):
+		return outcomeStrictNamespace
+	case errors.Is(err, ErrNoRole):
+		return outcomeNoRole
+	default:
+		return outcomeRefused
+	}
+}
+
+// checkRole checks that a role is in an allowed account, allowed in the namespace of the pod
+// and allowed by the policy.
+func (r *RoleMapper) checkRole(role string, pod *v1.Pod, IP string) (policy.Decision, error) {
+	if !r.accountAllowed(role) {
+		return policy.Decision{}, fmt.Errorf("role requested %s is in an account that is not allowed for pod at %s with namespace %s", role, IP, pod.GetNamespace())
+	}
 
 	// Determine if normalized role is allowed to be used in pod's namespace
-	if r.checkRoleForNamespace(role, pod.GetNamespace()) {
-		return &RoleMappingResult{Role: role, Namespace: pod.GetNamespace(), IP: IP}, nil
+	if !r.checkRoleForNamespace(role, pod.GetNamespace()) {
+		return policy.Decision{}, fmt.Errorf("role requested %s not valid for namespace of pod at %s with namespace %s", role, IP, pod.GetNamespace())
 	}
 
-	return nil, fmt.Errorf("role requested %s not valid for namespace of pod at %s with namespace %s", role, IP, pod.GetNamespace())
+	decision := r.checkRoleForPolicy(role, pod)
+	if !decision.Allowed {
+		return decision, fmt.Errorf("role requested %s denied by policy rule %q for pod at %s with namespace %s", role, decision.Rule, IP, pod.GetNamespace())
+	}
+	return decision, nil
 }
 
 // GetExternalIDMapping returns the externalID based on IP address
 func (r *RoleMapper) GetExternalIDMapping(IP string) (string, error) {
-	pod, err := r.store.PodByIP(IP)
+	return r.GetExternalIDMappingForConnection(IP, 0)
+}
+
+// GetExternalIDMappingForConnection returns the externalID based on the source address of a connection.
+func (r *RoleMapper) GetExternalIDMappingForConnection(IP string, port int) (string, error) {
+	pod, err := r.podForConnection(IP, port)
 	// If attempting to get a Pod that maps to multiple IPs
 	if err != nil {
 		return "", err
@@ -70,31 +284,139 @@ func (r *RoleMapper) GetExternalIDMapping(IP string) (string, error) {
 
 	externalID := pod.GetAnnotations()[r.iamExternalIDKey]
 
-	return externalID, nil
+	return r.resolveExternalID(externalID, pod.GetNamespace())
 }
 
-// extractQualifiedRoleName extracts a fully qualified ARN for a given pod,
+// extractRoleARNs extracts the fully qualified ARNs for a given pod.
+func (r *RoleMapper) extractRoleARNs(pod *v1.Pod) ([]string, error) {
+	roles, _, _, err := r.selectRoleARNs(pod)
+	return roles, err
+}
+
+// selectRoleARNs extracts the fully qualified ARNs for a given pod,
 // taking into consideration the appropriate fallback logic and defaulting
-// logic along with the namespace role restrictions
-func (r *RoleMapper) extractRoleARN(pod *v1.Pod) (string, error) {
+// logic. The annotation holds either a single role or a JSON array of roles.
+// The base ARN is the one of the pod namespace the roles were resolved with, and
+// the outcome reports how the roles were chosen, or why none were.
+func (r *RoleMapper) selectRoleARNs(pod *v1.Pod) (roles []string, baseARN, outcome string, err error) {
 	rawRoleName, annotationPresent := pod.GetAnnotations()[r.iamRoleKey]
 
-	if !annotationPresent && r.defaultRoleARN == "" {
-		return "", fmt.Errorf("unable to find role for IP %s", pod.Status.PodIP)
+	if annotationPresent && r.optOutValue != "" && strings.TrimSpace(rawRoleName) == r.optOutValue {
+		return nil, "", outcomeOptOut, fmt.Errorf("%w for IP %s", ErrRoleOptOut, pod.Status.PodIP)
+	}
+
+	baseARN, err = r.namespaceBaseARN(pod.GetNamespace())
+	if err != nil {
+		return nil, "", outcomeNoRole, err
+	}
+
+	if annotationPresent {
+		rawRoleNames, err := parseRoleAnnotation(rawRoleName)
+		if err != nil {
+			return nil, "", outcomeNoRole, fmt.Errorf("invalid role annotation for IP %s: %s", pod.Status.PodIP, err)
+		}
+		roles = make([]string, 0, len(rawRoleNames))
+		for _, name := range rawRoleNames {
+			roles = append(roles, r.iam.RoleARNWithBase(baseARN, r.resolveAlias(name, pod)))
+		}
+		return roles, baseARN, outcomeAnnotation, nil
+	}
+
+	if r.roleTemplate != nil {
+		role, err := renderRoleTemplate(r.roleTemplate, pod)
+		if err == nil {
+			log.Debugf("Using templated role %s for IP %s", role, pod.Status.PodIP)
+			return []string{r.iam.RoleARNWithBase(baseARN, role)}, baseARN, outcomeTemplate, nil
+		}
+		log.Debugf("Unable to render role template for IP %s: %s", pod.Status.PodIP, err)
+	}
+
+	if r.defaultRoleARN == "" {
+		return nil, "", outcomeNoRole, fmt.Errorf("%w for IP %s", ErrNoRole, pod.Status.PodIP)
+	}
+
+	if r.isStrictNamespace(pod.GetNamespace()) {
+		return nil, "", outcomeStrictNamespace, fmt.Errorf("%w %s for IP %s", ErrStrictNamespace, pod.GetNamespace(), pod.Status.PodIP)
+	}
+
+	log.Warnf("Using fallback role for IP %s", pod.Status.PodIP)
+	return []string{r.iam.RoleARN(r.defaultRoleARN)}, baseARN, outcomeDefaultRole, nil
+}
+
+// isStrictNamespace checks the namespace labels against the strict namespace selector.
+// Namespaces that can't be found are considered strict.
+func (r *RoleMapper) isStrictNamespace(namespace string) bool {
+	if r.strictNamespaces == nil {
+		return false
+	}
+	ns, err := r.store.NamespaceByName(namespace)
+	if errors.Is(err, kube2iam.ErrNamespaceNotWatched) {
+		// Namespaces aren't watched at all, they are handled as namespaces without labels
+		return r.strictNamespaces.Matches(labels.Set{})
+	}
+	if err != nil {
+		log.Debugf("Unable to find an indexed namespace of %s", namespace)
+		return true
 	}
+	return r.strictNamespaces.Matches(labels.Set(ns.GetLabels()))
+}
 
-	if !annotationPresent {
-		log.Warnf("Using fallback role for IP %s", pod.Status.PodIP)
-		rawRoleName = r.defaultRoleARN
+// resolveAlias returns the role of an alias, or the name itself when it isn't an alias.
+func (r *RoleMapper) resolveAlias(name string, pod *v1.Pod) string {
+	if r.aliases == nil {
+		return name
 	}
+	if role, ok := r.aliases.Resolve(name, pod.GetNamespace()); ok {
+		log.Debugf("Resolved role alias %s to %s for IP %s", name, role, pod.Status.PodIP)
+		return role
+	}
+	return name
+}
 
-	return r.iam.RoleARN(rawRoleName), nil
+// parseRoleAnnotation splits a role annotation into its roles, the first role being the primary role.
+func parseRoleAnnotation(value string) ([]string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(value), "[") {
+		return []string{value}, nil
+	}
+	var roles []string
+	if err := json.Unmarshal([]byte(value), &roles); err != nil {
+		return nil, err
+	}
+	if len(roles) == 0 {
+		return nil, fmt.Errorf("empty list of roles")
+	}
+	for _, role := range roles {
+		if role == "" {
+			return nil, fmt.Errorf("empty role in list of roles")
+		}
+	}
+	return roles, nil
 }
 
 // checkRoleForNamespace checks the 'database' for a role allowed in a namespace,
-// returns true if the role is found, otheriwse false
+// returns true if the role is found, otheriwse false.
+// In audit mode a role that is not found is logged and counted but still allowed.
 func (r *RoleMapper) checkRoleForNamespace(roleArn string, namespace string) bool {
-	if !r.namespaceRestriction || roleArn == r.defaultRoleARN {
+	if !r.namespaceRestriction && !r.namespaceRestrictionAudit {
+		return true
+	}
+
+	if r.roleAllowedInNamespace(roleArn, namespace) {
+		return true
+	}
+
+	if r.namespaceRestrictionAudit {
+		log.Warnf("Role: %s on namespace: %s not found, allowing in audit mode.", roleArn, namespace)
+		metrics.NamespaceRestrictionAuditDenials.WithLabelValues(namespace, roleArn).Inc()
+		return true
+	}
+	log.Warnf("Role: %s on namespace: %s not found.", roleArn, namespace)
+	return false
+}
+
+// roleAllowedInNamespace matches a role against the active grants of the allowed roles annotation of a namespace.
+func (r *RoleMapper) roleAllowedInNamespace(roleArn string, namespace string) bool {
+	if roleArn == r.defaultRoleARN {
 		return true
 	}
 
@@ -104,47 +426,165 @@ func (r *RoleMapper) checkRoleForNamespace(roleArn string, namespace string) boo
 		return false
 	}
 
-	ar := kube2iam.GetNamespaceRoleAnnotation(ns, r.namespaceKey)
-	for _, rolePattern := range ar {
-		normalized := r.iam.RoleARN(rolePattern)
+	baseARN, err := r.namespaceBaseARN(namespace)
+	if err != nil {
+		return false
+	}
+
+	now := r.now()
+	for _, grant := range kube2iam.GetNamespaceRoleGrants(ns, r.namespaceKey) {
+		normalized := r.iam.RoleARNWithBase(baseARN, grant.Role)
+		if !r.matchRolePattern(normalized, roleArn) {
+			continue
+		}
+		if !grant.ActiveAt(now) {
+			log.Warnf("Role: %s matched %s on namespace:%s but the grant is not active (not before: %v, expires: %v).", roleArn, grant.Role, namespace, grant.NotBefore, grant.Expires)
+			continue
+		}
+		log.Debugf("Role: %s matched %s on namespace:%s.", roleArn, grant.Role, namespace)
+		return true
+	}
+	return false
+}
 
-		if strings.ToLower(r.namespaceRestrictionFormat) == "regexp" {
-			matched, err := regexp.MatchString(normalized, roleArn)
-			if err != nil {
-				log.Errorf("Namespace annotation %s caused an error when trying to match: %s for namespace: %s", rolePattern, roleArn, namespace)
-			}
-			if matched {
-				log.Debugf("Role: %s matched %s on namespace:%s.", roleArn, rolePattern, namespace)
-				return true
-			}
-		} else {
-			if glob.Glob(normalized, roleArn) {
-				log.Debugf("Role: %s matched %s on namespace:%s.", roleArn, rolePattern, namespace)
-				return true
+// matchRolePattern matches a role against a normalized glob or regexp pattern.
+func (r *RoleMapper) matchRolePattern(pattern string, roleArn string) bool {
+	if strings.ToLower(r.namespaceRestrictionFormat) == "regexp" {
+		matched, err := regexp.MatchString(pattern, roleArn)
+		if err != nil {
+			log.Errorf("Namespace annotation %s caused an error when trying to match: %s", pattern, roleArn)
+		}
+		return matched
+	}
+	return glob.Glob(pattern, roleArn)
+}
+
+// namespaceBaseARN returns the base ARN of roles in a namespace, read from the namespace
+// annotation when set and the cluster base ARN otherwise. It fails when the namespace can't be
+// looked up, so that role names of a tenant aren't resolved in the cluster account, unless
+// namespaces aren't watched.
+func (r *RoleMapper) namespaceBaseARN(namespace string) (string, error) {
+	if r.namespaceBaseARNKey == "" {
+		return r.iam.BaseARN, nil
+	}
+	ns, err := r.store.NamespaceByName(namespace)
+	if errors.Is(err, kube2iam.ErrNamespaceNotWatched) {
+		return r.iam.BaseARN, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to look up the base ARN of namespace %s: %w", namespace, err)
+	}
+	return r.baseARNOf(ns)
+}
+
+// baseARNOf returns the base ARN of roles in the namespace, read from its annotation when set and
+// the cluster base ARN otherwise.
+func (r *RoleMapper) baseARNOf(ns *v1.Namespace) (string, error) {
+	baseARN := ns.GetAnnotations()[r.namespaceBaseARNKey]
+	if r.namespaceBaseARNKey == "" || baseARN == "" {
+		return r.iam.BaseARN, nil
+	}
+
+	if !iam.IsValidBaseARN(baseARN) {
+		return "", fmt.Errorf("invalid base ARN %s for namespace %s, expected: %s", baseARN, ns.GetName(), iam.ARNRegexp.String())
+	}
+	if !r.accountAllowed(baseARN) {
+		return "", fmt.Errorf("base ARN %s for namespace %s is in an account that is not allowed", baseARN, ns.GetName())
+	}
+	if !strings.HasSuffix(baseARN, "/") {
+		baseARN += "/"
+	}
+	return baseARN, nil
+}
+
+// accountAllowed checks the account of an ARN against the allowed accounts, if any.
+func (r *RoleMapper) accountAllowed(arn string) bool {
+	if r.allowedAccounts == nil {
+		return true
+	}
+	accountID, ok := iam.AccountID(arn)
+	return ok && r.allowedAccounts[accountID]
+}
+
+// RejectedRole describes a pod whose role is refused by namespace restrictions.
+type RejectedRole struct {
+	IP        string `json:"ip"`
+	Pod       string `json:"pod"`
+	Namespace string `json:"namespace"`
+	Role      string `json:"role"`
+}
+
+// namespaceRestrictionRejections lists every indexed pod whose role is not allowed in its namespace.
+func (r *RoleMapper) namespaceRestrictionRejections() []RejectedRole {
+	rejections := []RejectedRole{}
+	for _, ip := range r.store.ListPodIPs() {
+		pod, err := r.store.PodByIP(ip)
+		if err != nil {
+			continue
+		}
+		roles, err := r.extractRoleARNs(pod)
+		if err != nil {
+			continue
+		}
+		for _, role := range roles {
+			if !r.roleAllowedInNamespace(role, pod.GetNamespace()) {
+				rejections = append(rejections, RejectedRole{IP: ip, Pod: pod.GetName(), Namespace: pod.GetNamespace(), Role: role})
 			}
 		}
+	}
+	return rejections
+}
 
+// checkRoleForPolicy evaluates the policy, if any, for the role requested by a pod.
+func (r *RoleMapper) checkRoleForPolicy(roleArn string, pod *v1.Pod) policy.Decision {
+	if r.policy == nil {
+		return policy.Decision{Allowed: true}
 	}
-	log.Warnf("Role: %s on namespace: %s not found.", roleArn, namespace)
-	return false
+
+	input := policy.Input{Pod: pod, Role: roleArn}
+	if ns, err := r.store.NamespaceByName(pod.GetNamespace()); err == nil {
+		input.Namespace = ns
+	}
+	if node, err := r.store.NodeByName(pod.Spec.NodeName); err == nil {
+		input.Node = node
+	} else {
+		log.Debugf("Unable to find an indexed node of %s: %s", pod.Spec.NodeName, err)
+	}
+
+	decision := r.policy.Evaluate(input)
+	result := "allow"
+	if !decision.Allowed {
+		result = "deny"
+		log.Warnf("Role: %s on namespace: %s denied by policy rule %q.", roleArn, pod.GetNamespace(), decision.Rule)
+	} else {
+		log.Debugf("Role: %s on namespace: %s allowed by policy rule %q.", roleArn, pod.GetNamespace(), decision.Rule)
+	}
+	metrics.PolicyDecisionCount.WithLabelValues(decision.Rule, result).Inc()
+	return decision
 }
 
 // DumpDebugInfo outputs all the roles by IP address.
 func (r *RoleMapper) DumpDebugInfo() map[string]interface{} {
 	output := make(map[string]interface{})
 	rolesByIP := make(map[string]string)
+	allRolesByIP := make(map[string][]string)
 	namespacesByIP := make(map[string]string)
 	rolesByNamespace := make(map[string][]string)
+	ipsByPod := make(map[string][]string)
 
 	for _, ip := range r.store.ListPodIPs() {
 		// When pods have `hostNetwork: true` they share an IP and we receive an error
 		if pod, err := r.store.PodByIP(ip); err == nil {
 			namespacesByIP[ip] = pod.Namespace
+			ipsByPod[pod.GetNamespace()+"/"+pod.GetName()] = kube2iam.PodIPs(pod)
 			if role, ok := pod.GetAnnotations()[r.iamRoleKey]; ok {
 				rolesByIP[ip] = role
 			} else {
 				rolesByIP[ip] = ""
 			}
+			if roles, err := r.extractRoleARNs(pod); err == nil {
+				allRolesByIP[ip] = roles
+			}
 		}
 	}
 
@@ -155,21 +595,35 @@ func (r *RoleMapper) DumpDebugInfo() map[string]interface{} {
 	}
 
 	output["rolesByIP"] = rolesByIP
+	output["allRolesByIP"] = allRolesByIP
 	output["namespaceByIP"] = namespacesByIP
+	output["ipsByPod"] = ipsByPod
 	output["rolesByNamespace"] = rolesByNamespace
+	if r.aliases != nil {
+		output["roleAliases"] = r.aliases.Aliases()
+	}
+	if r.namespaceRestriction || r.namespaceRestrictionAudit {
+		output["namespaceRestrictionRejections"] = r.namespaceRestrictionRejections()
+	}
 	return output
 }
 
 // NewRoleMapper returns a new RoleMapper for use.
-func NewRoleMapper(roleKey string, externalIDKey string, defaultRole string, namespaceRestriction bool, namespaceKey string, iamInstance *iam.Client, kubeStore store, namespaceRestrictionFormat string) *RoleMapper {
-	return &RoleMapper{
+func NewRoleMapper(roleKey string, externalIDKey string, defaultRole string, namespaceRestriction bool, namespaceKey string, iamInstance *iam.Client, kubeStore Store, namespaceRestrictionFormat string, opts ...Option) *RoleMapper {
+	r := &RoleMapper{
 		defaultRoleARN:             iamInstance.RoleARN(defaultRole),
 		iamRoleKey:                 roleKey,
 		iamExternalIDKey:           externalIDKey,
 		namespaceKey:               namespaceKey,
 		namespaceRestriction:       namespaceRestriction,
 		iam:                        iamInstance,
+		credentials:                iamInstance,
 		store:                      kubeStore,
 		namespaceRestrictionFormat: namespaceRestrictionFormat,
+		now:                        time.Now,
+	}
+	for _, opt := range opts {
+		opt(r)
 	}
+	return r
 }
@@ -1,11 +1,16 @@
 package mappings
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/jtblin/kube2iam"
 	"github.com/jtblin/kube2iam/iam"
+	"github.com/jtblin/kube2iam/policy"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 const (
@@ -75,23 +80,142 @@ func TestExtractRoleARN(t *testing.T) {
 			pod := &v1.Pod{}
 			pod.Annotations = tt.annotations
 
-			resp, err := rp.extractRoleARN(pod)
-			if tt.expectError && err == nil {
-				t.Error("Expected error however didn't receive one")
+			resp, err := rp.extractRoleARNs(pod)
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error however didn't receive one")
+				}
 				return
 			}
-			if !tt.expectError && err != nil {
+			if err != nil {
 				t.Errorf("Didn't expect error but received %s", err)
 				return
 			}
-			if resp != tt.expectedARN {
-				t.Errorf("Response [%s] did not equal expected [%s]", resp, tt.expectedARN)
+			if len(resp) != 1 || resp[0] != tt.expectedARN {
+				t.Errorf("Response %v did not equal expected [%s]", resp, tt.expectedARN)
 				return
 			}
 		})
 	}
 }
 
+func TestExtractRoleARNTemplate(t *testing.T) {
+	var templateTests = []struct {
+		test            string
+		template        string
+		annotations     map[string]string
+		labels          map[string]string
+		defaultRole     string
+		expectedARN     string
+		expectedOutcome string
+		expectError     bool
+	}{
+		{
+			test:            "Template from namespace and service account",
+			template:        "{{.Namespace}}-{{.ServiceAccount}}",
+			expectedARN:     defaultBaseRole + "payments-billing",
+			expectedOutcome: outcomeTemplate,
+		},
+		{
+			test:            "Template from label",
+			template:        "{{.Namespace}}/{{.Labels.app}}",
+			labels:          map[string]string{"app": "api"},
+			expectedARN:     defaultBaseRole + "payments/api",
+			expectedOutcome: outcomeTemplate,
+		},
+		{
+			test:            "Annotation takes precedence",
+			template:        "{{.Namespace}}-{{.ServiceAccount}}",
+			annotations:     map[string]string{roleKey: "explicit-role"},
+			expectedARN:     defaultBaseRole + "explicit-role",
+			expectedOutcome: outcomeAnnotation,
+		},
+		{
+			test:            "Missing label falls back to default",
+			template:        "{{.Labels.app}}",
+			defaultRole:     "default-role",
+			expectedARN:     defaultBaseRole + "default-role",
+			expectedOutcome: outcomeDefaultRole,
+		},
+		{
+			test:        "Missing label without default",
+			template:    "{{.Labels.app}}",
+			expectError: true,
+		},
+		{
+			test:            "Empty render falls back to default",
+			template:        "{{if .Labels}}{{end}}",
+			defaultRole:     "default-role",
+			expectedARN:     defaultBaseRole + "default-role",
+			expectedOutcome: outcomeDefaultRole,
+		},
+	}
+	for _, tt := range templateTests {
+		t.Run(tt.test, func(t *testing.T) {
+			tmpl, err := ParseRoleTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("unexpected error parsing template: %v", err)
+			}
+			rp := RoleMapper{iamRoleKey: roleKey, defaultRoleARN: tt.defaultRole, roleTemplate: tmpl}
+			rp.iam = &iam.Client{BaseARN: defaultBaseRole}
+
+			pod := &v1.Pod{}
+			pod.Namespace = "payments"
+			pod.Spec.ServiceAccountName = "billing"
+			pod.Annotations = tt.annotations
+			pod.Labels = tt.labels
+
+			resp, _, outcome, err := rp.selectRoleARNs(pod)
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error however didn't receive one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Didn't expect error but received %s", err)
+			}
+			if len(resp) != 1 || resp[0] != tt.expectedARN {
+				t.Errorf("Response %v did not equal expected [%s]", resp, tt.expectedARN)
+			}
+			if outcome != tt.expectedOutcome {
+				t.Errorf("expected outcome %q, got %q", tt.expectedOutcome, outcome)
+			}
+		})
+	}
+}
+
+func TestGetRoleMappingTemplateNamespaceRestriction(t *testing.T) {
+	tmpl, err := ParseRoleTemplate("{{.Namespace}}-{{.ServiceAccount}}")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	allowed := &v1.Pod{}
+	allowed.Namespace = "default"
+	allowed.Spec.ServiceAccountName = "reader"
+	denied := allowed.DeepCopy()
+	denied.Spec.ServiceAccountName = "admin"
+
+	store := &storeMock{
+		pods:        map[string]*v1.Pod{"10.0.0.8": allowed, "10.0.0.9": denied},
+		namespace:   "default",
+		annotations: map[string]string{namespaceKey: `["default-reader"]`},
+	}
+	rp := NewRoleMapper(roleKey, externalIDKey, "", true, namespaceKey, &iam.Client{BaseARN: defaultBaseRole}, store, "glob", WithRoleTemplate(tmpl))
+
+	result, err := rp.GetRoleMapping("10.0.0.8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Role != defaultBaseRole+"default-reader" {
+		t.Errorf("expected templated role, got %q", result.Role)
+	}
+	if _, err := rp.GetRoleMapping("10.0.0.9"); err == nil {
+		t.Error("expected templated role outside of the allowed roles to be rejected")
+	}
+}
+
 func TestCheckRoleForNamespace(t *testing.T) {
 	var roleCheckTests = []struct {
 		test                       string
@@ -389,6 +513,9 @@ type storeMock struct {
 	podErr error
 	nsList []string
 	nsMap  map[string]*v1.Namespace
+	nodes  map[string]*v1.Node
+	// Namespaces outside the namespace selector
+	unwatched map[string]bool
 }
 
 func (k *storeMock) ListPodIPs() []string {
@@ -415,6 +542,15 @@ func (k *storeMock) PodByIP(ip string) (*v1.Pod, error) {
 	return nil, nil
 }
 
+func (k *storeMock) PodByUID(uid string) (*v1.Pod, error) {
+	for _, pod := range k.pods {
+		if string(pod.UID) == uid {
+			return pod, nil
+		}
+	}
+	return nil, fmt.Errorf("pod with specified UID not found")
+}
+
 func (k *storeMock) ListNamespaces() []string {
 	if k.nsList != nil {
 		return k.nsList
@@ -423,6 +559,9 @@ func (k *storeMock) ListNamespaces() []string {
 }
 
 func (k *storeMock) NamespaceByName(ns string) (*v1.Namespace, error) {
+	if k.unwatched[ns] {
+		return nil, fmt.Errorf("namespaces are not watched: %w", kube2iam.ErrNamespaceNotWatched)
+	}
 	if k.nsMap != nil {
 		if n, ok := k.nsMap[ns]; ok {
 			return n, nil
@@ -438,6 +577,13 @@ func (k *storeMock) NamespaceByName(ns string) (*v1.Namespace, error) {
 	return nil, fmt.Errorf("namespace isn't present")
 }
 
+func (k *storeMock) NodeByName(name string) (*v1.Node, error) {
+	if n, ok := k.nodes[name]; ok {
+		return n, nil
+	}
+	return nil, fmt.Errorf("node isn't present")
+}
+
 // ---- GetRoleMapping tests ---------------------------------------------------
 
 func TestGetRoleMappingNoAnnotationNoDefault(t *testing.T) {
@@ -445,7 +591,7 @@ func TestGetRoleMappingNoAnnotationNoDefault(t *testing.T) {
 	pod.Status.PodIP = "10.0.0.1"
 	store := &storeMock{pods: map[string]*v1.Pod{"10.0.0.1": pod}}
 
-	// No defaultRole, and BaseARN is also empty — so RoleARN("") == "" and extractRoleARN errors.
+	// No defaultRole, and BaseARN is also empty — so RoleARN("") == "" and selectRoleARNs errors.
 	rp := NewRoleMapper(roleKey, externalIDKey, "", false, namespaceKey, &iam.Client{BaseARN: ""}, store, "glob")
 	_, err := rp.GetRoleMapping("10.0.0.1")
 	if err == nil {
@@ -479,6 +625,326 @@ func TestGetRoleMappingPodNotFound(t *testing.T) {
 	}
 }
 
+func TestGetRoleMappingPolicy(t *testing.T) {
+	rolePolicy, err := policy.New(policy.Config{Rules: []policy.Rule{{
+		Name:       "payments-backend",
+		Effect:     policy.Allow,
+		Expression: `namespaceObject.labels["team"] == "payments" && pod.labels["tier"] == "backend"`,
+	}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ns := &v1.Namespace{}
+	ns.Name = "payments"
+	ns.Labels = map[string]string{"team": "payments"}
+
+	backend := &v1.Pod{}
+	backend.Namespace = "payments"
+	backend.Labels = map[string]string{"tier": "backend"}
+	backend.Annotations = map[string]string{roleKey: "payments/reader"}
+
+	frontend := backend.DeepCopy()
+	frontend.Labels = map[string]string{"tier": "frontend"}
+
+	store := &storeMock{
+		pods:  map[string]*v1.Pod{"10.0.0.6": backend, "10.0.0.7": frontend},
+		nsMap: map[string]*v1.Namespace{"payments": ns},
+	}
+	rp := NewRoleMapper(roleKey, externalIDKey, "", false, namespaceKey, &iam.Client{BaseARN: defaultBaseRole}, store, "glob", WithPolicy(rolePolicy))
+
+	result, err := rp.GetRoleMapping("10.0.0.6")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.PolicyRule != "payments-backend" {
+		t.Errorf("expected policy rule 'payments-backend', got %q", result.PolicyRule)
+	}
+
+	_, err = rp.GetRoleMapping("10.0.0.7")
+	if err == nil || !strings.Contains(err.Error(), policy.DefaultRuleName) {
+		t.Errorf("expected denial by the default rule, got %v", err)
+	}
+}
+
+func TestGetRoleMappingNodeConstraint(t *testing.T) {
+	rolePolicy, err := policy.New(policy.Config{
+		DefaultEffect: policy.Allow,
+		NodeConstraints: []policy.NodeConstraint{{
+			Name:         "secure-pool",
+			Role:         defaultBaseRole + "secure/*",
+			NodeSelector: map[string]string{"pool": "secure"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	onSecure := &v1.Pod{}
+	onSecure.Namespace = "default"
+	onSecure.Spec.NodeName = "secure-node"
+	onSecure.Annotations = map[string]string{roleKey: "secure/vault"}
+
+	onGeneral := onSecure.DeepCopy()
+	onGeneral.Spec.NodeName = "general-node"
+
+	secureNode := &v1.Node{}
+	secureNode.Name = "secure-node"
+	secureNode.Labels = map[string]string{"pool": "secure"}
+	generalNode := &v1.Node{}
+	generalNode.Name = "general-node"
+
+	store := &storeMock{
+		pods:  map[string]*v1.Pod{"10.0.0.10": onSecure, "10.0.0.11": onGeneral},
+		nodes: map[string]*v1.Node{"secure-node": secureNode, "general-node": generalNode},
+	}
+	// Namespace restrictions are disabled, the annotation alone would be permitted
+	rp := NewRoleMapper(roleKey, externalIDKey, "", false, namespaceKey, &iam.Client{BaseARN: defaultBaseRole}, store, "glob", WithPolicy(rolePolicy))
+
+	if _, err := rp.GetRoleMapping("10.0.0.10"); err != nil {
+		t.Errorf("expected role to be allowed on the secure node, got %v", err)
+	}
+	if _, err := rp.GetRoleMapping("10.0.0.11"); err == nil || !strings.Contains(err.Error(), "secure-pool") {
+		t.Errorf("expected denial by 'secure-pool' on the general node, got %v", err)
+	}
+}
+
+func TestGetRoleMappingNamespaceBaseARN(t *testing.T) {
+	const (
+		baseARNKey    = "baseARNKey"
+		tenantBaseARN = "arn:aws:iam::999999999999:role/"
+	)
+	tenant := &v1.Namespace{}
+	tenant.Name = "tenant"
+	tenant.Annotations = map[string]string{
+		baseARNKey:   "arn:aws:iam::999999999999:role",
+		namespaceKey: `["app-*"]`,
+	}
+	rogue := &v1.Namespace{}
+	rogue.Name = "rogue"
+	rogue.Annotations = map[string]string{baseARNKey: "arn:aws:iam::666666666666:role/"}
+
+	newPod := func(ns, role string) *v1.Pod {
+		pod := &v1.Pod{}
+		pod.Namespace = ns
+		pod.Annotations = map[string]string{roleKey: role}
+		return pod
+	}
+	store := &storeMock{
+		pods: map[string]*v1.Pod{
+			"10.0.1.1": newPod("tenant", "app-reader"),
+			"10.0.1.2": newPod("tenant", "admin"),
+			"10.0.1.3": newPod("rogue", "app-reader"),
+			"10.0.1.4": newPod("tenant", "arn:aws:iam::666666666666:role/app-reader"),
+		},
+		nsMap: map[string]*v1.Namespace{"tenant": tenant, "rogue": rogue},
+	}
+	rp := NewRoleMapper(roleKey, externalIDKey, "", true, namespaceKey, &iam.Client{BaseARN: defaultBaseRole}, store, "glob",
+		WithNamespaceBaseARN(baseARNKey), WithAllowedAccounts([]string{"123456789012", "999999999999"}))
+
+	result, err := rp.GetRoleMapping("10.0.1.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Role != tenantBaseARN+"app-reader" {
+		t.Errorf("expected role in tenant account, got %q", result.Role)
+	}
+	if result.BaseARN != tenantBaseARN {
+		t.Errorf("expected base ARN %q, got %q", tenantBaseARN, result.BaseARN)
+	}
+
+	for ip, reason := range map[string]string{
+		"10.0.1.2": "role not allowed in namespace",
+		"10.0.1.3": "namespace base ARN in an account that is not allowed",
+		"10.0.1.4": "role in an account that is not allowed",
+	} {
+		if _, err := rp.GetRoleMapping(ip); err == nil {
+			t.Errorf("expected error for %s: %s", ip, reason)
+		}
+	}
+}
+
+func TestGetRoleMappingNamespaceBaseARNLookupError(t *testing.T) {
+	const baseARNKey = "baseARNKey"
+	tenant := &v1.Namespace{}
+	tenant.Name = "tenant"
+	tenant.Annotations = map[string]string{baseARNKey: "arn:aws:iam::999999999999:role/"}
+
+	newPod := func(ns string) *v1.Pod {
+		pod := &v1.Pod{}
+		pod.Namespace = ns
+		pod.Annotations = map[string]string{roleKey: "app-reader"}
+		return pod
+	}
+	store := &storeMock{
+		pods: map[string]*v1.Pod{
+			"10.0.2.1": newPod("tenant"),
+			"10.0.2.2": newPod("evicted-from-cache"),
+			"10.0.2.3": newPod("unwatched"),
+		},
+		nsMap:     map[string]*v1.Namespace{"tenant": tenant},
+		unwatched: map[string]bool{"unwatched": true},
+	}
+	rp := NewRoleMapper(roleKey, externalIDKey, "", false, namespaceKey, &iam.Client{BaseARN: defaultBaseRole}, store, "glob",
+		WithNamespaceBaseARN(baseARNKey))
+
+	tests := []struct {
+		ip           string
+		expectedRole string
+	}{
+		{"10.0.2.1", "arn:aws:iam::999999999999:role/app-reader"},
+		// A namespace missing from the cache must not resolve the role in the cluster account
+		{"10.0.2.2", ""},
+		{"10.0.2.3", defaultBaseRole + "app-reader"},
+	}
+	for _, tt := range tests {
+		result, err := rp.GetRoleMapping(tt.ip)
+		if tt.expectedRole == "" {
+			if err == nil {
+				t.Errorf("%s: expected error when the namespace lookup fails, got role %q", tt.ip, result.Role)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.ip, err)
+			continue
+		}
+		if result.Role != tt.expectedRole {
+			t.Errorf("%s: expected role %q, got %q", tt.ip, tt.expectedRole, result.Role)
+		}
+		if result.BaseARN != strings.TrimSuffix(tt.expectedRole, "app-reader") {
+			t.Errorf("%s: expected the base ARN of role %q, got %q", tt.ip, tt.expectedRole, result.BaseARN)
+		}
+	}
+
+	// Opted out pods are answered without looking up the base ARN of their namespace
+	optedOut := newPod("evicted-from-cache")
+	optedOut.Annotations[roleKey] = "none"
+	store.pods["10.0.2.4"] = optedOut
+	rp = NewRoleMapper(roleKey, externalIDKey, "", false, namespaceKey, &iam.Client{BaseARN: defaultBaseRole}, store, "glob",
+		WithNamespaceBaseARN(baseARNKey), WithOptOutValue("none"))
+	if _, err := rp.GetRoleMapping("10.0.2.4"); !errors.Is(err, ErrRoleOptOut) {
+		t.Errorf("expected ErrRoleOptOut for an opted out pod, got %v", err)
+	}
+}
+
+func TestGetRoleMappingMultipleRoles(t *testing.T) {
+	newPod := func(annotation string) *v1.Pod {
+		pod := &v1.Pod{}
+		pod.Namespace = "default"
+		pod.Annotations = map[string]string{roleKey: annotation}
+		return pod
+	}
+	store := &storeMock{
+		pods: map[string]*v1.Pod{
+			"10.0.3.1": newPod(`["reader", "arn:aws:iam::999999999999:role/writer", "admin"]`),
+			"10.0.3.2": newPod(`["admin", "reader"]`),
+			"10.0.3.3": newPod(`["reader", `),
+			"10.0.3.4": newPod(`[]`),
+		},
+		namespace:   "default",
+		annotations: map[string]string{namespaceKey: `["reader", "arn:aws:iam::999999999999:role/*"]`},
+	}
+	rp := NewRoleMapper(roleKey, externalIDKey, "", true, namespaceKey, &iam.Client{BaseARN: defaultBaseRole}, store, "glob")
+
+	result, err := rp.GetRoleMapping("10.0.3.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Role != defaultBaseRole+"reader" {
+		t.Errorf("expected primary role reader, got %q", result.Role)
+	}
+	expected := []string{defaultBaseRole + "reader", "arn:aws:iam::999999999999:role/writer"}
+	if strings.Join(result.Roles, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected roles %v without the role not allowed in the namespace, got %v", expected, result.Roles)
+	}
+	if !result.Permits("arn:aws:iam::999999999999:role/writer") || result.Permits(defaultBaseRole+"admin") {
+		t.Errorf("unexpected permitted roles %v", result.Roles)
+	}
+
+	for ip, reason := range map[string]string{
+		"10.0.3.2": "primary role not allowed in namespace",
+		"10.0.3.3": "invalid list of roles",
+		"10.0.3.4": "empty list of roles",
+	} {
+		if _, err := rp.GetRoleMapping(ip); err == nil {
+			t.Errorf("expected error for %s: %s", ip, reason)
+		}
+	}
+}
+
+func TestGetRoleMappingOptOutAndStrictNamespaces(t *testing.T) {
+	newPod := func(ns string, annotations map[string]string) *v1.Pod {
+		pod := &v1.Pod{}
+		pod.Namespace = ns
+		pod.Annotations = annotations
+		return pod
+	}
+	strict := &v1.Namespace{}
+	strict.Name = "strict"
+	strict.Labels = map[string]string{"kube2iam.io/strict": "true"}
+	relaxed := &v1.Namespace{}
+	relaxed.Name = "relaxed"
+
+	store := &storeMock{
+		pods: map[string]*v1.Pod{
+			"10.0.4.1": newPod("relaxed", map[string]string{roleKey: "none"}),
+			"10.0.4.2": newPod("strict", nil),
+			"10.0.4.3": newPod("relaxed", nil),
+			"10.0.4.4": newPod("strict", map[string]string{roleKey: "explicit-role"}),
+			"10.0.4.5": newPod("unknown", nil),
+			"10.0.4.6": newPod("unselected", nil),
+		},
+		nsMap:     map[string]*v1.Namespace{"strict": strict, "relaxed": relaxed},
+		unwatched: map[string]bool{"unselected": true},
+	}
+	selector, err := labels.Parse("kube2iam.io/strict=true")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rp := NewRoleMapper(roleKey, externalIDKey, "default-role", false, namespaceKey, &iam.Client{BaseARN: defaultBaseRole}, store, "glob",
+		WithOptOutValue("none"), WithStrictNamespaces(selector))
+
+	tests := []struct {
+		ip          string
+		expectedErr error
+		expectedARN string
+	}{
+		{ip: "10.0.4.1", expectedErr: ErrRoleOptOut},
+		{ip: "10.0.4.2", expectedErr: ErrStrictNamespace},
+		{ip: "10.0.4.3", expectedARN: defaultBaseRole + "default-role"},
+		{ip: "10.0.4.4", expectedARN: defaultBaseRole + "explicit-role"},
+		{ip: "10.0.4.5", expectedErr: ErrStrictNamespace},
+		{ip: "10.0.4.6", expectedARN: defaultBaseRole + "default-role"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			result, err := rp.GetRoleMapping(tt.ip)
+			if tt.expectedErr != nil {
+				if !errors.Is(err, tt.expectedErr) {
+					t.Errorf("expected %v, got %v", tt.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Role != tt.expectedARN {
+				t.Errorf("expected role %q, got %q", tt.expectedARN, result.Role)
+			}
+		})
+	}
+}
+
+func TestGetRoleMappingNoRole(t *testing.T) {
+	pod := &v1.Pod{}
+	store := &storeMock{pods: map[string]*v1.Pod{"10.0.4.6": pod}}
+	rp := NewRoleMapper(roleKey, externalIDKey, "", false, namespaceKey, &iam.Client{BaseARN: ""}, store, "glob")
+	if _, err := rp.GetRoleMapping("10.0.4.6"); !errors.Is(err, ErrNoRole) {
+		t.Errorf("expected ErrNoRole, got %v", err)
+	}
+}
+
 // ---- GetExternalIDMapping tests ---------------------------------------------
 
 func TestGetExternalIDMappingWithAnnotation(t *testing.T) {
@@ -517,7 +983,9 @@ func TestGetExternalIDMappingWithoutAnnotation(t *testing.T) {
 
 func TestDumpDebugInfo(t *testing.T) {
 	pod := &v1.Pod{}
+	pod.Name = "debug"
 	pod.Status.PodIP = "10.0.0.5"
+	pod.Status.PodIPs = []v1.PodIP{{IP: "10.0.0.5"}, {IP: "fd00::5"}}
 	pod.Annotations = map[string]string{roleKey: "debug-role"}
 	pod.Namespace = "default"
 
@@ -548,4 +1016,53 @@ func TestDumpDebugInfo(t *testing.T) {
 	if rolesByIP["10.0.0.5"] != "debug-role" {
 		t.Errorf("expected role 'debug-role' for IP 10.0.0.5, got %q", rolesByIP["10.0.0.5"])
 	}
+	allRolesByIP := result["allRolesByIP"].(map[string][]string)
+	if roles := allRolesByIP["10.0.0.5"]; len(roles) != 1 || roles[0] != defaultBaseRole+"debug-role" {
+		t.Errorf("expected all roles [%sdebug-role] for IP 10.0.0.5, got %v", defaultBaseRole, roles)
+	}
+	ipsByPod := result["ipsByPod"].(map[string][]string)
+	if ips := ipsByPod["default/debug"]; len(ips) != 2 || ips[1] != "fd00::5" {
+		t.Errorf("expected IPs [10.0.0.5 fd00::5] for pod default/debug, got %v", ips)
+	}
+}
+
+func TestNamespaceRestrictionAudit(t *testing.T) {
+	allowed := &v1.Pod{}
+	allowed.Name = "allowed"
+	allowed.Namespace = "default"
+	allowed.Annotations = map[string]string{roleKey: "explicit-role"}
+
+	rejected := &v1.Pod{}
+	rejected.Name = "rejected"
+	rejected.Namespace = "default"
+	rejected.Annotations = map[string]string{roleKey: "other-role"}
+
+	ns := &v1.Namespace{}
+	ns.Name = "default"
+	ns.Annotations = map[string]string{namespaceKey: `["explicit-role"]`}
+
+	store := &storeMock{
+		pods:  map[string]*v1.Pod{"10.0.0.8": allowed, "10.0.0.9": rejected},
+		nsMap: map[string]*v1.Namespace{"default": ns},
+	}
+	rp := NewRoleMapper(roleKey, externalIDKey, "", false, namespaceKey, &iam.Client{BaseARN: defaultBaseRole}, store, "glob",
+		WithNamespaceRestrictionAudit(true))
+
+	if _, err := rp.GetRoleMapping("10.0.0.9"); err != nil {
+		t.Errorf("expected audit mode to serve the rejected role, got %v", err)
+	}
+
+	rejections, ok := rp.DumpDebugInfo()["namespaceRestrictionRejections"].([]RejectedRole)
+	if !ok {
+		t.Fatal("expected 'namespaceRestrictionRejections' in DumpDebugInfo output")
+	}
+	expected := RejectedRole{IP: "10.0.0.9", Pod: "rejected", Namespace: "default", Role: defaultBaseRole + "other-role"}
+	if len(rejections) != 1 || rejections[0] != expected {
+		t.Errorf("expected rejections [%+v], got %+v", expected, rejections)
+	}
+
+	enforced := NewRoleMapper(roleKey, externalIDKey, "", true, namespaceKey, &iam.Client{BaseARN: defaultBaseRole}, store, "glob")
+	if _, err := enforced.GetRoleMapping("10.0.0.9"); err == nil {
+		t.Error("expected enforced namespace restrictions to reject the role")
+	}
 }
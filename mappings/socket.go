@@ -0,0 +1,57 @@
+package mappings
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jtblin/kube2iam/procfs"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// PodUIDResolver attributes a connection to the UID of the pod owning the connecting socket. It returns an
+// error wrapping procfs.ErrUnavailable when the sockets can't be read at all.
+type PodUIDResolver interface {
+	PodUID(ip string, port int) (string, error)
+}
+
+// WithSocketAttribution identifies the pods connecting from the node IP, i.e. hostNetwork pods,
+// by the owner of the connecting socket instead of the source IP shared by all of them.
+func WithSocketAttribution(resolver PodUIDResolver, nodeIP string) Option {
+	return func(r *RoleMapper) {
+		r.socketResolver = resolver
+		r.nodeIP = nodeIP
+	}
+}
+
+// podForConnection returns the pod a connection comes from. A connection from the node IP not attributed
+// to a hostNetwork pod is refused rather than served the role of the pod indexed under the node IP,
+// unless the sockets can't be read at all.
+func (r *RoleMapper) podForConnection(IP string, port int) (*v1.Pod, error) {
+	if r.socketResolver != nil && port != 0 && IP == r.nodeIP {
+		pod, err := r.podBySocket(IP, port)
+		if err == nil {
+			return pod, nil
+		}
+		if !errors.Is(err, procfs.ErrUnavailable) {
+			return nil, fmt.Errorf("unable to attribute connection from %s:%d to a hostNetwork pod: %w", IP, port, err)
+		}
+		log.Debugf("Unable to attribute connection from %s:%d to a hostNetwork pod, falling back to its IP: %s", IP, port, err)
+	}
+	return r.store.PodByIP(IP)
+}
+
+func (r *RoleMapper) podBySocket(IP string, port int) (*v1.Pod, error) {
+	uid, err := r.socketResolver.PodUID(IP, port)
+	if err != nil {
+		return nil, err
+	}
+	pod, err := r.store.PodByUID(uid)
+	if err != nil {
+		return nil, err
+	}
+	if !pod.Spec.HostNetwork {
+		return nil, fmt.Errorf("pod %s/%s owning the connection is not a hostNetwork pod", pod.GetNamespace(), pod.GetName())
+	}
+	return pod, nil
+}
@@ -0,0 +1,92 @@
+package mappings
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/jtblin/kube2iam/iam"
+	"github.com/jtblin/kube2iam/procfs"
+)
+
+const testNodeIP = "192.168.0.10"
+
+// fakeSocketResolver maps source ports to pod UIDs.
+type fakeSocketResolver map[int]string
+
+func (f fakeSocketResolver) PodUID(_ string, port int) (string, error) {
+	if uid, ok := f[port]; ok {
+		return uid, nil
+	}
+	return "", fmt.Errorf("no socket bound to port %d", port)
+}
+
+func socketTestPod(name, role string, hostNetwork bool) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "kube-system",
+			UID:         types.UID("uid-" + name),
+			Annotations: map[string]string{roleKey: role},
+		},
+		Spec: v1.PodSpec{HostNetwork: hostNetwork},
+	}
+}
+
+// unavailableSocketResolver fails as when procfs isn't mounted.
+type unavailableSocketResolver struct{}
+
+func (unavailableSocketResolver) PodUID(_ string, _ int) (string, error) {
+	return "", fmt.Errorf("%w: no tcp table", procfs.ErrUnavailable)
+}
+
+func TestGetRoleMappingForConnection(t *testing.T) {
+	// The pod indexed under the node IP is the one PodByIP falls back to.
+	store := &storeMock{pods: map[string]*v1.Pod{
+		testNodeIP:  socketTestPod("node-agent", "agent-role", true),
+		"10.0.0.20": socketTestPod("log-shipper", "logs-role", true),
+		"10.0.0.21": socketTestPod("web", "web-role", false),
+	}}
+	resolver := fakeSocketResolver{40001: "uid-log-shipper", 40002: "uid-web", 40003: "uid-unknown"}
+
+	tests := []struct {
+		name          string
+		resolver      PodUIDResolver
+		ip            string
+		port          int
+		expectedRole  string
+		expectedError string
+	}{
+		{"socket owned by hostNetwork pod", resolver, testNodeIP, 40001, "logs-role", ""},
+		{"socket owned by non hostNetwork pod is refused", resolver, testNodeIP, 40002, "", "not a hostNetwork pod"},
+		{"unknown pod UID is refused", resolver, testNodeIP, 40003, "", "pod with specified UID not found"},
+		{"unattributed socket is refused", resolver, testNodeIP, 40004, "", "no socket bound to port 40004"},
+		{"unreadable procfs falls back to IP", unavailableSocketResolver{}, testNodeIP, 40001, "agent-role", ""},
+		{"no port falls back to IP", resolver, testNodeIP, 0, "agent-role", ""},
+		{"other IP is not attributed", resolver, "10.0.0.21", 40001, "web-role", ""},
+		{"attribution disabled", nil, testNodeIP, 40001, "agent-role", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := NewRoleMapper(roleKey, externalIDKey, "", false, namespaceKey, &iam.Client{BaseARN: defaultBaseRole}, store, "glob",
+				WithSocketAttribution(tt.resolver, testNodeIP))
+			result, err := rp.GetRoleMappingForConnection(tt.ip, tt.port)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Fatalf("expected error containing %q, got %v (result %+v)", tt.expectedError, err, result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if expected := defaultBaseRole + tt.expectedRole; result.Role != expected {
+				t.Errorf("expected role %q, got %q", expected, result.Role)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package mappings
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// RoleTemplateData holds the pod metadata available to role templates.
+type RoleTemplateData struct {
+	Namespace      string
+	ServiceAccount string
+	PodName        string
+	Labels         map[string]string
+}
+
+// ParseRoleTemplate parses a text/template used to derive a role name from pod metadata,
+// e.g. "{{.Namespace}}-{{.ServiceAccount}}". Referencing a missing label is an error.
+func ParseRoleTemplate(text string) (*template.Template, error) {
+	return template.New("role").Option("missingkey=error").Parse(text)
+}
+
+// renderRoleTemplate returns the role derived from the template for the given pod.
+func renderRoleTemplate(tmpl *template.Template, pod *v1.Pod) (string, error) {
+	data := RoleTemplateData{
+		Namespace:      pod.GetNamespace(),
+		ServiceAccount: pod.Spec.ServiceAccountName,
+		PodName:        pod.GetName(),
+		Labels:         pod.GetLabels(),
+	}
+	if data.Labels == nil {
+		data.Labels = map[string]string{}
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	role := strings.TrimSpace(buf.String())
+	if role == "" {
+		return "", fmt.Errorf("role template rendered an empty role")
+	}
+	return role, nil
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	log "github.com/sirupsen/logrus"
 
 	"github.com/jtblin/kube2iam/version"
 )
@@ -54,6 +53,20 @@ var (
 		},
 	)
 
+	// IamCacheEvictionCount tracks total number of cached credentials evicted after their role was revoked.
+	IamCacheEvictionCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "iam",
+			Name:      "cache_evictions_total",
+			Help:      "Total number of cached credentials evicted after their role was revoked.",
+		},
+		[]string{
+			// Why the role was revoked: grant_expired, namespace_changed or pod_changed
+			"reason",
+		},
+	)
+
 	// K8sAPIDupReqCount tracks total number of K8s Api requests performed when duplicated pods are identified in the cache.
 	K8sAPIDupReqCount = prometheus.NewCounter(
 		prometheus.CounterOpts{
@@ -84,6 +97,152 @@ var (
 		},
 	)
 
+	// PodLookupCount tracks how pods looked up by IP are resolved.
+	PodLookupCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "iam",
+			Name:      "k8s_pod_lookup_total",
+			Help:      "Total number of pod lookups by IP by the path that resolved them.",
+		},
+		[]string{
+			// The path resolving the pod: cache, wait, api or not_found
+			"path",
+		},
+	)
+
+	// CacheObjects reports the number of objects held by the informer caches.
+	CacheObjects = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "k8s",
+			Name:      "cache_objects",
+			Help:      "Number of objects held by the informer caches.",
+		},
+		[]string{
+			// The resource cached: pods, namespaces, nodes or configmaps
+			"resource",
+		},
+	)
+
+	// InformerLastEvent reports when the watch of an informer last delivered an event.
+	InformerLastEvent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "k8s",
+			Name:      "informer_last_event_timestamp_seconds",
+			Help:      "Unix time of the last event delivered by the watch of an informer.",
+		},
+		[]string{
+			// The resource watched: pods, namespaces, nodes or configmaps
+			"resource",
+		},
+	)
+
+	// InformerLastResync reports when an informer last listed its resource or resynced its handlers.
+	InformerLastResync = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "k8s",
+			Name:      "informer_last_resync_timestamp_seconds",
+			Help:      "Unix time of the last list or periodic resync of an informer.",
+		},
+		[]string{
+			// The resource watched: pods, namespaces, nodes or configmaps
+			"resource",
+		},
+	)
+
+	// InformerWatchRestarts tracks the watches restarted after going stale.
+	InformerWatchRestarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "k8s",
+			Name:      "informer_watch_restarts_total",
+			Help:      "Total number of informer watches restarted after going stale.",
+		},
+		[]string{
+			// The resource watched: pods, namespaces, nodes or configmaps
+			"resource",
+		},
+	)
+
+	// NamespaceRestrictionAuditDenials tracks roles that namespace restrictions would deny in audit mode.
+	NamespaceRestrictionAuditDenials = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "namespace_restriction",
+			Name:      "audit_denials_total",
+			Help:      "Total number of requests that namespace restrictions would deny in audit mode.",
+		},
+		[]string{
+			// The namespace of the pod requesting the role
+			"namespace",
+			// The arn of the IAM role being requested
+			"role_arn",
+		},
+	)
+
+	// NamespaceRoleGrantsExpiring reports the number of role grants of each namespace nearing expiry.
+	NamespaceRoleGrantsExpiring = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "namespace_restriction",
+			Name:      "grants_expiring",
+			Help:      "Number of time-bounded role grants expiring within the warning window.",
+		},
+		[]string{
+			// The namespace holding the grants
+			"namespace",
+		},
+	)
+
+	// PolicyDecisionCount tracks total number of policy decisions by rule.
+	PolicyDecisionCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "policy",
+			Name:      "decisions_total",
+			Help:      "Total number of policy decisions by rule.",
+		},
+		[]string{
+			// The name of the rule that decided the request
+			"rule",
+			// The decision, either allow or deny
+			"decision",
+		},
+	)
+
+	// AuthzDecisionCount tracks total number of authorization webhook decisions.
+	AuthzDecisionCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "authz",
+			Name:      "decisions_total",
+			Help:      "Total number of authorization webhook decisions.",
+		},
+		[]string{
+			// The decision, either allow or deny
+			"decision",
+			// Where the decision came from: webhook, cache, fail_open or fail_closed
+			"source",
+		},
+	)
+
+	// RoleMappingOutcomeCount tracks total number of role mappings by outcome.
+	RoleMappingOutcomeCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "role_mapping",
+			Name:      "outcomes_total",
+			Help:      "Total number of role mappings by outcome.",
+		},
+		[]string{
+			// How the role was chosen or why none was: annotation, template, default_role, opt_out, strict_namespace, no_role or refused
+			"outcome",
+		},
+	)
+
 	// HTTPRequestSec tracks timing of served HTTP requests.
 	HTTPRequestSec = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -114,6 +273,20 @@ var (
 		},
 	)
 
+	// PreflightCheckStatus reports the result of the startup preflight checks.
+	PreflightCheckStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "preflight",
+			Name:      "check_status",
+			Help:      "The result of the startup preflight checks. A value of 1 means the check passed, 0 means it failed.",
+		},
+		[]string{
+			// The preflight check: caller_identity, base_role_account or canary_assume_role
+			"check",
+		},
+	)
+
 	// Info reports various static information about the running kube2iam binary.
 	Info = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -135,11 +308,23 @@ var (
 func init() {
 	prometheus.MustRegister(IamRequestSec)
 	prometheus.MustRegister(IamCacheHitCount)
+	prometheus.MustRegister(IamCacheEvictionCount)
 	prometheus.MustRegister(K8sAPIDupReqCount)
 	prometheus.MustRegister(K8sAPIDupReqSuccesCount)
 	prometheus.MustRegister(PodNotFoundInCache)
+	prometheus.MustRegister(PodLookupCount)
+	prometheus.MustRegister(CacheObjects)
+	prometheus.MustRegister(InformerLastEvent)
+	prometheus.MustRegister(InformerLastResync)
+	prometheus.MustRegister(InformerWatchRestarts)
+	prometheus.MustRegister(NamespaceRestrictionAuditDenials)
+	prometheus.MustRegister(NamespaceRoleGrantsExpiring)
+	prometheus.MustRegister(PolicyDecisionCount)
+	prometheus.MustRegister(AuthzDecisionCount)
+	prometheus.MustRegister(RoleMappingOutcomeCount)
 	prometheus.MustRegister(HTTPRequestSec)
 	prometheus.MustRegister(HealthcheckStatus)
+	prometheus.MustRegister(PreflightCheckStatus)
 	prometheus.MustRegister(Info)
 
 	for _, val := range []string{IamSuccessCode, IamUnknownFailCode} {
@@ -148,17 +333,12 @@ func init() {
 	Info.WithLabelValues(version.Version, version.BuildDate, version.GitCommit).Set(1)
 }
 
-// StartMetricsServer registers a prometheus /metrics handler and starts a HTTP server
-// listening on the provided port to service it.
-func StartMetricsServer(metricsPort string) {
+// NewServer returns a HTTP server listening on the provided port and serving the prometheus
+// /metrics handler. The caller starts and shuts the server down.
+func NewServer(metricsPort string) *http.Server {
 	r := mux.NewRouter()
 	r.Handle("/metrics", GetHandler())
-
-	go func() {
-		if err := http.ListenAndServe(":"+metricsPort, r); err != nil {
-			log.Fatalf("Error creating metrics http server: %+v", err)
-		}
-	}()
+	return &http.Server{Addr: ":" + metricsPort, Handler: r}
 }
 
 // GetHandler creates a prometheus HTTP handler that will serve metrics.
@@ -2,15 +2,28 @@ package kube2iam
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
+// ErrNamespaceNotWatched is returned when looking up a namespace while namespaces aren't watched, because
+// no feature reads them.
+var ErrNamespaceNotWatched = errors.New("namespace is not watched")
+
+// NamespaceGrantsRevokedFunc is called with the grants removed from or changed in the allowed roles
+// annotation of a namespace, or all its grants when the namespace is deleted.
+type NamespaceGrantsRevokedFunc func(ns *v1.Namespace, revoked []RoleGrant)
+
 // NamespaceHandler outputs change events from K8.
 type NamespaceHandler struct {
-	namespaceKey string
+	namespaceKey    string
+	onGrantsRevoked NamespaceGrantsRevokedFunc
 }
 
 func (h *NamespaceHandler) namespaceFields(ns *v1.Namespace) log.Fields {
@@ -38,8 +51,9 @@ func (h *NamespaceHandler) OnAdd(obj interface{}, isInInitialList bool) {
 
 // OnUpdate called with a namespace is updated inside k8s.
 func (h *NamespaceHandler) OnUpdate(oldObj, newObj interface{}) {
-	nns, ok := newObj.(*v1.Namespace)
-	if !ok {
+	ons, ok1 := oldObj.(*v1.Namespace)
+	nns, ok2 := newObj.(*v1.Namespace)
+	if !ok1 || !ok2 {
 		log.Errorf("Expected Namespace but OnUpdate handler received %+v %+v", oldObj, newObj)
 		return
 	}
@@ -51,32 +65,136 @@ func (h *NamespaceHandler) OnUpdate(oldObj, newObj interface{}) {
 	for _, role := range roles {
 		logger.WithField("ns.role", role).Info("Discovered role on namespace (OnUpdate)")
 	}
+
+	revoked := revokedGrants(GetNamespaceRoleGrants(ons, h.namespaceKey), GetNamespaceRoleGrants(nns, h.namespaceKey))
+	h.revoke(nns, revoked)
 }
 
 // OnDelete called with a namespace is removed from k8s.
 func (h *NamespaceHandler) OnDelete(obj interface{}) {
 	ns, ok := obj.(*v1.Namespace)
+	if !ok {
+		deletedObj, dok := obj.(cache.DeletedFinalStateUnknown)
+		if dok {
+			ns, ok = deletedObj.Obj.(*v1.Namespace)
+		}
+	}
+
 	if !ok {
 		log.Errorf("Expected Namespace but OnDelete handler received %+v", obj)
 		return
 	}
 	log.WithFields(h.namespaceFields(ns)).Info("Deleting namespace (OnDelete)")
+
+	h.revoke(ns, GetNamespaceRoleGrants(ns, h.namespaceKey))
 }
 
-// GetNamespaceRoleAnnotation reads the "iam.amazonaws.com/allowed-roles" annotation of a namespace
-// and splits them as a JSON list (["role1", "role2", "role3"])
-func GetNamespaceRoleAnnotation(ns *v1.Namespace, namespaceKey string) []string {
+func (h *NamespaceHandler) revoke(ns *v1.Namespace, revoked []RoleGrant) {
+	if len(revoked) == 0 {
+		return
+	}
+	logger := log.WithFields(h.namespaceFields(ns))
+	for _, grant := range revoked {
+		logger.WithField("ns.role", grant.Role).Info("Revoked role on namespace")
+	}
+	if h.onGrantsRevoked != nil {
+		h.onGrantsRevoked(ns, revoked)
+	}
+}
+
+// revokedGrants returns the old grants that are not granted the same way anymore.
+func revokedGrants(oldGrants, newGrants []RoleGrant) []RoleGrant {
+	var revoked []RoleGrant
+	for _, old := range oldGrants {
+		kept := false
+		for _, grant := range newGrants {
+			if old.equal(grant) {
+				kept = true
+				break
+			}
+		}
+		if !kept {
+			revoked = append(revoked, old)
+		}
+	}
+	return revoked
+}
+
+// RoleGrant is an entry of the allowed roles annotation of a namespace. It is either a
+// role pattern or an object with a role pattern and an optional validity period, e.g.
+// {"role": "contractor-*", "notBefore": "2024-01-01T00:00:00Z", "expires": "2024-02-01T00:00:00Z"}.
+type RoleGrant struct {
+	Role      string     `json:"role"`
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+// UnmarshalJSON decodes a grant from either a role pattern or an object.
+func (g *RoleGrant) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*g = RoleGrant{}
+		return json.Unmarshal(data, &g.Role)
+	}
+	type grant RoleGrant
+	var decoded grant
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if decoded.Role == "" {
+		return fmt.Errorf("role grant without a role")
+	}
+	*g = RoleGrant(decoded)
+	return nil
+}
+
+// ActiveAt returns whether the grant is valid at the given time.
+func (g RoleGrant) ActiveAt(t time.Time) bool {
+	if g.NotBefore != nil && t.Before(*g.NotBefore) {
+		return false
+	}
+	return g.Expires == nil || t.Before(*g.Expires)
+}
+
+func (g RoleGrant) equal(o RoleGrant) bool {
+	return g.Role == o.Role && timeEqual(g.NotBefore, o.NotBefore) && timeEqual(g.Expires, o.Expires)
+}
+
+func timeEqual(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// GetNamespaceRoleGrants reads the "iam.amazonaws.com/allowed-roles" annotation of a namespace
+// and decodes it as a JSON list of role patterns or grants (["role1", {"role": "role2", "expires": "..."}])
+func GetNamespaceRoleGrants(ns *v1.Namespace, namespaceKey string) []RoleGrant {
 	rolesString := ns.GetAnnotations()[namespaceKey]
 	if rolesString != "" {
-		var decoded []string
+		var decoded []RoleGrant
 		if err := json.Unmarshal([]byte(rolesString), &decoded); err != nil {
 			log.Errorf("Unable to decode roles on namespace %s ( role annotation is '%s' ) with error: %s", ns.Name, rolesString, err)
+			return nil
 		}
 		return decoded
 	}
 	return nil
 }
 
+// GetNamespaceRoleAnnotation reads the "iam.amazonaws.com/allowed-roles" annotation of a namespace
+// and returns the role patterns of its grants, including grants that are not active.
+func GetNamespaceRoleAnnotation(ns *v1.Namespace, namespaceKey string) []string {
+	grants := GetNamespaceRoleGrants(ns, namespaceKey)
+	if grants == nil {
+		return nil
+	}
+	roles := make([]string, 0, len(grants))
+	for _, grant := range grants {
+		roles = append(roles, grant.Role)
+	}
+	return roles
+}
+
 // NamespaceIndexFunc maps a namespace to it's name.
 func NamespaceIndexFunc(obj interface{}) ([]string, error) {
 	namespace, ok := obj.(*v1.Namespace)
@@ -87,9 +205,29 @@ func NamespaceIndexFunc(obj interface{}) ([]string, error) {
 	return []string{namespace.GetName()}, nil
 }
 
-// NewNamespaceHandler returns a new namespace handler.
-func NewNamespaceHandler(namespaceKey string) *NamespaceHandler {
+// NamespaceFromMetadata is a cache.TransformFunc turning the namespace metadata of a metadata-only
+// informer into namespaces holding only their name, labels and annotations.
+func NamespaceFromMetadata(obj interface{}) (interface{}, error) {
+	metadata, ok := obj.(*metav1.PartialObjectMetadata)
+	if !ok {
+		// e.g. cache.DeletedFinalStateUnknown
+		return obj, nil
+	}
+	return &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            metadata.GetName(),
+			UID:             metadata.GetUID(),
+			ResourceVersion: metadata.GetResourceVersion(),
+			Labels:          metadata.GetLabels(),
+			Annotations:     metadata.GetAnnotations(),
+		},
+	}, nil
+}
+
+// NewNamespaceHandler returns a new namespace handler, onGrantsRevoked is optional.
+func NewNamespaceHandler(namespaceKey string, onGrantsRevoked NamespaceGrantsRevokedFunc) *NamespaceHandler {
 	return &NamespaceHandler{
-		namespaceKey: namespaceKey,
+		namespaceKey:    namespaceKey,
+		onGrantsRevoked: onGrantsRevoked,
 	}
 }
@@ -2,6 +2,7 @@ package kube2iam
 
 import (
 	"testing"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -62,6 +63,65 @@ func TestGetNamespaceRoleAnnotation(t *testing.T) {
 	}
 }
 
+func TestGetNamespaceRoleGrants(t *testing.T) {
+	ns := &v1.Namespace{}
+	ns.Annotations = map[string]string{"namespaceKey": `["my-role", {"role": "contractor-*", "notBefore": "2024-01-01T00:00:00Z", "expires": "2024-02-01T00:00:00Z"}]`}
+
+	grants := GetNamespaceRoleGrants(ns, "namespaceKey")
+	if len(grants) != 2 {
+		t.Fatalf("expected 2 grants, got %d: %v", len(grants), grants)
+	}
+	if grants[0].Role != "my-role" || grants[0].Expires != nil || grants[0].NotBefore != nil {
+		t.Errorf("expected plain grant for my-role, got %+v", grants[0])
+	}
+	if grants[1].Role != "contractor-*" || grants[1].Expires == nil || grants[1].NotBefore == nil {
+		t.Errorf("expected time-bounded grant for contractor-*, got %+v", grants[1])
+	}
+
+	roles := GetNamespaceRoleAnnotation(ns, "namespaceKey")
+	if len(roles) != 2 || roles[1] != "contractor-*" {
+		t.Errorf("expected role patterns of all grants, got %v", roles)
+	}
+}
+
+func TestGetNamespaceRoleGrantsInvalid(t *testing.T) {
+	for _, annotation := range []string{
+		`[{"expires": "2024-02-01T00:00:00Z"}]`,
+		`[{"role": "my-role", "expires": "tomorrow"}]`,
+		`["my-role", 42]`,
+	} {
+		ns := &v1.Namespace{}
+		ns.Annotations = map[string]string{"namespaceKey": annotation}
+		if grants := GetNamespaceRoleGrants(ns, "namespaceKey"); grants != nil {
+			t.Errorf("expected no grants for %s, got %v", annotation, grants)
+		}
+	}
+}
+
+func TestRoleGrantActiveAt(t *testing.T) {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	expires := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	grant := RoleGrant{Role: "contractor-*", NotBefore: &notBefore, Expires: &expires}
+
+	tests := []struct {
+		at       time.Time
+		expected bool
+	}{
+		{at: notBefore.Add(-time.Second), expected: false},
+		{at: notBefore, expected: true},
+		{at: expires.Add(-time.Second), expected: true},
+		{at: expires, expected: false},
+	}
+	for _, tt := range tests {
+		if got := grant.ActiveAt(tt.at); got != tt.expected {
+			t.Errorf("ActiveAt(%s) = %t, want %t", tt.at, got, tt.expected)
+		}
+	}
+	if !(RoleGrant{Role: "my-role"}).ActiveAt(expires) {
+		t.Error("expected grant without validity period to always be active")
+	}
+}
+
 func TestGetNamespaceRoleAnnotationMissingKey(t *testing.T) {
 	ns := &v1.Namespace{}
 	ns.Annotations = map[string]string{"other-key": `["role"]`}
@@ -103,7 +163,7 @@ func TestNamespaceIndexFuncWrongType(t *testing.T) {
 // ---- NamespaceHandler events ------------------------------------------------
 
 func TestNamespaceHandlerOnAdd(t *testing.T) {
-	h := NewNamespaceHandler("ns-key")
+	h := NewNamespaceHandler("ns-key", nil)
 	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{
 		Name:        "test",
 		Annotations: map[string]string{"ns-key": `["my-role"]`},
@@ -113,30 +173,61 @@ func TestNamespaceHandlerOnAdd(t *testing.T) {
 }
 
 func TestNamespaceHandlerOnAddWrongType(t *testing.T) {
-	h := NewNamespaceHandler("ns-key")
+	h := NewNamespaceHandler("ns-key", nil)
 	// Should not panic; logs an error
 	h.OnAdd("not-a-namespace", false)
 }
 
 func TestNamespaceHandlerOnUpdate(t *testing.T) {
-	h := NewNamespaceHandler("ns-key")
+	h := NewNamespaceHandler("ns-key", nil)
 	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
 	h.OnUpdate(ns, ns)
 }
 
 func TestNamespaceHandlerOnUpdateWrongType(t *testing.T) {
-	h := NewNamespaceHandler("ns-key")
+	h := NewNamespaceHandler("ns-key", nil)
 	h.OnUpdate("old", "new")
 }
 
 func TestNamespaceHandlerOnDelete(t *testing.T) {
-	h := NewNamespaceHandler("ns-key")
+	h := NewNamespaceHandler("ns-key", nil)
 	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
 	h.OnDelete(ns)
 }
 
+func TestNamespaceHandlerRevokedGrants(t *testing.T) {
+	var revoked []string
+	h := NewNamespaceHandler("ns-key", func(ns *v1.Namespace, grants []RoleGrant) {
+		for _, grant := range grants {
+			revoked = append(revoked, grant.Role)
+		}
+	})
+	oldNs := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "test",
+		Annotations: map[string]string{"ns-key": `["kept", "removed", {"role": "shortened", "expires": "2024-02-01T00:00:00Z"}]`},
+	}}
+	newNs := oldNs.DeepCopy()
+	newNs.Annotations["ns-key"] = `["kept", {"role": "shortened", "expires": "2024-01-15T00:00:00Z"}, "added"]`
+
+	h.OnUpdate(oldNs, newNs)
+	if len(revoked) != 2 || revoked[0] != "removed" || revoked[1] != "shortened" {
+		t.Errorf("expected removed and shortened grants to be revoked, got %v", revoked)
+	}
+
+	revoked = nil
+	h.OnUpdate(newNs, newNs.DeepCopy())
+	if len(revoked) != 0 {
+		t.Errorf("expected no revocation for an unchanged annotation, got %v", revoked)
+	}
+
+	h.OnDelete(cache.DeletedFinalStateUnknown{Key: "test", Obj: newNs})
+	if len(revoked) != 3 {
+		t.Errorf("expected all grants to be revoked on delete, got %v", revoked)
+	}
+}
+
 func TestNamespaceHandlerOnDeleteWrongType(t *testing.T) {
-	h := NewNamespaceHandler("ns-key")
+	h := NewNamespaceHandler("ns-key", nil)
 	h.OnDelete("not-a-namespace")
 }
 
@@ -224,6 +315,112 @@ func TestPodIPIndexFuncInactive(t *testing.T) {
 	}
 }
 
+func TestPodIPIndexFuncDualStack(t *testing.T) {
+	pod := &v1.Pod{Status: v1.PodStatus{
+		PodIP:  "10.0.0.1",
+		PodIPs: []v1.PodIP{{IP: "10.0.0.1"}, {IP: "fd00:10::0001"}},
+		Phase:  v1.PodRunning,
+	}}
+	keys, err := PodIPIndexFunc(pod)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 2 || keys[0] != "10.0.0.1" || keys[1] != "fd00:10::1" {
+		t.Errorf("expected [\"10.0.0.1\" \"fd00:10::1\"], got %v", keys)
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"10.0.0.1", "10.0.0.1"},
+		{"::ffff:10.0.0.1", "10.0.0.1"},
+		{"FD00:10:0::1", "fd00:10::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"not-an-ip", "not-an-ip"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeIP(tt.input); got != tt.expected {
+			t.Errorf("NormalizeIP(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestNewPodTransform(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:          "web",
+			Namespace:     "default",
+			UID:           "uid-web",
+			Labels:        map[string]string{"app": "web"},
+			Annotations:   map[string]string{"iam.amazonaws.com/role": "web-role", "kubectl.kubernetes.io/last-applied-configuration": "{}"},
+			ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+		},
+		Spec: v1.PodSpec{
+			NodeName:           "node-1",
+			ServiceAccountName: "web",
+			Containers:         []v1.Container{{Name: "web", Image: "nginx"}},
+		},
+		Status: v1.PodStatus{PodIP: "10.0.0.1", PodIPs: []v1.PodIP{{IP: "10.0.0.1"}}, Phase: v1.PodRunning},
+	}
+
+	obj, err := NewPodTransform([]string{"iam.amazonaws.com/role"})(pod)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := obj.(*v1.Pod)
+	if got.Name != "web" || got.Namespace != "default" || got.UID != "uid-web" || got.Labels["app"] != "web" {
+		t.Errorf("expected pod identity and labels to be kept, got %+v", got.ObjectMeta)
+	}
+	if len(got.Annotations) != 1 || got.Annotations["iam.amazonaws.com/role"] != "web-role" {
+		t.Errorf("expected only the role annotation to be kept, got %v", got.Annotations)
+	}
+	if len(got.ManagedFields) != 0 || len(got.Spec.Containers) != 0 {
+		t.Errorf("expected managed fields and containers to be dropped, got %+v", got)
+	}
+	if got.Spec.NodeName != "node-1" || got.Spec.ServiceAccountName != "web" || got.Status.PodIP != "10.0.0.1" || got.Status.Phase != v1.PodRunning {
+		t.Errorf("expected spec and status fields used for role mapping to be kept, got %+v", got)
+	}
+
+	obj, err = NewPodTransform(nil)(pod)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if annotations := obj.(*v1.Pod).Annotations; len(annotations) != 2 {
+		t.Errorf("expected all annotations to be kept without annotation keys, got %v", annotations)
+	}
+
+	tombstone := cache.DeletedFinalStateUnknown{Key: "default/web", Obj: pod}
+	if obj, err := NewPodTransform(nil)(tombstone); err != nil || obj != tombstone {
+		t.Errorf("expected tombstones to be passed through, got %v, %v", obj, err)
+	}
+}
+
+func TestNamespaceFromMetadata(t *testing.T) {
+	metadata := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{
+		Name:          "team-a",
+		Labels:        map[string]string{"team": "a"},
+		Annotations:   map[string]string{"iam.amazonaws.com/allowed-roles": `["role-a"]`},
+		ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+	}}
+	obj, err := NamespaceFromMetadata(metadata)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ns, ok := obj.(*v1.Namespace)
+	if !ok {
+		t.Fatalf("expected a namespace, got %T", obj)
+	}
+	if ns.Name != "team-a" || ns.Labels["team"] != "a" || len(GetNamespaceRoleAnnotation(ns, "iam.amazonaws.com/allowed-roles")) != 1 {
+		t.Errorf("expected name, labels and annotations to be kept, got %+v", ns.ObjectMeta)
+	}
+	if len(ns.ManagedFields) != 0 {
+		t.Errorf("expected managed fields to be dropped, got %v", ns.ManagedFields)
+	}
+}
+
 func TestPodIPIndexFuncWrongType(t *testing.T) {
 	_, err := PodIPIndexFunc("not-a-pod")
 	if err == nil {
@@ -234,7 +431,7 @@ func TestPodIPIndexFuncWrongType(t *testing.T) {
 // ---- PodHandler events ------------------------------------------------------
 
 func TestPodHandlerOnAdd(t *testing.T) {
-	h := NewPodHandler("iam.amazonaws.com/role")
+	h := NewPodHandler("iam.amazonaws.com/role", nil)
 	pod := &v1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "test-pod",
@@ -249,29 +446,58 @@ func TestPodHandlerOnAdd(t *testing.T) {
 }
 
 func TestPodHandlerOnAddWrongType(t *testing.T) {
-	h := NewPodHandler("iam.amazonaws.com/role")
+	h := NewPodHandler("iam.amazonaws.com/role", nil)
 	h.OnAdd("not-a-pod", false)
 }
 
 func TestPodHandlerOnUpdate(t *testing.T) {
-	h := NewPodHandler("iam.amazonaws.com/role")
+	h := NewPodHandler("iam.amazonaws.com/role", nil)
 	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-pod"}}
 	h.OnUpdate(pod, pod)
 }
 
+func TestPodHandlerRoleChange(t *testing.T) {
+	changes := 0
+	h := NewPodHandler("iam.amazonaws.com/role", func(oldPod, newPod *v1.Pod) {
+		changes++
+	})
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "test-pod",
+		Annotations: map[string]string{"iam.amazonaws.com/role": "my-role"},
+	}}
+
+	unchanged := pod.DeepCopy()
+	unchanged.Status.Phase = v1.PodRunning
+	h.OnUpdate(pod, unchanged)
+	if changes != 0 {
+		t.Errorf("expected no role change, got %d", changes)
+	}
+
+	changed := pod.DeepCopy()
+	changed.Annotations["iam.amazonaws.com/role"] = "other-role"
+	h.OnUpdate(pod, changed)
+
+	removed := pod.DeepCopy()
+	removed.Annotations = nil
+	h.OnUpdate(pod, removed)
+	if changes != 2 {
+		t.Errorf("expected 2 role changes, got %d", changes)
+	}
+}
+
 func TestPodHandlerOnUpdateWrongType(t *testing.T) {
-	h := NewPodHandler("iam.amazonaws.com/role")
+	h := NewPodHandler("iam.amazonaws.com/role", nil)
 	h.OnUpdate("old", "new")
 }
 
 func TestPodHandlerOnDelete(t *testing.T) {
-	h := NewPodHandler("iam.amazonaws.com/role")
+	h := NewPodHandler("iam.amazonaws.com/role", nil)
 	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-pod"}}
 	h.OnDelete(pod)
 }
 
 func TestPodHandlerOnDeleteTombstone(t *testing.T) {
-	h := NewPodHandler("iam.amazonaws.com/role")
+	h := NewPodHandler("iam.amazonaws.com/role", nil)
 	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "tombstoned-pod"}}
 	tombstone := cache.DeletedFinalStateUnknown{
 		Key: "default/tombstoned-pod",
@@ -282,6 +508,6 @@ func TestPodHandlerOnDeleteTombstone(t *testing.T) {
 }
 
 func TestPodHandlerOnDeleteWrongType(t *testing.T) {
-	h := NewPodHandler("iam.amazonaws.com/role")
+	h := NewPodHandler("iam.amazonaws.com/role", nil)
 	h.OnDelete("not-a-pod")
 }
@@ -0,0 +1,71 @@
+package kube2iam
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// NodeHandler outputs change events for nodes from K8.
+type NodeHandler struct{}
+
+func (h *NodeHandler) nodeFields(node *v1.Node) log.Fields {
+	return log.Fields{
+		"node.name":   node.GetName(),
+		"node.labels": node.GetLabels(),
+	}
+}
+
+// OnAdd called when a node is added to k8s.
+func (h *NodeHandler) OnAdd(obj interface{}, isInInitialList bool) {
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		log.Errorf("Expected Node but OnAdd handler received %+v", obj)
+		return
+	}
+	log.WithFields(h.nodeFields(node)).Debug("Node OnAdd")
+}
+
+// OnUpdate called when a node is updated inside k8s.
+func (h *NodeHandler) OnUpdate(oldObj, newObj interface{}) {
+	node, ok := newObj.(*v1.Node)
+	if !ok {
+		log.Errorf("Expected Node but OnUpdate handler received %+v %+v", oldObj, newObj)
+		return
+	}
+	log.WithFields(h.nodeFields(node)).Debug("Node OnUpdate")
+}
+
+// OnDelete called when a node is removed from k8s.
+func (h *NodeHandler) OnDelete(obj interface{}) {
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		deletedObj, dok := obj.(cache.DeletedFinalStateUnknown)
+		if dok {
+			node, ok = deletedObj.Obj.(*v1.Node)
+		}
+	}
+
+	if !ok {
+		log.Errorf("Expected Node but OnDelete handler received %+v", obj)
+		return
+	}
+	log.WithFields(h.nodeFields(node)).Debug("Node OnDelete")
+}
+
+// NodeIndexFunc maps a node to it's name.
+func NodeIndexFunc(obj interface{}) ([]string, error) {
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		return nil, fmt.Errorf("expected node but received: %+v", obj)
+	}
+
+	return []string{node.GetName()}, nil
+}
+
+// NewNodeHandler returns a new node handler.
+func NewNodeHandler() *NodeHandler {
+	return &NodeHandler{}
+}
@@ -0,0 +1,49 @@
+package kube2iam
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ---- NodeIndexFunc ----------------------------------------------------------
+
+func TestNodeIndexFunc(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}
+	keys, err := NodeIndexFunc(node)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "node-1" {
+		t.Errorf("expected [\"node-1\"], got %v", keys)
+	}
+}
+
+func TestNodeIndexFuncWrongType(t *testing.T) {
+	_, err := NodeIndexFunc("not-a-node")
+	if err == nil {
+		t.Error("expected error for wrong type, got nil")
+	}
+}
+
+// ---- NodeHandler events -----------------------------------------------------
+
+func TestNodeHandlerEvents(t *testing.T) {
+	h := NewNodeHandler()
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"pool": "secure"}}}
+	// Should not panic
+	h.OnAdd(node, false)
+	h.OnUpdate(node, node)
+	h.OnDelete(node)
+	h.OnDelete(cache.DeletedFinalStateUnknown{Key: "node-1", Obj: node})
+}
+
+func TestNodeHandlerEventsWrongType(t *testing.T) {
+	h := NewNodeHandler()
+	// Should not panic; logs an error
+	h.OnAdd("not-a-node", false)
+	h.OnUpdate("old", "new")
+	h.OnDelete("not-a-node")
+}
@@ -1,16 +1,27 @@
 package kube2iam
 
 import (
+	"errors"
 	"fmt"
+	"net/netip"
 
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
+// ErrPodNotFound is returned when a pod missing from the cache is still not found after waiting for it to
+// be indexed or looking it up with the api server, so that the lookup isn't retried.
+var ErrPodNotFound = errors.New("pod not found")
+
+// PodRoleChangeFunc is called when the role annotation of a pod changes.
+type PodRoleChangeFunc func(oldPod, newPod *v1.Pod)
+
 // PodHandler represents a pod handler.
 type PodHandler struct {
-	iamRoleKey string
+	iamRoleKey   string
+	onRoleChange PodRoleChangeFunc
 }
 
 func (p *PodHandler) podFields(pod *v1.Pod) log.Fields {
@@ -18,6 +29,7 @@ func (p *PodHandler) podFields(pod *v1.Pod) log.Fields {
 		"pod.name":         pod.GetName(),
 		"pod.namespace":    pod.GetNamespace(),
 		"pod.status.ip":    pod.Status.PodIP,
+		"pod.status.ips":   PodIPs(pod),
 		"pod.status.phase": pod.Status.Phase,
 		"pod.iam.role":     pod.GetAnnotations()[p.iamRoleKey],
 	}
@@ -40,7 +52,7 @@ func (p *PodHandler) OnAdd(obj interface{}, isInInitialList bool) {
 
 // OnUpdate is called when a pod is modified.
 func (p *PodHandler) OnUpdate(oldObj, newObj interface{}) {
-	_, ok1 := oldObj.(*v1.Pod)
+	oldPod, ok1 := oldObj.(*v1.Pod)
 	newPod, ok2 := newObj.(*v1.Pod)
 	if !ok1 || !ok2 {
 		log.Errorf("Expected Pod but OnUpdate handler received %+v %+v", oldObj, newObj)
@@ -49,6 +61,15 @@ func (p *PodHandler) OnUpdate(oldObj, newObj interface{}) {
 
 	logger := log.WithFields(p.podFields(newPod))
 	logger.Debug("Pod OnUpdate")
+
+	oldRole, hadRole := oldPod.GetAnnotations()[p.iamRoleKey]
+	newRole, hasRole := newPod.GetAnnotations()[p.iamRoleKey]
+	if oldRole != newRole || hadRole != hasRole {
+		logger.WithField("pod.iam.old_role", oldRole).Info("Pod role annotation changed")
+		if p.onRoleChange != nil {
+			p.onRoleChange(oldPod, newPod)
+		}
+	}
 }
 
 // OnDelete is called when a pod is deleted.
@@ -76,19 +97,104 @@ func isPodActive(p *v1.Pod) bool {
 		v1.PodFailed != p.Status.Phase
 }
 
-// PodIPIndexFunc maps a given Pod to it's IP for caching.
+// NormalizeIP returns the canonical form of an IP address, IPv4-mapped IPv6 addresses
+// being returned as IPv4 addresses. Unparsable addresses are returned unchanged.
+func NormalizeIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	return addr.Unmap().WithZone("").String()
+}
+
+// PodIPs returns all the IPs of a pod, the primary IP first, i.e. both families in dual-stack clusters.
+func PodIPs(pod *v1.Pod) []string {
+	var ips []string
+	seen := make(map[string]bool)
+	add := func(ip string) {
+		if ip == "" {
+			return
+		}
+		ip = NormalizeIP(ip)
+		if !seen[ip] {
+			seen[ip] = true
+			ips = append(ips, ip)
+		}
+	}
+	add(pod.Status.PodIP)
+	for _, podIP := range pod.Status.PodIPs {
+		add(podIP.IP)
+	}
+	return ips
+}
+
+// PodIPIndexFunc maps a given Pod to all of it's IPs for caching.
 func PodIPIndexFunc(obj interface{}) ([]string, error) {
 	pod, ok := obj.(*v1.Pod)
 	if !ok {
 		return nil, fmt.Errorf("obj not pod: %+v", obj)
 	}
 	if isPodActive(pod) {
-		return []string{pod.Status.PodIP}, nil
+		return PodIPs(pod), nil
 	}
 	return nil, nil
 }
 
-// NewPodHandler constructs a pod handler given the relevant IAM Role Key
-func NewPodHandler(iamRoleKey string) *PodHandler {
-	return &PodHandler{iamRoleKey: iamRoleKey}
+// PodUIDIndexFunc maps a given Pod to it's UID for caching.
+func PodUIDIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("obj not pod: %+v", obj)
+	}
+	return []string{string(pod.GetUID())}, nil
+}
+
+// NewPodTransform returns a cache.TransformFunc stripping pods down to the fields used to map them to roles,
+// i.e. identity, labels, IPs, phase, start and deletion time, node, service account and hostNetwork.
+// Only the given annotations are kept, or all of them when annotationKeys is nil.
+func NewPodTransform(annotationKeys []string) cache.TransformFunc {
+	return func(obj interface{}) (interface{}, error) {
+		pod, ok := obj.(*v1.Pod)
+		if !ok {
+			// e.g. cache.DeletedFinalStateUnknown
+			return obj, nil
+		}
+		annotations := pod.GetAnnotations()
+		if annotationKeys != nil {
+			annotations = make(map[string]string)
+			for _, key := range annotationKeys {
+				if value, ok := pod.GetAnnotations()[key]; ok {
+					annotations[key] = value
+				}
+			}
+		}
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              pod.GetName(),
+				Namespace:         pod.GetNamespace(),
+				UID:               pod.GetUID(),
+				ResourceVersion:   pod.GetResourceVersion(),
+				Labels:            pod.GetLabels(),
+				Annotations:       annotations,
+				DeletionTimestamp: pod.GetDeletionTimestamp(),
+			},
+			Spec: v1.PodSpec{
+				NodeName:           pod.Spec.NodeName,
+				ServiceAccountName: pod.Spec.ServiceAccountName,
+				HostNetwork:        pod.Spec.HostNetwork,
+			},
+			Status: v1.PodStatus{
+				Phase:     pod.Status.Phase,
+				PodIP:     pod.Status.PodIP,
+				PodIPs:    pod.Status.PodIPs,
+				StartTime: pod.Status.StartTime,
+			},
+		}, nil
+	}
+}
+
+// NewPodHandler constructs a pod handler given the relevant IAM Role Key and an
+// optional function called when the role annotation of a pod changes.
+func NewPodHandler(iamRoleKey string, onRoleChange PodRoleChangeFunc) *PodHandler {
+	return &PodHandler{iamRoleKey: iamRoleKey, onRoleChange: onRoleChange}
 }
@@ -0,0 +1,281 @@
+package policy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	glob "github.com/ryanuber/go-glob"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// Effect is the outcome of a policy rule when its expression evaluates to true.
+type Effect string
+
+const (
+	// Allow permits the request.
+	Allow Effect = "allow"
+	// Deny refuses the request.
+	Deny Effect = "deny"
+
+	// DefaultRuleName is reported when no rule matched and the default effect applied.
+	DefaultRuleName = "default"
+
+	roleARNPrefix   = "arn:"
+	missingKeyError = "no such key"
+)
+
+// Rule is a named CEL expression evaluated against a credential request.
+type Rule struct {
+	Name       string `json:"name"`
+	Effect     Effect `json:"effect"`
+	Expression string `json:"expression"`
+}
+
+// NodeConstraint restricts the roles matching a glob of their full ARN to nodes matching a label selector.
+type NodeConstraint struct {
+	Name         string            `json:"name"`
+	Role         string            `json:"role"`
+	NodeSelector map[string]string `json:"nodeSelector"`
+}
+
+// Config is the file representation of a policy.
+type Config struct {
+	// DefaultEffect applies when no rule matches, it defaults to deny.
+	DefaultEffect   Effect           `json:"defaultEffect"`
+	NodeConstraints []NodeConstraint `json:"nodeConstraints"`
+	Rules           []Rule           `json:"rules"`
+}
+
+// Input holds the objects a policy is evaluated against.
+// Namespace and Node are optional, missing objects are presented as empty maps.
+type Input struct {
+	Pod       *v1.Pod
+	Namespace *v1.Namespace
+	Node      *v1.Node
+	Role      string
+}
+
+// Decision is the result of evaluating a policy.
+type Decision struct {
+	Allowed bool
+	Rule    string
+}
+
+type compiledRule struct {
+	Rule
+	program cel.Program
+}
+
+type compiledNodeConstraint struct {
+	NodeConstraint
+	selector labels.Selector
+}
+
+// Policy is a compiled, ordered list of rules. The first rule whose expression
+// evaluates to true decides the request. Node constraints are checked before
+// the rules and deny a role on any node that doesn't match their selector.
+type Policy struct {
+	defaultEffect   Effect
+	nodeConstraints []compiledNodeConstraint
+	rules           []compiledRule
+}
+
+// newEnv declares the variables available to rule expressions. The namespace is
+// exposed as namespaceObject because namespace is a reserved word in CEL.
+func newEnv() (*cel.Env, error) {
+	objectType := cel.MapType(cel.StringType, cel.DynType)
+	return cel.NewEnv(
+		cel.Variable("pod", objectType),
+		cel.Variable("namespaceObject", objectType),
+		cel.Variable("node", objectType),
+		cel.Variable("role", cel.StringType),
+	)
+}
+
+func validEffect(effect Effect) bool {
+	return effect == Allow || effect == Deny
+}
+
+// New compiles the rules of the given config.
+func New(cfg Config) (*Policy, error) {
+	env, err := newEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{defaultEffect: cfg.DefaultEffect}
+	if p.defaultEffect == "" {
+		p.defaultEffect = Deny
+	}
+	if !validEffect(p.defaultEffect) {
+		return nil, fmt.Errorf("invalid default effect %q, expected %q or %q", cfg.DefaultEffect, Allow, Deny)
+	}
+
+	names := make(map[string]bool, len(cfg.Rules)+len(cfg.NodeConstraints))
+	checkName := func(name string) error {
+		if name == "" || name == DefaultRuleName {
+			return fmt.Errorf("invalid rule name %q", name)
+		}
+		if names[name] {
+			return fmt.Errorf("duplicate rule name %q", name)
+		}
+		names[name] = true
+		return nil
+	}
+
+	for _, constraint := range cfg.NodeConstraints {
+		if err := checkName(constraint.Name); err != nil {
+			return nil, err
+		}
+		if constraint.Role == "" || len(constraint.NodeSelector) == 0 {
+			return nil, fmt.Errorf("node constraint %q requires a role and a nodeSelector", constraint.Name)
+		}
+		// Roles are matched by their full ARN, a role name would never match and silently disable the constraint
+		if !strings.HasPrefix(constraint.Role, roleARNPrefix) {
+			return nil, fmt.Errorf("node constraint %q role %q must be a full role ARN pattern starting with %q", constraint.Name, constraint.Role, roleARNPrefix)
+		}
+		sel, err := labels.ValidatedSelectorFromSet(constraint.NodeSelector)
+		if err != nil {
+			return nil, fmt.Errorf("node constraint %q has an invalid nodeSelector: %s", constraint.Name, err)
+		}
+		p.nodeConstraints = append(p.nodeConstraints, compiledNodeConstraint{NodeConstraint: constraint, selector: sel})
+	}
+
+	for _, rule := range cfg.Rules {
+		if err := checkName(rule.Name); err != nil {
+			return nil, err
+		}
+		if !validEffect(rule.Effect) {
+			return nil, fmt.Errorf("rule %q has invalid effect %q, expected %q or %q", rule.Name, rule.Effect, Allow, Deny)
+		}
+
+		ast, issues := env.Compile(rule.Expression)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("rule %q failed to compile: %s", rule.Name, issues.Err())
+		}
+		if ast.OutputType() != cel.BoolType {
+			return nil, fmt.Errorf("rule %q must evaluate to a bool, got %s", rule.Name, ast.OutputType())
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q failed to compile: %s", rule.Name, err)
+		}
+		p.rules = append(p.rules, compiledRule{Rule: rule, program: program})
+	}
+	return p, nil
+}
+
+// Load reads and compiles a YAML or JSON policy file.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse policy file %s: %s", path, err)
+	}
+	return New(cfg)
+}
+
+// Evaluate returns the decision of the first matching rule, or the default effect.
+// A rule reading a missing map key doesn't match, and a rule that fails to evaluate otherwise
+// is skipped if it allows and matches if it denies.
+func (p *Policy) Evaluate(in Input) Decision {
+	if decision, denied := p.checkNodeConstraints(in); denied {
+		return decision
+	}
+
+	vars := in.activation()
+	for _, rule := range p.rules {
+		out, _, err := rule.program.Eval(vars)
+		matched := false
+		if err != nil && isMissingKey(err) {
+			log.Debugf("Policy rule %q doesn't match role %s: %s", rule.Name, in.Role, err)
+		} else if err != nil {
+			log.Warnf("Policy rule %q failed to evaluate for role %s: %s", rule.Name, in.Role, err)
+			matched = rule.Effect == Deny
+		} else if b, ok := out.Value().(bool); ok {
+			matched = b
+		}
+		if matched {
+			return Decision{Allowed: rule.Effect == Allow, Rule: rule.Name}
+		}
+	}
+	return Decision{Allowed: p.defaultEffect == Allow, Rule: DefaultRuleName}
+}
+
+// isMissingKey returns whether an evaluation error comes from reading a key absent from a map, such as a
+// label the pod doesn't have. CEL doesn't type these errors, they are recognized by their message.
+func isMissingKey(err error) bool {
+	return strings.HasPrefix(err.Error(), missingKeyError)
+}
+
+// checkNodeConstraints denies a role constrained to labelled nodes when the pod's node
+// is unknown or doesn't match the constraint's selector.
+func (p *Policy) checkNodeConstraints(in Input) (Decision, bool) {
+	for _, constraint := range p.nodeConstraints {
+		if !glob.Glob(constraint.Role, in.Role) {
+			continue
+		}
+		if in.Node == nil {
+			log.Warnf("Node constraint %q requires node labels %s for role %s but the node is unknown", constraint.Name, constraint.selector, in.Role)
+			return Decision{Allowed: false, Rule: constraint.Name}, true
+		}
+		if !constraint.selector.Matches(labels.Set(in.Node.GetLabels())) {
+			return Decision{Allowed: false, Rule: constraint.Name}, true
+		}
+	}
+	return Decision{}, false
+}
+
+func (in Input) activation() map[string]interface{} {
+	pod := map[string]interface{}{}
+	namespace := map[string]interface{}{}
+	node := map[string]interface{}{}
+
+	if in.Pod != nil {
+		pod = map[string]interface{}{
+			"name":           in.Pod.GetName(),
+			"namespace":      in.Pod.GetNamespace(),
+			"labels":         stringMap(in.Pod.GetLabels()),
+			"annotations":    stringMap(in.Pod.GetAnnotations()),
+			"serviceAccount": in.Pod.Spec.ServiceAccountName,
+			"nodeName":       in.Pod.Spec.NodeName,
+		}
+		namespace["name"] = in.Pod.GetNamespace()
+		node["name"] = in.Pod.Spec.NodeName
+	}
+	namespace["labels"] = map[string]string{}
+	namespace["annotations"] = map[string]string{}
+	node["labels"] = map[string]string{}
+
+	if in.Namespace != nil {
+		namespace["name"] = in.Namespace.GetName()
+		namespace["labels"] = stringMap(in.Namespace.GetLabels())
+		namespace["annotations"] = stringMap(in.Namespace.GetAnnotations())
+	}
+	if in.Node != nil {
+		node["name"] = in.Node.GetName()
+		node["labels"] = stringMap(in.Node.GetLabels())
+	}
+
+	return map[string]interface{}{
+		"pod":             pod,
+		"namespaceObject": namespace,
+		"node":            node,
+		"role":            in.Role,
+	}
+}
+
+func stringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
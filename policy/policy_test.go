@@ -0,0 +1,268 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const paymentsExpression = `namespaceObject.labels["team"] == "payments" && pod.labels["tier"] == "backend" && role.startsWith("arn:aws:iam::123456789012:role/payments/")`
+
+func testPod(labels map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pod", Namespace: "payments", Labels: labels},
+		Spec:       v1.PodSpec{ServiceAccountName: "billing", NodeName: "node-1"},
+	}
+}
+
+func testNamespace(labels map[string]string) *v1.Namespace {
+	return &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments", Labels: labels}}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"invalid default effect", Config{DefaultEffect: "maybe"}},
+		{"missing rule name", Config{Rules: []Rule{{Effect: Allow, Expression: "true"}}}},
+		{"reserved rule name", Config{Rules: []Rule{{Name: DefaultRuleName, Effect: Allow, Expression: "true"}}}},
+		{"duplicate rule name", Config{Rules: []Rule{
+			{Name: "a", Effect: Allow, Expression: "true"},
+			{Name: "a", Effect: Deny, Expression: "false"},
+		}}},
+		{"invalid effect", Config{Rules: []Rule{{Name: "a", Effect: "permit", Expression: "true"}}}},
+		{"syntax error", Config{Rules: []Rule{{Name: "a", Effect: Allow, Expression: "pod.labels["}}}},
+		{"unknown variable", Config{Rules: []Rule{{Name: "a", Effect: Allow, Expression: "container.name == 'x'"}}}},
+		{"non bool expression", Config{Rules: []Rule{{Name: "a", Effect: Allow, Expression: "role"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.cfg); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	p, err := New(Config{Rules: []Rule{
+		{Name: "deny-admin", Effect: Deny, Expression: `role.endsWith("/admin")`},
+		{Name: "payments-backend", Effect: Allow, Expression: paymentsExpression},
+		{Name: "service-account", Effect: Allow, Expression: `pod.serviceAccount == "reporting" && node.name == "node-1"`},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	backend := map[string]string{"tier": "backend"}
+	payments := map[string]string{"team": "payments"}
+	reporting := testPod(nil)
+	reporting.Spec.ServiceAccountName = "reporting"
+
+	tests := []struct {
+		name        string
+		input       Input
+		wantAllowed bool
+		wantRule    string
+	}{
+		{
+			name:        "matching allow rule",
+			input:       Input{Pod: testPod(backend), Namespace: testNamespace(payments), Role: "arn:aws:iam::123456789012:role/payments/reader"},
+			wantAllowed: true,
+			wantRule:    "payments-backend",
+		},
+		{
+			name:        "deny rule takes precedence",
+			input:       Input{Pod: testPod(backend), Namespace: testNamespace(payments), Role: "arn:aws:iam::123456789012:role/payments/admin"},
+			wantAllowed: false,
+			wantRule:    "deny-admin",
+		},
+		{
+			name:        "wrong namespace label falls through to default",
+			input:       Input{Pod: testPod(backend), Namespace: testNamespace(map[string]string{"team": "search"}), Role: "arn:aws:iam::123456789012:role/payments/reader"},
+			wantAllowed: false,
+			wantRule:    DefaultRuleName,
+		},
+		{
+			name:        "missing label errors and skips allow rule",
+			input:       Input{Pod: testPod(nil), Namespace: testNamespace(payments), Role: "arn:aws:iam::123456789012:role/payments/reader"},
+			wantAllowed: false,
+			wantRule:    DefaultRuleName,
+		},
+		{
+			name:        "missing namespace object",
+			input:       Input{Pod: reporting, Role: "arn:aws:iam::123456789012:role/reporting"},
+			wantAllowed: true,
+			wantRule:    "service-account",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.Evaluate(tt.input)
+			if got.Allowed != tt.wantAllowed || got.Rule != tt.wantRule {
+				t.Errorf("expected allowed=%t rule=%q, got allowed=%t rule=%q", tt.wantAllowed, tt.wantRule, got.Allowed, got.Rule)
+			}
+		})
+	}
+}
+
+func TestEvaluateDenyRuleErrorFailsClosed(t *testing.T) {
+	p, err := New(Config{DefaultEffect: Allow, Rules: []Rule{
+		{Name: "deny-numbered", Effect: Deny, Expression: `int(pod.labels["tier"]) > 1`},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := p.Evaluate(Input{Pod: testPod(map[string]string{"tier": "frontend"}), Role: "arn:aws:iam::123456789012:role/any"})
+	if got.Allowed || got.Rule != "deny-numbered" {
+		t.Errorf("expected deny by deny-numbered, got %+v", got)
+	}
+}
+
+func TestEvaluateMissingKeyDoesNotMatch(t *testing.T) {
+	p, err := New(Config{DefaultEffect: Allow, Rules: []Rule{
+		{Name: "deny-dev", Effect: Deny, Expression: `pod.labels["env"] == "dev"`},
+		{Name: "allow-frontend", Effect: Allow, Expression: `namespaceObject.labels.tier == "frontend"`},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected Decision
+	}{
+		{"absent label", nil, Decision{Allowed: true, Rule: DefaultRuleName}},
+		{"other value", map[string]string{"env": "prod"}, Decision{Allowed: true, Rule: DefaultRuleName}},
+		{"matching value", map[string]string{"env": "dev"}, Decision{Allowed: false, Rule: "deny-dev"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.Evaluate(Input{Pod: testPod(tt.labels), Namespace: testNamespace(nil), Role: "arn:aws:iam::123456789012:role/any"})
+			if got != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	content := `
+defaultEffect: allow
+rules:
+- name: deny-admin
+  effect: deny
+  expression: role.endsWith("/admin")
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := p.Evaluate(Input{Pod: testPod(nil), Role: "arn:aws:iam::123456789012:role/reader"}); !got.Allowed || got.Rule != DefaultRuleName {
+		t.Errorf("expected allow by default, got %+v", got)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("expected error for missing file, got nil")
+	}
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte("rules:\n- name: a\n  unknown: field\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("expected error for unknown field, got nil")
+	}
+
+	content := `
+nodeConstraints:
+- name: secure-pool
+  role: secure/*
+  nodeSelector:
+    pool: secure
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "full role ARN") {
+		t.Errorf("expected error for a node constraint on a role name, got %v", err)
+	}
+}
+
+func TestNodeConstraints(t *testing.T) {
+	p, err := New(Config{
+		DefaultEffect: Allow,
+		NodeConstraints: []NodeConstraint{{
+			Name:         "secure-pool",
+			Role:         "arn:aws:iam::*:role/secure/*",
+			NodeSelector: map[string]string{"pool": "secure"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	secure := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"pool": "secure"}}}
+	general := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-2", Labels: map[string]string{"pool": "general"}}}
+
+	tests := []struct {
+		name        string
+		node        *v1.Node
+		role        string
+		wantAllowed bool
+		wantRule    string
+	}{
+		{"constrained role on matching node", secure, "arn:aws:iam::123456789012:role/secure/vault", true, DefaultRuleName},
+		{"constrained role on other node", general, "arn:aws:iam::123456789012:role/secure/vault", false, "secure-pool"},
+		{"constrained role on unknown node", nil, "arn:aws:iam::123456789012:role/secure/vault", false, "secure-pool"},
+		{"unconstrained role on other node", general, "arn:aws:iam::123456789012:role/reader", true, DefaultRuleName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.Evaluate(Input{Pod: testPod(nil), Node: tt.node, Role: tt.role})
+			if got.Allowed != tt.wantAllowed || got.Rule != tt.wantRule {
+				t.Errorf("expected allowed=%t rule=%q, got allowed=%t rule=%q", tt.wantAllowed, tt.wantRule, got.Allowed, got.Rule)
+			}
+		})
+	}
+}
+
+func TestNodeConstraintsInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		constraint NodeConstraint
+	}{
+		{"missing role", NodeConstraint{Name: "a", NodeSelector: map[string]string{"pool": "secure"}}},
+		{"missing selector", NodeConstraint{Name: "a", Role: "*"}},
+		{"invalid selector", NodeConstraint{Name: "a", Role: "arn:*", NodeSelector: map[string]string{"pool": "not valid!"}}},
+		{"role name", NodeConstraint{Name: "a", Role: "secure/*", NodeSelector: map[string]string{"pool": "secure"}}},
+		{"role glob", NodeConstraint{Name: "a", Role: "*", NodeSelector: map[string]string{"pool": "secure"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(Config{NodeConstraints: []NodeConstraint{tt.constraint}}); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+
+	_, err := New(Config{
+		NodeConstraints: []NodeConstraint{{Name: "a", Role: "arn:*", NodeSelector: map[string]string{"pool": "secure"}}},
+		Rules:           []Rule{{Name: "a", Effect: Allow, Expression: "true"}},
+	})
+	if err == nil {
+		t.Error("expected error for rule name shared with a node constraint, got nil")
+	}
+}
@@ -0,0 +1,221 @@
+// Package procfs attributes local TCP connections to the pod owning the connecting socket,
+// which identifies hostNetwork pods that share the node IP.
+package procfs
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karlseguin/ccache"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRoot is the default mount point of procfs.
+const DefaultRoot = "/proc"
+
+const (
+	// socketCacheTTL is how long the process and fd holding a socket are remembered. They are checked
+	// again before being used, a socket inode not being reused while the socket is open.
+	socketCacheTTL = 1 * time.Minute
+	// cgroupCacheTTL is how long processes are remembered as not running in a pod, so that their file
+	// descriptors are not scanned. It is short as the PID may be reused by a process of a pod.
+	cgroupCacheTTL = 5 * time.Second
+)
+
+// ErrUnavailable is returned when the sockets or processes can't be read from procfs, e.g. when procfs
+// isn't mounted, as opposed to a socket positively owned by a process out of a pod.
+var ErrUnavailable = errors.New("procfs unavailable")
+
+// podUIDRegexp matches the pod UID in cgroup paths, both in the cgroupfs
+// (/kubepods/burstable/pod<uid>/...) and systemd (kubepods-burstable-pod<uid>.slice) layouts.
+var podUIDRegexp = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// Resolver looks up sockets, processes and cgroups in a procfs tree.
+type Resolver struct {
+	Root string
+	// sockets maps socket inodes to the fd holding them, e.g. 123/fd/3
+	sockets *ccache.Cache
+	// hostProcesses holds the PIDs of the processes not running in a pod
+	hostProcesses *ccache.Cache
+}
+
+// PodUID returns the UID of the pod owning the TCP socket bound to the given local address.
+func (r *Resolver) PodUID(ip string, port int) (string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", fmt.Errorf("invalid IP %q", ip)
+	}
+
+	inode, err := r.socketInode(addr, port)
+	if err != nil {
+		return "", err
+	}
+	pid, err := r.pidForInode(inode)
+	if err != nil {
+		return "", err
+	}
+	return r.podUIDForPID(pid)
+}
+
+// socketInode finds the inode of the TCP socket bound to the address in net/tcp and net/tcp6.
+func (r *Resolver) socketInode(ip net.IP, port int) (string, error) {
+	tables := 0
+	for _, table := range []string{"tcp", "tcp6"} {
+		path := filepath.Join(r.Root, "net", table)
+		inode, err := r.findSocket(path, ip, port)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("%w: error reading %s: %v", ErrUnavailable, path, err)
+		}
+		tables++
+		if inode != "" {
+			return inode, nil
+		}
+	}
+	if tables == 0 {
+		return "", fmt.Errorf("%w: no tcp table in %s", ErrUnavailable, filepath.Join(r.Root, "net"))
+	}
+	return "", fmt.Errorf("no socket found for %s", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+}
+
+func (r *Resolver) findSocket(path string, ip net.IP, port int) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Errorf("Error closing %s: %+v", path, err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // skip the header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[9] == "0" {
+			continue
+		}
+		localIP, localPort, err := parseAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		if localPort == port && localIP.Equal(ip) {
+			return fields[9], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// parseAddr decodes an address of the net/tcp tables, e.g. 0100007F:1F90 for 127.0.0.1:8080.
+// Addresses are written as 32-bit words in host byte order, little-endian on supported platforms.
+func parseAddr(s string) (net.IP, int, error) {
+	hexIP, hexPort, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	b, err := hex.DecodeString(hexIP)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port in address %q", s)
+	}
+	return net.IP(b), int(port), nil
+}
+
+// pidForInode finds a process holding a file descriptor on the socket. Only the processes running in a pod
+// are scanned, and the fd holding the socket is remembered for the next requests on the same connection.
+func (r *Resolver) pidForInode(inode string) (string, error) {
+	target := "socket:[" + inode + "]"
+	if item := r.sockets.Get(inode); item != nil && !item.Expired() {
+		fdPath := item.Value().(string)
+		if link, err := os.Readlink(filepath.Join(r.Root, fdPath)); err == nil && link == target {
+			pid, _, _ := strings.Cut(fdPath, "/")
+			return pid, nil
+		}
+		r.sockets.Delete(inode)
+	}
+
+	entries, err := os.ReadDir(r.Root)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	for _, entry := range entries {
+		pid := entry.Name()
+		if _, err := strconv.Atoi(pid); err != nil || r.isHostProcess(pid) {
+			continue
+		}
+		fdDir := filepath.Join(r.Root, pid, "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			// The process exited or isn't readable
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && link == target {
+				r.sockets.Set(inode, filepath.Join(pid, "fd", fd.Name()), socketCacheTTL)
+				return pid, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no process of a pod found for socket inode %s", inode)
+}
+
+// isHostProcess returns whether the process doesn't run in a pod, remembering the processes not running
+// in a pod for a short time.
+func (r *Resolver) isHostProcess(pid string) bool {
+	if item := r.hostProcesses.Get(pid); item != nil && !item.Expired() {
+		return true
+	}
+	data, err := os.ReadFile(filepath.Join(r.Root, pid, "cgroup"))
+	if err != nil {
+		// The process exited, its fds are not readable either
+		return false
+	}
+	if !podUIDRegexp.Match(data) {
+		r.hostProcesses.Set(pid, true, cgroupCacheTTL)
+		return true
+	}
+	return false
+}
+
+// podUIDForPID extracts the pod UID from the cgroups of a process.
+func (r *Resolver) podUIDForPID(pid string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(r.Root, pid, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	match := podUIDRegexp.FindSubmatch(data)
+	if match == nil {
+		return "", fmt.Errorf("process %s is not running in a pod", pid)
+	}
+	return strings.ReplaceAll(string(match[1]), "_", "-"), nil
+}
+
+// NewResolver returns a new Resolver for the procfs mounted at root.
+func NewResolver(root string) *Resolver {
+	if root == "" {
+		root = DefaultRoot
+	}
+	return &Resolver{
+		Root:          root,
+		sockets:       ccache.New(ccache.Configure()),
+		hostProcesses: ccache.New(ccache.Configure()),
+	}
+}
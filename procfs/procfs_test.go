@@ -0,0 +1,187 @@
+package procfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const tcpHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+
+// newFakeProc builds a procfs tree with a hostNetwork pod process connected from 192.168.0.10:41000,
+// a node process connected from [::ffff:192.168.0.10]:42000 and an idle process.
+func newFakeProc(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+
+	write := func(path, content string) {
+		t.Helper()
+		full := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	socket := func(pid, fd, inode string) {
+		t.Helper()
+		dir := filepath.Join(root, pid, "fd")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("socket:["+inode+"]", filepath.Join(dir, fd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("net/tcp", tcpHeader+
+		"   0: 0A00A8C0:A028 0A00A8C0:1FF5 01 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 20 4 30 10 -1\n"+
+		"   1: 00000000:1FF5 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1000 1 0000000000000000 100 0 0 10 0\n")
+	write("net/tcp6", tcpHeader+
+		"   0: 0000000000000000FFFF00000A00A8C0:A410 0000000000000000FFFF00000A00A8C0:1FF5 01 00000000:00000000 00:00000000 00000000     0        0 2002 1 0000000000000000 20 4 30 10 -1\n")
+
+	write("123/cgroup", "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod3f1c2a7e_8d4b_4c3a_9e2f_1a2b3c4d5e6f.slice/cri-containerd-abc.scope\n")
+	socket("123", "3", "1001")
+	write("456/cgroup", "12:pids:/system.slice/kubelet.service\n0::/system.slice/kubelet.service\n")
+	socket("456", "7", "2002")
+	write("789/cgroup", "0::/kubepods/besteffort/pod9b8a7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d/abc\n")
+	write("self/cgroup", "0::/\n")
+	return root
+}
+
+func TestPodUID(t *testing.T) {
+	r := NewResolver(newFakeProc(t))
+
+	uid, err := r.PodUID("192.168.0.10", 41000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if uid != "3f1c2a7e-8d4b-4c3a-9e2f-1a2b3c4d5e6f" {
+		t.Errorf("expected pod UID from systemd cgroup, got %q", uid)
+	}
+}
+
+func TestPodUIDErrors(t *testing.T) {
+	r := NewResolver(newFakeProc(t))
+
+	tests := []struct {
+		name string
+		ip   string
+		port int
+	}{
+		{name: "invalid IP", ip: "not-an-ip", port: 41000},
+		{name: "no socket", ip: "192.168.0.10", port: 43000},
+		{name: "process not in a pod", ip: "192.168.0.10", port: 42000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid, err := r.PodUID(tt.ip, tt.port)
+			if err == nil {
+				t.Errorf("expected error, got UID %q", uid)
+			}
+			if errors.Is(err, ErrUnavailable) {
+				t.Errorf("expected the socket owner to be identified, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPodUIDUnavailable(t *testing.T) {
+	r := NewResolver(t.TempDir())
+
+	if _, err := r.PodUID("192.168.0.10", 41000); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable without tcp tables, got %v", err)
+	}
+}
+
+func TestPidForInodeCache(t *testing.T) {
+	root := newFakeProc(t)
+	r := NewResolver(root)
+
+	pid, err := r.pidForInode("1001")
+	if err != nil || pid != "123" {
+		t.Fatalf("expected process 123, got %q: %v", pid, err)
+	}
+	if item := r.sockets.Get("1001"); item == nil || item.Value() != filepath.Join("123", "fd", "3") {
+		t.Errorf("expected the fd holding the socket to be remembered, got %v", item)
+	}
+
+	// The remembered fd is checked before being used
+	if err := os.Remove(filepath.Join(root, "123", "fd", "3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "124", "fd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "124", "cgroup"), []byte("0::/kubepods/besteffort/pod9b8a7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d/abc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("socket:[1001]", filepath.Join(root, "124", "fd", "5")); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := r.pidForInode("1001"); err != nil || pid != "124" {
+		t.Errorf("expected process 124 once the remembered fd is closed, got %q: %v", pid, err)
+	}
+}
+
+func TestPidForInodeSkipsHostProcesses(t *testing.T) {
+	r := NewResolver(newFakeProc(t))
+
+	// The socket is held by the kubelet, whose fds are not scanned
+	if pid, err := r.pidForInode("2002"); err == nil {
+		t.Errorf("expected no process of a pod, got %q", pid)
+	}
+	if item := r.hostProcesses.Get("456"); item == nil {
+		t.Error("expected the kubelet to be remembered as a host process")
+	}
+	if item := r.hostProcesses.Get("123"); item != nil {
+		t.Error("expected the pod process not to be remembered as a host process")
+	}
+}
+
+func TestPodUIDForPIDCgroupfs(t *testing.T) {
+	r := NewResolver(newFakeProc(t))
+
+	uid, err := r.podUIDForPID("789")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if uid != "9b8a7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d" {
+		t.Errorf("expected pod UID from cgroupfs path, got %q", uid)
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		ip   string
+		port int
+		err  bool
+	}{
+		{addr: "0100007F:1F90", ip: "127.0.0.1", port: 8080},
+		{addr: "0000000000000000FFFF00000A00A8C0:A410", ip: "192.168.0.10", port: 42000},
+		{addr: "00000000000000000000000001000000:0050", ip: "::1", port: 80},
+		{addr: "0100007F", err: true},
+		{addr: "ZZ00007F:1F90", err: true},
+		{addr: "0100007F:ZZZZ", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			ip, port, err := parseAddr(tt.addr)
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected error, got %s:%d", ip, port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ip.String() != tt.ip || port != tt.port {
+				t.Errorf("expected %s:%d, got %s:%d", tt.ip, tt.port, ip, port)
+			}
+		})
+	}
+}
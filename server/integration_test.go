@@ -97,6 +97,14 @@ func (s *integStore) PodByIP(ip string) (*v1.Pod, error) {
 	}
 	return nil, errors.New("pod not found for IP " + ip)
 }
+func (s *integStore) PodByUID(uid string) (*v1.Pod, error) {
+	for _, pod := range s.pods {
+		if string(pod.UID) == uid {
+			return pod, nil
+		}
+	}
+	return nil, errors.New("pod not found for UID " + uid)
+}
 func (s *integStore) ListNamespaces() []string {
 	names := make([]string, 0, len(s.namespaces))
 	for name := range s.namespaces {
@@ -110,6 +118,9 @@ func (s *integStore) NamespaceByName(name string) (*v1.Namespace, error) {
 	}
 	return nil, errors.New("namespace not found: " + name)
 }
+func (s *integStore) NodeByName(name string) (*v1.Node, error) {
+	return nil, errors.New("node not found: " + name)
+}
 
 func newIntegServer(store *integStore, baseARN string, creds *iam.Credentials, stsErr error, nsRestriction bool) *Server {
 	iamClient := integrationIAMClient(baseARN, creds, stsErr)
@@ -342,6 +353,10 @@ func (c *countingSTSClient) AssumeRole(ctx context.Context, params *sts.AssumeRo
 	return c.delegate.AssumeRole(ctx, params, optFns...)
 }
 
+func (c *countingSTSClient) GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	return c.delegate.GetCallerIdentity(ctx, params, optFns...)
+}
+
 // TestIntegErrorCaching ensures that STS errors are cached.
 func TestIntegErrorCaching(t *testing.T) {
 	const (
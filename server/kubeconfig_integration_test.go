@@ -7,9 +7,9 @@ import (
 )
 
 func TestRunKubeconfigError(t *testing.T) {
-	s := NewServer()
 	// Pass a non-existent kubeconfig
-	err := s.Run("/tmp/non-existent-kubeconfig", "", "", "node", false)
+	s := NewServer(WithKubeconfig("/tmp/non-existent-kubeconfig", ""))
+	err := s.Run(t.Context())
 	if err != nil {
 		// This is expected as the file doesn't exist
 		return
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"github.com/jtblin/kube2iam/authz"
+	"github.com/jtblin/kube2iam/iam"
+	"github.com/jtblin/kube2iam/k8s"
+)
+
+// Option configures a Server created with NewServer.
+type Option func(*Server)
+
+// WithAppPort serves the metadata API on the given port.
+func WithAppPort(port string) Option {
+	return func(s *Server) {
+		s.AppPort = port
+		s.MetricsPort = port
+	}
+}
+
+// WithMetricsPort serves the metrics on a port other than the app port.
+func WithMetricsPort(port string) Option {
+	return func(s *Server) {
+		s.MetricsPort = port
+	}
+}
+
+// WithNode maps the pods of the given node, with the host IP used to proxy the metadata API.
+func WithNode(nodeName, hostIP string) Option {
+	return func(s *Server) {
+		s.NodeName = nodeName
+		s.HostIP = hostIP
+	}
+}
+
+// WithKubeconfig connects to the api server with the given kubeconfig and context, the current
+// context being used when empty.
+func WithKubeconfig(path, context string) Option {
+	return func(s *Server) {
+		s.KubeconfigPath = path
+		s.KubeconfigContext = context
+	}
+}
+
+// WithBaseRoleARN prefixes the roles not given as ARNs with the base ARN.
+func WithBaseRoleARN(baseARN string) Option {
+	return func(s *Server) {
+		s.BaseRoleARN = baseARN
+	}
+}
+
+// WithDefaultRole issues the default role to pods without a role annotation.
+func WithDefaultRole(role string) Option {
+	return func(s *Server) {
+		s.DefaultIAMRole = role
+	}
+}
+
+// WithRoleKey reads the role of pods from the given annotation.
+func WithRoleKey(key string) Option {
+	return func(s *Server) {
+		s.IAMRoleKey = key
+	}
+}
+
+// WithNamespaceRestriction restricts the roles of pods to the roles allowed by the annotation of
+// their namespace.
+func WithNamespaceRestriction(namespaceKey string) Option {
+	return func(s *Server) {
+		s.NamespaceRestriction = true
+		s.NamespaceKey = namespaceKey
+	}
+}
+
+// WithKubernetesClient uses the given client instead of connecting to the api server on Start.
+func WithKubernetesClient(client *k8s.Client) Option {
+	return func(s *Server) {
+		s.k8s = client
+	}
+}
+
+// WithIAMClient uses the given client instead of creating one on Start.
+func WithIAMClient(client *iam.Client) Option {
+	return func(s *Server) {
+		s.iam = client
+	}
+}
+
+// WithCredentialsProvider issues credentials with the given provider instead of the IAM client,
+// e.g. to share a credentials cache with the embedding process.
+func WithCredentialsProvider(provider iam.CredentialsProvider) Option {
+	return func(s *Server) {
+		s.credentials = provider
+	}
+}
+
+// WithAuthorizer consults the given authorizer before issuing credentials instead of the webhook.
+func WithAuthorizer(authorizer authz.Authorizer) Option {
+	return func(s *Server) {
+		s.authorizer = authorizer
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jtblin/kube2iam/iam"
+	"github.com/jtblin/kube2iam/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Preflight checks that the node identity can be used to assume roles before serving requests, so that a
+// misconfigured node role is reported at startup rather than when the first pod asks for credentials. It
+// gets the node identity from STS, checks that it is in the account of the base role ARN and assumes the
+// canary role when set. The checks are then run again periodically by the preflight readiness check, and
+// their result reported by the kube2iam_preflight_check_status metric. The returned error lets the caller
+// refuse to start on failure.
+func (s *Server) Preflight(ctx context.Context) error {
+	if err := s.initIAMClient(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	identity, err := s.preflightChecks(ctx)
+	if identity != "" {
+		log.Infof("Assuming roles with the node identity %s", identity)
+		if accountErr := s.checkAccount(identity); accountErr != nil && !s.PreflightStrict {
+			log.Warnf("%s, roles given by name are assumed in another account", accountErr)
+		}
+	}
+	s.preflightOnce.Do(func() {
+		s.readiness.Register("preflight", preflightCheckInterval, func(ctx context.Context) error {
+			_, err := s.preflightChecks(ctx)
+			return err
+		})
+	})
+	return err
+}
+
+// preflightChecks runs the preflight checks, records their result and returns the node identity. A node
+// identity out of the account of the base role ARN only fails the checks with PreflightStrict, as nodes
+// may assume roles of other accounts.
+func (s *Server) preflightChecks(ctx context.Context) (string, error) {
+	var errs []error
+	identity, err := s.iam.CallerIdentity(ctx)
+	recordPreflight("caller_identity", err)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("error getting the node identity: %w", err))
+	} else if s.BaseRoleARN != "" {
+		err = s.checkAccount(identity)
+		recordPreflight("base_role_account", err)
+		if err != nil && s.PreflightStrict {
+			errs = append(errs, err)
+		}
+	}
+	if s.PreflightCanaryRole != "" {
+		roleARN := s.iam.RoleARN(s.PreflightCanaryRole)
+		err = s.iam.CheckAssumeRole(ctx, roleARN, s.HostIP)
+		recordPreflight("canary_assume_role", err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error assuming the canary role %s: %w", roleARN, err))
+		}
+	}
+	return identity, errors.Join(errs...)
+}
+
+// checkAccount returns an error when the node identity is not in the account of the base role ARN.
+func (s *Server) checkAccount(identity string) error {
+	if s.BaseRoleARN == "" {
+		return nil
+	}
+	identityAccount, ok := iam.AccountID(identity)
+	if !ok {
+		return fmt.Errorf("invalid node identity %s", identity)
+	}
+	baseAccount, ok := iam.AccountID(s.BaseRoleARN)
+	if !ok {
+		return fmt.Errorf("invalid base role ARN %s", s.BaseRoleARN)
+	}
+	if identityAccount != baseAccount {
+		return fmt.Errorf("node identity %s is in account %s, not in the account %s of the base role ARN", identity, identityAccount, baseAccount)
+	}
+	return nil
+}
+
+func recordPreflight(check string, err error) {
+	status := 1.0
+	if err != nil {
+		status = 0
+	}
+	metrics.PreflightCheckStatus.WithLabelValues(check).Set(status)
+}
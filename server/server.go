@@ -1,26 +1,39 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/cenk/backoff"
 	"github.com/gorilla/mux"
 	"github.com/jtblin/kube2iam"
+	"github.com/jtblin/kube2iam/authz"
+	"github.com/jtblin/kube2iam/health"
 	"github.com/jtblin/kube2iam/iam"
+	"github.com/jtblin/kube2iam/iptables"
 	"github.com/jtblin/kube2iam/k8s"
 	"github.com/jtblin/kube2iam/mappings"
 	"github.com/jtblin/kube2iam/metrics"
+	"github.com/jtblin/kube2iam/policy"
+	"github.com/jtblin/kube2iam/procfs"
 	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/tools/cache"
 )
 
@@ -40,13 +53,27 @@ const (
 	defaultCacheResyncPeriod          = 30 * time.Minute
 	defaultResolveDupIPs              = false
 	defaultNamespaceRestrictionFormat = "glob"
+	defaultAuthzWebhookTimeout        = 2 * time.Second
+	defaultAuthzWebhookCacheTTL       = 1 * time.Minute
+	defaultNamespaceExternalIDKey     = "iam.amazonaws.com/external-id"
+	defaultGrantExpiryWindow          = 24 * time.Hour
+	defaultPodLookupWait              = 1 * time.Second
+	defaultAPITimeout                 = 5 * time.Second
+	defaultInformerStaleThreshold     = 15 * time.Minute
+	defaultShutdownTimeout            = 10 * time.Second
+	defaultShutdownDelay              = 5 * time.Second
 	healthcheckInterval               = 30 * time.Second
+	preflightTimeout                  = 30 * time.Second
+	preflightCheckInterval            = 5 * time.Minute
+	stsCheckInterval                  = 1 * time.Minute
+	iptablesCheckInterval             = 1 * time.Minute
+	grantExpiryCheckInterval          = 1 * time.Minute
 )
 
-var tokenRouteRegexp = regexp.MustCompile("^/?[^/]+/api/token$")
+// DefaultIPv6MetadataAddress is the address of the instance metadata service on IPv6-only nodes.
+const DefaultIPv6MetadataAddress = "fd00:ec2::254"
 
-// Keeps track of the names of registered handlers for metric value/label initialization
-var registeredHandlerNames []string
+var tokenRouteRegexp = regexp.MustCompile("^/?[^/]+/api/token$")
 
 // Server encapsulates all of the parameters necessary for starting up
 // the server. These can either be set via command line or directly.
@@ -54,6 +81,14 @@ type Server struct {
 	KubeconfigPath             string
 	APIServer                  string
 	APIToken                   string
+	APITokenFile               string
+	APIClientCertFile          string
+	APIClientKeyFile           string
+	APICAFile                  string
+	APIQPS                     float32
+	APIBurst                   int
+	APITimeout                 time.Duration
+	KubeconfigContext          string
 	AppPort                    string
 	MetricsPort                string
 	BaseRoleARN                string
@@ -71,6 +106,33 @@ type Server struct {
 	LogLevel                   string
 	LogFormat                  string
 	NamespaceRestrictionFormat string
+	PolicyFile                 string
+	RoleAliasConfigMap         string
+	RoleTemplate               string
+	NamespaceBaseARNKey        string
+	AllowedAccountIDs          []string
+	ExternalIDSource           string
+	NamespaceExternalIDKey     string
+	ExternalIDSaltFile         string
+	ExternalIDStrict           bool
+	OptOutRoleValue            string
+	StrictNamespaceSelector    string
+	NamespaceSelector          string
+	AuthzWebhookURL            string
+	AuthzWebhookTimeout        time.Duration
+	AuthzWebhookCacheTTL       time.Duration
+	GrantExpiryWindow          time.Duration
+	ProcfsRoot                 string
+	PodLookupWait              time.Duration
+	InformerStaleThreshold     time.Duration
+	ShutdownTimeout            time.Duration
+	ShutdownDelay              time.Duration
+	PreflightCanaryRole        string
+	AuthzWebhookFailOpen       bool
+	PreflightEnabled           bool
+	PreflightStrict            bool
+	HostNetworkAttribution     bool
+	PodAPILookup               bool
 	ResolveDupIPs              bool
 	UseRegionalStsEndpoint     bool
 	AddIPTablesRule            bool
@@ -79,16 +141,24 @@ type Server struct {
 	Debug                      bool
 	Insecure                   bool
 	NamespaceRestriction       bool
+	NamespaceRestrictionAudit  bool
 	Verbose                    bool
 	Version                    bool
 	iam                        *iam.Client
+	credentials                iam.CredentialsProvider
 	k8s                        *k8s.Client
 	roleMapper                 *mappings.RoleMapper
+	authorizer                 authz.Authorizer
 	BackoffMaxElapsedTime      time.Duration
 	BackoffMaxInterval         time.Duration
 	InstanceID                 string
 	HealthcheckFailReason      string
-	healthcheckTicker          *time.Ticker
+	shuttingDown               atomic.Bool
+	cacheSynced                []cache.InformerSynced
+	checksOnce                 sync.Once
+	preflightOnce              sync.Once
+	readiness                  *health.Registry
+	liveness                   *health.Registry
 }
 
 type appHandlerFunc func(*log.Entry, http.ResponseWriter, *http.Request)
@@ -157,7 +227,6 @@ func (h *appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func newAppHandler(name string, fn appHandlerFunc) *appHandler {
-	registeredHandlerNames = append(registeredHandlerNames, name)
 	return &appHandler{name: name, fn: fn}
 }
 
@@ -168,19 +237,60 @@ func parseRemoteAddr(addr string) string {
 		host = addr
 	}
 
-	ip := net.ParseIP(host)
-	if ip == nil {
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
 		return ""
 	}
 
-	return ip.String()
+	// Connections accepted on a dual-stack socket report IPv4 clients as IPv4-mapped IPv6 addresses
+	return ip.Unmap().WithZone("").String()
+}
+
+// parseRemotePort returns the source port of a remote address, or 0 when it has none.
+func parseRemotePort(addr string) int {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return 0
+	}
+	return p
 }
 
-func (s *Server) getRoleMapping(IP string) (*mappings.RoleMappingResult, error) {
+// isPermanentMappingError returns whether a mapping error is answered immediately, as the pod
+// is known and retrying can't change the answer, or the pod lookup fallback already waited for the pod.
+func isPermanentMappingError(err error) bool {
+	return errors.Is(err, kube2iam.ErrPodNotFound) ||
+		errors.Is(err, mappings.ErrRoleOptOut) ||
+		errors.Is(err, mappings.ErrStrictNamespace) ||
+		errors.Is(err, mappings.ErrNoRole) ||
+		errors.Is(err, mappings.ErrExternalIDMismatch)
+}
+
+// pollGrantExpiry periodically reports grants nearing expiry and evicts the credentials of expired grants.
+func (s *Server) pollGrantExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.roleMapper.CheckGrantExpiry(s.GrantExpiryWindow)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) getRoleMapping(IP string, port int) (*mappings.RoleMappingResult, error) {
 	var roleMapping *mappings.RoleMappingResult
 	var err error
 	operation := func() error {
-		roleMapping, err = s.roleMapper.GetRoleMapping(IP)
+		roleMapping, err = s.roleMapper.GetRoleMappingForConnection(IP, port)
+		if isPermanentMappingError(err) {
+			return backoff.Permanent(err)
+		}
 		return err
 	}
 
@@ -189,6 +299,8 @@ func (s *Server) getRoleMapping(IP string) (*mappings.RoleMappingResult, error)
 	expBackoff.MaxElapsedTime = s.BackoffMaxElapsedTime
 
 	err = backoff.Retry(operation, expBackoff)
+	// The outcome is recorded once the request is answered, not for every attempt
+	metrics.RoleMappingOutcomeCount.WithLabelValues(mappings.MappingOutcome(roleMapping, err)).Inc()
 	if err != nil {
 		return nil, err
 	}
@@ -196,11 +308,14 @@ func (s *Server) getRoleMapping(IP string) (*mappings.RoleMappingResult, error)
 	return roleMapping, nil
 }
 
-func (s *Server) getExternalIDMapping(IP string) (string, error) {
+func (s *Server) getExternalIDMapping(IP string, port int) (string, error) {
 	var externalID string
 	var err error
 	operation := func() error {
-		externalID, err = s.roleMapper.GetExternalIDMapping(IP)
+		externalID, err = s.roleMapper.GetExternalIDMappingForConnection(IP, port)
+		if isPermanentMappingError(err) {
+			return backoff.Permanent(err)
+		}
 		return err
 	}
 
@@ -216,17 +331,21 @@ func (s *Server) getExternalIDMapping(IP string) (string, error) {
 	return externalID, nil
 }
 
-func (s *Server) beginPollHealthcheck(interval time.Duration) {
-	if s.healthcheckTicker == nil {
-		s.doHealthcheck()
-		s.healthcheckTicker = time.NewTicker(interval)
-		go func() {
-			for {
-				<-s.healthcheckTicker.C
+// beginPollHealthcheck performs the healthcheck, and then repeats it in the background until the context is done.
+func (s *Server) beginPollHealthcheck(ctx context.Context, interval time.Duration) {
+	s.doHealthcheck()
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
 				s.doHealthcheck()
 			}
-		}()
-	}
+		}
+	}()
 }
 
 func (s *Server) doHealthcheck() {
@@ -254,6 +373,13 @@ func (s *Server) doHealthcheck() {
 	}
 
 	s.InstanceID = string(instanceId)
+
+	if s.k8s != nil {
+		if stale := s.k8s.StaleInformers(); len(stale) > 0 {
+			errMsg = fmt.Sprintf("Stale informers %s, no activity for more than %s", strings.Join(stale, ", "), s.InformerStaleThreshold)
+			log.Error(errMsg)
+		}
+	}
 }
 
 // HealthResponse represents a response for the health check.
@@ -267,6 +393,10 @@ func (s *Server) healthHandler(logger *log.Entry, w http.ResponseWriter, r *http
 	// The healthcheck logic is performed in doHealthcheck and saved into Server struct fields.
 	// This "caching" of results allows the healthcheck to be monitored at a high request rate by external systems
 	// without fear of overwhelming any rate limits with AWS or other dependencies.
+	if s.shuttingDown.Load() {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	if len(s.HealthcheckFailReason) > 0 {
 		http.Error(w, s.HealthcheckFailReason, http.StatusInternalServerError)
 		return
@@ -294,7 +424,7 @@ func (s *Server) debugStoreHandler(logger *log.Entry, w http.ResponseWriter, r *
 func (s *Server) securityCredentialsHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Server", "EC2ws")
 	remoteIP := parseRemoteAddr(r.RemoteAddr)
-	roleMapping, err := s.getRoleMapping(remoteIP)
+	roleMapping, err := s.getRoleMapping(remoteIP, parseRemotePort(r.RemoteAddr))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -302,8 +432,12 @@ func (s *Server) securityCredentialsHandler(logger *log.Entry, w http.ResponseWr
 
 	// If a base ARN has been supplied and this is not cross-account then
 	// return a simple role-name, otherwise return the full ARN
-	if s.iam.BaseARN != "" && strings.HasPrefix(roleMapping.Role, s.iam.BaseARN) {
-		write(logger, w, strings.TrimPrefix(roleMapping.Role, s.iam.BaseARN))
+	baseARN := roleMapping.BaseARN
+	if baseARN == "" {
+		baseARN = s.iam.BaseARN
+	}
+	if baseARN != "" && strings.HasPrefix(roleMapping.Role, baseARN) {
+		write(logger, w, strings.TrimPrefix(roleMapping.Role, baseARN))
 		return
 	}
 	write(logger, w, roleMapping.Role)
@@ -312,14 +446,19 @@ func (s *Server) securityCredentialsHandler(logger *log.Entry, w http.ResponseWr
 func (s *Server) roleHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Server", "EC2ws")
 	remoteIP := parseRemoteAddr(r.RemoteAddr)
+	remotePort := parseRemotePort(r.RemoteAddr)
 
-	roleMapping, err := s.getRoleMapping(remoteIP)
+	roleMapping, err := s.getRoleMapping(remoteIP, remotePort)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	externalID, err := s.getExternalIDMapping(remoteIP)
+	externalID, err := s.getExternalIDMapping(remoteIP, remotePort)
+	if errors.Is(err, mappings.ErrExternalIDMismatch) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -329,18 +468,38 @@ func (s *Server) roleHandler(logger *log.Entry, w http.ResponseWriter, r *http.R
 		"pod.iam.role": roleMapping.Role,
 		"ns.name":      roleMapping.Namespace,
 	})
+	if roleMapping.PolicyRule != "" {
+		roleLogger = roleLogger.WithField("policy.rule", roleMapping.PolicyRule)
+	}
 
 	wantedRole := mux.Vars(r)["role"]
-	wantedRoleARN := s.iam.RoleARN(wantedRole)
+	wantedRoleARN := s.iam.RoleARNWithBase(roleMapping.BaseARN, wantedRole)
 
-	if wantedRoleARN != roleMapping.Role {
+	if !roleMapping.Permits(wantedRoleARN) {
 		roleLogger.WithField("params.iam.role", wantedRole).
-			Error("Invalid role: does not match annotated role")
+			Error("Invalid role: does not match annotated roles")
 		http.Error(w, fmt.Sprintf("Invalid role %s", wantedRole), http.StatusForbidden)
 		return
 	}
 
-	credentials, err := s.iam.AssumeRole(wantedRoleARN, externalID, remoteIP, s.IAMRoleSessionTTL, s.IAMRoleErrorTTL)
+	if s.authorizer != nil {
+		decision := s.authorizer.Authorize(authz.Request{
+			Pod:            roleMapping.PodName,
+			Namespace:      roleMapping.Namespace,
+			ServiceAccount: roleMapping.ServiceAccount,
+			Role:           wantedRoleARN,
+			ExternalID:     externalID,
+			Node:           roleMapping.NodeName,
+		})
+		if !decision.Allowed {
+			roleLogger.WithField("authz.reason", decision.Reason).
+				Error("Role denied by authorization webhook")
+			http.Error(w, fmt.Sprintf("Role %s denied by authorization webhook: %s", wantedRole, decision.Reason), http.StatusForbidden)
+			return
+		}
+	}
+
+	credentials, err := s.credentialsProvider().AssumeRole(wantedRoleARN, externalID, remoteIP, s.IAMRoleSessionTTL, s.IAMRoleErrorTTL)
 	if err != nil {
 		roleLogger.Errorf("Error assuming role %+v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -362,7 +521,7 @@ func (s *Server) reverseProxyHandler(logger *log.Entry, w http.ResponseWriter, r
 		r.RemoteAddr = ""
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: s.MetadataAddress})
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: iam.MetadataHost(s.MetadataAddress)})
 	proxy.ServeHTTP(w, r)
 	logger.WithField("metadata.url", s.MetadataAddress).Debug("Proxy ec2 metadata request")
 }
@@ -373,34 +532,306 @@ func write(logger *log.Entry, w http.ResponseWriter, s string) {
 	}
 }
 
-// Run runs the specified Server.
-func (s *Server) Run(kubeconfigPath, host, token, nodeName string, insecure bool) error {
-	k, err := k8s.NewClient(kubeconfigPath, host, token, nodeName, insecure, s.ResolveDupIPs)
+// roleMapperOptions validates the role mapping flags and returns the matching role mapper options.
+func (s *Server) roleMapperOptions() ([]mappings.Option, error) {
+	var roleTemplate *template.Template
+	if s.RoleTemplate != "" {
+		var err error
+		roleTemplate, err = mappings.ParseRoleTemplate(s.RoleTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid role template %q: %s", s.RoleTemplate, err)
+		}
+	}
+	if _, err := labels.Parse(s.NamespaceSelector); err != nil {
+		return nil, fmt.Errorf("invalid namespace selector %q: %s", s.NamespaceSelector, err)
+	}
+	var strictNamespaces labels.Selector
+	if s.StrictNamespaceSelector != "" {
+		var err error
+		strictNamespaces, err = labels.Parse(s.StrictNamespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid strict namespace selector %q: %s", s.StrictNamespaceSelector, err)
+		}
+	}
+	externalIDOption, err := s.externalIDOption()
+	if err != nil {
+		return nil, err
+	}
+	var socketResolver mappings.PodUIDResolver
+	if s.HostNetworkAttribution {
+		if s.HostIP == "" {
+			return nil, fmt.Errorf("hostNetwork attribution requires --host-ip")
+		}
+		socketResolver = procfs.NewResolver(s.ProcfsRoot)
+	}
+	return []mappings.Option{
+		mappings.WithNamespaceRestrictionAudit(s.NamespaceRestrictionAudit),
+		mappings.WithRoleTemplate(roleTemplate),
+		mappings.WithNamespaceBaseARN(s.NamespaceBaseARNKey),
+		mappings.WithAllowedAccounts(s.AllowedAccountIDs),
+		mappings.WithOptOutValue(s.OptOutRoleValue),
+		mappings.WithStrictNamespaces(strictNamespaces),
+		mappings.WithSocketAttribution(socketResolver, s.HostIP),
+		externalIDOption,
+	}, nil
+}
+
+// externalIDOption validates the external ID source and loads the salt of derived external IDs.
+func (s *Server) externalIDOption() (mappings.Option, error) {
+	if !mappings.ValidExternalIDSource(s.ExternalIDSource) {
+		return nil, fmt.Errorf("invalid external ID source %q, expected %q, %q or %q", s.ExternalIDSource,
+			mappings.ExternalIDSourcePod, mappings.ExternalIDSourceNamespace, mappings.ExternalIDSourceDerived)
+	}
+	var salt []byte
+	if s.ExternalIDSource == mappings.ExternalIDSourceDerived {
+		if s.ExternalIDSaltFile == "" {
+			return nil, fmt.Errorf("derived external IDs require --external-id-salt-file")
+		}
+		data, err := os.ReadFile(s.ExternalIDSaltFile)
+		if err != nil {
+			return nil, err
+		}
+		salt = bytes.TrimSpace(data)
+		if len(salt) == 0 {
+			return nil, fmt.Errorf("external ID salt file %s is empty", s.ExternalIDSaltFile)
+		}
+	}
+	return mappings.WithExternalIDSource(s.ExternalIDSource, s.NamespaceExternalIDKey, salt, s.ExternalIDStrict), nil
+}
+
+// needsNamespaces returns whether a feature reads namespaces, which are only watched then.
+func (s *Server) needsNamespaces(rolePolicy *policy.Policy) bool {
+	return s.NamespaceRestriction ||
+		s.NamespaceRestrictionAudit ||
+		s.NamespaceBaseARNKey != "" ||
+		s.ExternalIDSource == mappings.ExternalIDSourceNamespace ||
+		s.StrictNamespaceSelector != "" ||
+		rolePolicy != nil
+}
+
+// podAnnotationKeys returns the pod annotations to cache, all of them when a policy may read them.
+func (s *Server) podAnnotationKeys(rolePolicy *policy.Policy) []string {
+	if rolePolicy != nil {
+		return nil
+	}
+	return []string{s.IAMRoleKey, s.IAMExternalID}
+}
+
+// credentialsProvider returns the provider issuing credentials, the IAM client unless set with an option.
+func (s *Server) credentialsProvider() iam.CredentialsProvider {
+	if s.credentials != nil {
+		return s.credentials
+	}
+	return s.iam
+}
+
+// initClients creates the kubernetes and IAM clients not provided with options.
+func (s *Server) initClients() error {
+	if s.k8s == nil {
+		k, err := k8s.NewClient(k8s.ClientOptions{
+			KubeconfigPath:    s.KubeconfigPath,
+			KubeconfigContext: s.KubeconfigContext,
+			Host:              s.APIServer,
+			Token:             s.APIToken,
+			TokenFile:         s.APITokenFile,
+			CertFile:          s.APIClientCertFile,
+			KeyFile:           s.APIClientKeyFile,
+			CAFile:            s.APICAFile,
+			Insecure:          s.Insecure,
+			QPS:               s.APIQPS,
+			Burst:             s.APIBurst,
+			Timeout:           s.APITimeout,
+			NodeName:          s.NodeName,
+			ResolveDupIPs:     s.ResolveDupIPs,
+		})
+		if err != nil {
+			return err
+		}
+		s.k8s = k
+	}
+	s.k8s.EnablePodLookupFallback(s.PodLookupWait, s.PodAPILookup)
+	s.k8s.EnableStalenessDetection(s.InformerStaleThreshold)
+	return s.initIAMClient()
+}
+
+// initIAMClient creates the IAM client when not provided with an option.
+func (s *Server) initIAMClient() error {
+	if s.iam == nil {
+		s.iam = iam.NewClient(s.BaseRoleARN, s.UseRegionalStsEndpoint)
+	}
+	if s.iam.IMDS == nil {
+		var err error
+		s.iam.IMDS, err = iam.NewIMDSClient(s.MetadataAddress)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run starts the Server and serves requests until the context is done, and then shuts it down gracefully.
+func (s *Server) Run(ctx context.Context) error {
+	// Informers and background jobs keep running while requests are served during the shutdown, and are
+	// stopped when Run returns, or when the context is done before the server is started.
+	jobsCtx, stopJobs := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopJobs()
+	stopBeforeStart := context.AfterFunc(ctx, stopJobs)
+	err := s.Start(jobsCtx)
+	stopBeforeStart()
 	if err != nil {
 		return err
 	}
-	s.k8s = k
-	s.iam = iam.NewClient(s.BaseRoleARN, s.UseRegionalStsEndpoint)
-	log.Debugln("Caches have been synced.  Proceeding with server.")
-	s.roleMapper = mappings.NewRoleMapper(s.IAMRoleKey, s.IAMExternalID, s.DefaultIAMRole, s.NamespaceRestriction, s.NamespaceKey, s.iam, s.k8s, s.NamespaceRestrictionFormat)
-	log.Debugf("Starting pod and namespace sync jobs with %s resync period", s.CacheResyncPeriod.String())
-	podSynched := s.k8s.WatchForPods(kube2iam.NewPodHandler(s.IAMRoleKey), s.CacheResyncPeriod)
-	namespaceSynched := s.k8s.WatchForNamespaces(kube2iam.NewNamespaceHandler(s.NamespaceKey), s.CacheResyncPeriod)
 
+	servers := []*http.Server{{Addr: ":" + s.AppPort, Handler: s.Handler()}}
+	if s.MetricsPort != s.AppPort {
+		servers = append(servers, metrics.NewServer(s.MetricsPort))
+	}
+	return s.serve(ctx, servers...)
+}
+
+// Start creates the clients not provided with options, starts the informers and background jobs until
+// the context is done, and waits for the caches to be synced. Handler serves requests once Start returned.
+func (s *Server) Start(ctx context.Context) error {
+	// The server may be started again after a shutdown
+	s.shuttingDown.Store(false)
+	if err := s.initClients(); err != nil {
+		return err
+	}
+	var rolePolicy *policy.Policy
+	var err error
+	if s.PolicyFile != "" {
+		rolePolicy, err = policy.Load(s.PolicyFile)
+		if err != nil {
+			return err
+		}
+		log.Infof("Loaded role policy from %s", s.PolicyFile)
+	}
+	if s.authorizer == nil && s.AuthzWebhookURL != "" {
+		s.authorizer = authz.NewWebhook(s.AuthzWebhookURL, s.AuthzWebhookTimeout, s.AuthzWebhookFailOpen, s.AuthzWebhookCacheTTL)
+	}
+	var roleAliases *mappings.AliasRegistry
+	var aliasNamespace, aliasName string
+	if s.RoleAliasConfigMap != "" {
+		var ok bool
+		aliasNamespace, aliasName, ok = strings.Cut(s.RoleAliasConfigMap, "/")
+		if !ok || aliasNamespace == "" || aliasName == "" {
+			return fmt.Errorf("invalid role alias configmap %q, expected namespace/name", s.RoleAliasConfigMap)
+		}
+		roleAliases = mappings.NewAliasRegistry()
+	}
+	opts, err := s.roleMapperOptions()
+	if err != nil {
+		return err
+	}
+	opts = append(opts,
+		mappings.WithPolicy(rolePolicy),
+		mappings.WithRoleAliases(roleAliases),
+		mappings.WithCredentialsProvider(s.credentials),
+	)
+	s.roleMapper = mappings.NewRoleMapper(s.IAMRoleKey, s.IAMExternalID, s.DefaultIAMRole, s.NamespaceRestriction, s.NamespaceKey, s.iam, s.k8s, s.NamespaceRestrictionFormat, opts...)
+	log.Debugf("Starting sync jobs with %s resync period", s.CacheResyncPeriod.String())
+	podSynched := s.k8s.WatchForPods(ctx, kube2iam.NewPodHandler(s.IAMRoleKey, s.roleMapper.RevokePodRoles), s.CacheResyncPeriod, s.podAnnotationKeys(rolePolicy))
+
+	cacheSynched := []cache.InformerSynced{podSynched}
+	if s.needsNamespaces(rolePolicy) {
+		namespaceHandler := kube2iam.NewNamespaceHandler(s.NamespaceKey, s.roleMapper.RevokeNamespaceGrants)
+		cacheSynched = append(cacheSynched, s.k8s.WatchForNamespaces(ctx, namespaceHandler, s.CacheResyncPeriod, s.NamespaceSelector))
+	} else {
+		log.Debugln("No feature reads namespaces, not watching namespaces")
+	}
+	if rolePolicy != nil {
+		// Node labels are only needed to evaluate policies
+		cacheSynched = append(cacheSynched, s.k8s.WatchForNodes(ctx, kube2iam.NewNodeHandler(), s.CacheResyncPeriod))
+	}
+	if roleAliases != nil {
+		cacheSynched = append(cacheSynched, s.k8s.WatchForConfigMap(ctx, aliasNamespace, aliasName, roleAliases, s.CacheResyncPeriod))
+	}
+
+	s.cacheSynced = cacheSynched
 	synced := false
-	for i := 0; i < defaultCacheSyncAttempts && !synced; i++ {
-		synced = cache.WaitForCacheSync(nil, podSynched, namespaceSynched)
+	for i := 0; i < defaultCacheSyncAttempts && !synced && ctx.Err() == nil; i++ {
+		synced = cache.WaitForCacheSync(ctx.Done(), cacheSynched...)
 	}
 
 	if !synced {
-		log.Fatalf("Attempted to wait for caches to be synced for %d however it is not done.  Giving up.", defaultCacheSyncAttempts)
-	} else {
-		log.Debugln("Caches have been synced.  Proceeding with server.")
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("attempted to wait for caches to be synced %d times however it is not done, giving up", defaultCacheSyncAttempts)
 	}
+	log.Debugln("Caches have been synced.  Proceeding with server.")
 
 	// Begin healthchecking
-	s.beginPollHealthcheck(healthcheckInterval)
+	s.beginPollHealthcheck(ctx, healthcheckInterval)
+
+	if s.NamespaceRestriction || s.NamespaceRestrictionAudit {
+		go s.pollGrantExpiry(ctx, grantExpiryCheckInterval)
+	}
+
+	s.checksOnce.Do(s.registerChecks)
+	s.readiness.Start(ctx)
+	s.liveness.Start(ctx)
+	return nil
+}
 
+// ReadinessChecks returns the registry of the checks served by /readyz, to register more checks.
+func (s *Server) ReadinessChecks() *health.Registry {
+	return s.readiness
+}
+
+// LivenessChecks returns the registry of the checks served by /livez, to register more checks.
+func (s *Server) LivenessChecks() *health.Registry {
+	return s.liveness
+}
+
+// registerChecks registers the readiness and liveness checks of the server, once for all the runs of the server.
+func (s *Server) registerChecks() {
+	s.readiness.Register("shutdown", 0, func(context.Context) error {
+		if s.shuttingDown.Load() {
+			return errors.New("shutting down")
+		}
+		return nil
+	})
+	s.readiness.Register("cache-synced", 0, func(context.Context) error {
+		for _, synced := range s.cacheSynced {
+			if !synced() {
+				return errors.New("caches not synced")
+			}
+		}
+		return nil
+	})
+	s.readiness.Register("informers-fresh", 0, func(context.Context) error {
+		if stale := s.k8s.StaleInformers(); len(stale) > 0 {
+			return fmt.Errorf("no activity of informers %s for more than %s", strings.Join(stale, ", "), s.InformerStaleThreshold)
+		}
+		return nil
+	})
+	s.readiness.Register("sts", stsCheckInterval, func(ctx context.Context) error {
+		_, err := s.iam.CallerIdentity(ctx)
+		return err
+	})
+	s.readiness.Register("imds", healthcheckInterval, func(context.Context) error {
+		_, err := s.iam.GetInstanceId()
+		return err
+	})
+	if s.AddIPTablesRule {
+		s.readiness.Register("iptables", iptablesCheckInterval, func(context.Context) error {
+			exists, err := iptables.RuleExists(s.AppPort, s.MetadataAddress, s.HostInterface, s.HostIP)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return errors.New("metadata redirect rule missing")
+			}
+			return nil
+		})
+	}
+	s.liveness.Register("ping", 0, func(context.Context) error { return nil })
+}
+
+// Handler returns the http.Handler serving the metadata API, the healthcheck, the debug endpoints when
+// enabled and the metrics when served on the app port.
+func (s *Server) Handler() http.Handler {
 	r := mux.NewRouter()
 	securityHandler := newAppHandler("securityCredentialsHandler", s.securityCredentialsHandler)
 
@@ -414,26 +845,62 @@ func (s *Server) Run(kubeconfigPath, host, token, nodeName string, insecure bool
 		"/{version}/meta-data/iam/security-credentials/{role:.*}",
 		newAppHandler("roleHandler", s.roleHandler))
 	r.Handle("/healthz", newAppHandler("healthHandler", s.healthHandler))
+	r.Handle("/readyz", s.readiness.Handler())
+	r.Handle("/livez", s.liveness.Handler())
 
 	if s.MetricsPort == s.AppPort {
 		r.Handle("/metrics", metrics.GetHandler())
-	} else {
-		metrics.StartMetricsServer(s.MetricsPort)
 	}
 
 	// This has to be registered last so that it catches fall-throughs
 	r.Handle("/{path:.*}", newAppHandler("reverseProxyHandler", s.reverseProxyHandler))
+	return r
+}
 
-	log.Infof("Listening on port %s", s.AppPort)
-	if err := http.ListenAndServe(":"+s.AppPort, r); err != nil {
-		log.Fatalf("Error creating kube2iam http server: %+v", err)
+// serve runs the http servers until the context is done or one of them fails. On shutdown, the
+// healthchecks fail while requests are still served for ShutdownDelay, so that probes observe it, and
+// in-flight requests are then given ShutdownTimeout to complete.
+func (s *Server) serve(ctx context.Context, servers ...*http.Server) error {
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		log.Infof("Listening on %s", srv.Addr)
+		go func(srv *http.Server) {
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errs <- fmt.Errorf("error running http server on %s: %w", srv.Addr, err)
+			}
+		}(srv)
 	}
-	return nil
+
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Infof("Shutting down, waiting up to %s for in-flight requests", s.ShutdownTimeout)
+	case err = <-errs:
+		log.Errorf("Shutting down: %v", err)
+	}
+	s.shuttingDown.Store(true)
+	metrics.HealthcheckStatus.Set(0)
+	if err == nil && s.ShutdownDelay > 0 {
+		log.Infof("Failing the healthchecks for %s before shutting down", s.ShutdownDelay)
+		time.Sleep(s.ShutdownDelay)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if shutdownErr := srv.Shutdown(shutdownCtx); shutdownErr != nil {
+			_ = srv.Close()
+			if err == nil {
+				err = fmt.Errorf("error shutting down http server on %s: %w", srv.Addr, shutdownErr)
+			}
+		}
+	}
+	return err
 }
 
-// NewServer will create a new Server with default values.
-func NewServer() *Server {
-	return &Server{
+// NewServer will create a new Server with default values, and then apply the options.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
 		AppPort:                    defaultAppPort,
 		MetricsPort:                defaultAppPort,
 		BackoffMaxElapsedTime:      defaultMaxElapsedTime,
@@ -450,5 +917,22 @@ func NewServer() *Server {
 		HealthcheckFailReason:      "Healthcheck not yet performed",
 		IAMRoleSessionTTL:          defaultIAMRoleSessionTTL,
 		IAMRoleErrorTTL:            defaultIAMRoleErrorTTL,
+		AuthzWebhookTimeout:        defaultAuthzWebhookTimeout,
+		AuthzWebhookCacheTTL:       defaultAuthzWebhookCacheTTL,
+		GrantExpiryWindow:          defaultGrantExpiryWindow,
+		ProcfsRoot:                 procfs.DefaultRoot,
+		PodLookupWait:              defaultPodLookupWait,
+		APITimeout:                 defaultAPITimeout,
+		InformerStaleThreshold:     defaultInformerStaleThreshold,
+		ShutdownTimeout:            defaultShutdownTimeout,
+		ShutdownDelay:              defaultShutdownDelay,
+		ExternalIDSource:           mappings.ExternalIDSourcePod,
+		NamespaceExternalIDKey:     defaultNamespaceExternalIDKey,
+		readiness:                  health.NewRegistry(),
+		liveness:                   health.NewRegistry(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -18,17 +22,25 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
 	"github.com/gorilla/mux"
+	"github.com/jtblin/kube2iam"
+	"github.com/jtblin/kube2iam/authz"
+	"github.com/jtblin/kube2iam/health"
 	"github.com/jtblin/kube2iam/iam"
+	"github.com/jtblin/kube2iam/k8s"
 	"github.com/jtblin/kube2iam/mappings"
+	"github.com/jtblin/kube2iam/metrics"
+	"github.com/jtblin/kube2iam/policy"
 	"github.com/karlseguin/ccache"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
 // ---- Mock implementations --------------------------------------------------
 
-// mockStore satisfies the mappings.store interface.
+// mockStore satisfies the mappings.Store interface.
 type mockStore struct {
 	pod       *v1.Pod
 	podErr    error
@@ -36,6 +48,7 @@ type mockStore struct {
 	nsErr     error
 	podIPs    []string
 	nsNames   []string
+	node      *v1.Node
 }
 
 func (m *mockStore) ListPodIPs() []string {
@@ -57,18 +70,33 @@ func (m *mockStore) ListNamespaces() []string {
 	return nil
 }
 func (m *mockStore) PodByIP(_ string) (*v1.Pod, error)               { return m.pod, m.podErr }
+func (m *mockStore) PodByUID(_ string) (*v1.Pod, error)              { return m.pod, m.podErr }
 func (m *mockStore) NamespaceByName(_ string) (*v1.Namespace, error) { return m.namespace, m.nsErr }
+func (m *mockStore) NodeByName(_ string) (*v1.Node, error) {
+	if m.node == nil {
+		return nil, errors.New("node not found")
+	}
+	return m.node, nil
+}
 
 // mockSTSClient implements iam.STSClient.
 type mockSTSClient struct {
-	output *sts.AssumeRoleOutput
-	err    error
+	output   *sts.AssumeRoleOutput
+	err      error
+	identity *sts.GetCallerIdentityOutput
 }
 
 func (m *mockSTSClient) AssumeRole(_ context.Context, _ *sts.AssumeRoleInput, _ ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
 	return m.output, m.err
 }
 
+func (m *mockSTSClient) GetCallerIdentity(_ context.Context, _ *sts.GetCallerIdentityInput, _ ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	if m.identity == nil {
+		return nil, m.err
+	}
+	return m.identity, nil
+}
+
 // mockRegionClient implements iam.RegionClient.
 type mockRegionClient struct{}
 
@@ -110,6 +138,30 @@ type nopCloser struct{ *strings.Reader }
 
 func (nopCloser) Close() error { return nil }
 
+// mockAuthorizer implements authz.Authorizer and records the last request.
+type mockAuthorizer struct {
+	decision authz.Decision
+	request  authz.Request
+}
+
+func (m *mockAuthorizer) Authorize(req authz.Request) authz.Decision {
+	m.request = req
+	return m.decision
+}
+
+// mockCredentialsProvider implements iam.CredentialsProvider and records the roles assumed.
+type mockCredentialsProvider struct {
+	credentials *iam.Credentials
+	assumed     []string
+}
+
+func (m *mockCredentialsProvider) AssumeRole(roleARN, _, _ string, _, _ time.Duration) (*iam.Credentials, error) {
+	m.assumed = append(m.assumed, roleARN)
+	return m.credentials, nil
+}
+
+func (m *mockCredentialsProvider) EvictRoles(_ func(roleARN string) bool) int { return 0 }
+
 // ---- Helpers ----------------------------------------------------------------
 
 func newLogger() *log.Entry {
@@ -177,6 +229,8 @@ func TestParseRemoteAddr(t *testing.T) {
 		{"no port", "10.0.0.1", "10.0.0.1"},
 		{"IPv6 without port", "fd00:ec2::254", "fd00:ec2::254"},
 		{"IPv6 with port", "[fd00:ec2::254]:8181", "fd00:ec2::254"},
+		{"IPv4-mapped IPv6 with port", "[::ffff:10.0.0.1]:8080", "10.0.0.1"},
+		{"IPv6 with zone", "[fe80::1%eth0]:8080", "fe80::1"},
 		{"single char before colon", "a:", ""},
 		{"non-IP hostname", "myhost:1234", ""},
 		{"empty string", "", ""},
@@ -192,6 +246,54 @@ func TestParseRemoteAddr(t *testing.T) {
 	}
 }
 
+func TestNeedsNamespaces(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(s *Server)
+		policy    *policy.Policy
+		expected  bool
+	}{
+		{name: "defaults", configure: func(s *Server) {}},
+		{name: "derived external IDs", configure: func(s *Server) { s.ExternalIDSource = mappings.ExternalIDSourceDerived }},
+		{name: "namespace restrictions", configure: func(s *Server) { s.NamespaceRestriction = true }, expected: true},
+		{name: "namespace restrictions audit", configure: func(s *Server) { s.NamespaceRestrictionAudit = true }, expected: true},
+		{name: "namespace base ARN", configure: func(s *Server) { s.NamespaceBaseARNKey = "iam.amazonaws.com/base-role-arn" }, expected: true},
+		{name: "namespace external IDs", configure: func(s *Server) { s.ExternalIDSource = mappings.ExternalIDSourceNamespace }, expected: true},
+		{name: "strict namespaces", configure: func(s *Server) { s.StrictNamespaceSelector = "strict=true" }, expected: true},
+		{name: "policy", configure: func(s *Server) {}, policy: &policy.Policy{}, expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			tt.configure(s)
+			if got := s.needsNamespaces(tt.policy); got != tt.expected {
+				t.Errorf("expected %t, got %t", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseRemotePort(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected int
+	}{
+		{"IPv4 with port", "10.0.0.1:8080", 8080},
+		{"IPv6 with port", "[fd00:ec2::254]:8181", 8181},
+		{"no port", "10.0.0.1", 0},
+		{"non numeric port", "10.0.0.1:http", 0},
+		{"empty string", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRemotePort(tt.input); got != tt.expected {
+				t.Errorf("parseRemotePort(%q) = %d, want %d", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
 // ---- healthHandler ----------------------------------------------------------
 
 func TestHealthHandlerHealthy(t *testing.T) {
@@ -352,6 +454,73 @@ func TestRoleHandlerMatch(t *testing.T) {
 	}
 }
 
+func TestRoleHandlerCredentialsProvider(t *testing.T) {
+	const baseARN = "arn:aws:iam::123456789012:role/"
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "my-pod",
+			Namespace:   "default",
+			Annotations: map[string]string{defaultIAMRoleKey: "my-role"},
+		},
+		Status: v1.PodStatus{PodIP: "10.0.0.10", Phase: v1.PodRunning},
+	}
+	provider := &mockCredentialsProvider{credentials: &iam.Credentials{AccessKeyID: "AKIAPROVIDER"}}
+	s := NewServer(WithCredentialsProvider(provider))
+	s.roleMapper = newRoleMapper(pod, nil, nil, nil, baseARN, "", false)
+	s.iam = iam.NewClient(baseARN, false)
+
+	req := httptest.NewRequest(http.MethodGet, "/latest/meta-data/iam/security-credentials/my-role", nil)
+	req.RemoteAddr = "10.0.0.10:9999"
+	req = setMuxVars(req, map[string]string{"role": "my-role"})
+	rw := httptest.NewRecorder()
+	s.roleHandler(newLogger(), rw, req)
+
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "AKIAPROVIDER") {
+		t.Errorf("expected the credentials of the provider, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if len(provider.assumed) != 1 || provider.assumed[0] != baseARN+"my-role" {
+		t.Errorf("expected the provider to assume %s, got %v", baseARN+"my-role", provider.assumed)
+	}
+}
+
+func TestRoleHandlerSecondaryRole(t *testing.T) {
+	const baseARN = "arn:aws:iam::123456789012:role/"
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "my-pod",
+			Namespace:   "default",
+			Annotations: map[string]string{defaultIAMRoleKey: `["reader", "writer"]`},
+		},
+		Status: v1.PodStatus{PodIP: "10.0.0.13", Phase: v1.PodRunning},
+	}
+
+	roleMapper := newRoleMapper(pod, nil, nil, nil, baseARN, "", false)
+	iamClient := newTestIAMClient(baseARN, &iam.Credentials{
+		AccessKeyID:     "AKIATEST",
+		SecretAccessKey: "secret",
+		Token:           "token",
+	}, nil)
+	s := buildServer(roleMapper, iamClient)
+
+	req := httptest.NewRequest(http.MethodGet, "/latest/meta-data/iam/security-credentials", nil)
+	req.RemoteAddr = "10.0.0.13:9999"
+	rw := httptest.NewRecorder()
+	s.securityCredentialsHandler(newLogger(), rw, req)
+	if body := strings.TrimSpace(rw.Body.String()); body != "reader" {
+		t.Errorf("expected primary role 'reader' to be listed, got %q", body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/latest/meta-data/iam/security-credentials/writer", nil)
+	req.RemoteAddr = "10.0.0.13:9999"
+	req = setMuxVars(req, map[string]string{"role": "writer"})
+	rw = httptest.NewRecorder()
+	s.roleHandler(newLogger(), rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("expected 200 for secondary role, got %d: %s", rw.Code, rw.Body.String())
+	}
+}
+
 func TestRoleHandlerMismatch(t *testing.T) {
 	const baseARN = "arn:aws:iam::123456789012:role/"
 
@@ -379,6 +548,201 @@ func TestRoleHandlerMismatch(t *testing.T) {
 	}
 }
 
+func TestRoleHandlerExternalIDMismatch(t *testing.T) {
+	const baseARN = "arn:aws:iam::123456789012:role/"
+	const roleName = "my-role"
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pod",
+			Namespace: "tenant-a",
+			Annotations: map[string]string{
+				defaultIAMRoleKey:    roleName,
+				defaultIAMExternalID: "tenant-b-id",
+			},
+		},
+		Status: v1.PodStatus{PodIP: "10.0.0.12", Phase: v1.PodRunning},
+	}
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "tenant-a",
+		Annotations: map[string]string{defaultNamespaceExternalIDKey: "tenant-a-id"},
+	}}
+
+	store := &mockStore{pod: pod, namespace: ns}
+	iamClient := &iam.Client{BaseARN: baseARN}
+	roleMapper := mappings.NewRoleMapper(defaultIAMRoleKey, defaultIAMExternalID, "", false, defaultNamespaceKey, iamClient, store, "glob",
+		mappings.WithExternalIDSource(mappings.ExternalIDSourceNamespace, defaultNamespaceExternalIDKey, nil, true))
+	s := buildServer(roleMapper, iamClient)
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/latest/meta-data/iam/security-credentials/%s", roleName), nil)
+	req.RemoteAddr = "10.0.0.12:9999"
+	req = setMuxVars(req, map[string]string{"role": roleName})
+	rw := httptest.NewRecorder()
+	s.roleHandler(newLogger(), rw, req)
+
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d: %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestExternalIDOption(t *testing.T) {
+	saltFile := filepath.Join(t.TempDir(), "salt")
+	if err := os.WriteFile(saltFile, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatalf("failed to write salt file: %v", err)
+	}
+	emptyFile := filepath.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(emptyFile, []byte("\n"), 0600); err != nil {
+		t.Fatalf("failed to write salt file: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		source    string
+		saltFile  string
+		expectErr bool
+	}{
+		{name: "pod", source: mappings.ExternalIDSourcePod},
+		{name: "namespace", source: mappings.ExternalIDSourceNamespace},
+		{name: "derived", source: mappings.ExternalIDSourceDerived, saltFile: saltFile},
+		{name: "derived without salt", source: mappings.ExternalIDSourceDerived, expectErr: true},
+		{name: "derived with empty salt", source: mappings.ExternalIDSourceDerived, saltFile: emptyFile, expectErr: true},
+		{name: "unknown source", source: "annotation", expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			s.ExternalIDSource = tt.source
+			s.ExternalIDSaltFile = tt.saltFile
+			_, err := s.externalIDOption()
+			if tt.expectErr && err == nil {
+				t.Error("expected error, got nil")
+			}
+			if !tt.expectErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRoleHandlerOptOutAnsweredImmediately(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "my-pod",
+			Namespace:   "default",
+			Annotations: map[string]string{defaultIAMRoleKey: "none"},
+		},
+		Status: v1.PodStatus{PodIP: "10.0.0.14", Phase: v1.PodRunning},
+	}
+	store := &mockStore{pod: pod}
+	iamClient := &iam.Client{BaseARN: "arn:aws:iam::123456789012:role/"}
+	roleMapper := mappings.NewRoleMapper(defaultIAMRoleKey, defaultIAMExternalID, "default-role", false, defaultNamespaceKey, iamClient, store, "glob",
+		mappings.WithOptOutValue("none"))
+	s := buildServer(roleMapper, iamClient)
+	s.BackoffMaxElapsedTime = time.Minute
+
+	req := httptest.NewRequest(http.MethodGet, "/latest/meta-data/iam/security-credentials", nil)
+	req.RemoteAddr = "10.0.0.14:9999"
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	s.securityCredentialsHandler(newLogger(), rw, req)
+
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected opt-out to be answered without retrying, took %s", elapsed)
+	}
+}
+
+func TestRoleHandlerPodNotFoundAnsweredImmediately(t *testing.T) {
+	roleMapper := newRoleMapper(nil, fmt.Errorf("%w: no pod with IP %q", kube2iam.ErrPodNotFound, "10.99.99.99"), nil, nil, "", "", false)
+	s := buildServer(roleMapper, &iam.Client{})
+	s.BackoffMaxElapsedTime = time.Minute
+
+	req := httptest.NewRequest(http.MethodGet, "/latest/meta-data/iam/security-credentials", nil)
+	req.RemoteAddr = "10.99.99.99:9999"
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	s.securityCredentialsHandler(newLogger(), rw, req)
+
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected a pod not found by the lookup fallback to be answered without retrying, took %s", elapsed)
+	}
+}
+
+func TestGetRoleMappingOutcomeRecordedOnce(t *testing.T) {
+	pod := &v1.Pod{}
+	pod.Namespace = "default"
+	pod.Status.PodIP = "10.0.0.5"
+	pod.Annotations = map[string]string{defaultIAMRoleKey: "app"}
+	outcome := func(label string) float64 {
+		return testutil.ToFloat64(metrics.RoleMappingOutcomeCount.WithLabelValues(label))
+	}
+
+	// The namespace can't be found, the role is refused by the namespace restriction after retries
+	refused := buildServer(newRoleMapper(pod, nil, nil, errors.New("namespace not found"), "arn:aws:iam::123456789012:role/", "", true), &iam.Client{})
+	refused.BackoffMaxElapsedTime = 200 * time.Millisecond
+	refused.BackoffMaxInterval = 20 * time.Millisecond
+	annotations, refusals := outcome("annotation"), outcome("refused")
+	if _, err := refused.getRoleMapping("10.0.0.5", 0); err == nil {
+		t.Fatal("expected the role to be refused")
+	}
+	if got := outcome("annotation") - annotations; got != 0 {
+		t.Errorf("expected no annotation outcome for a refused role, got %v", got)
+	}
+	if got := outcome("refused") - refusals; got != 1 {
+		t.Errorf("expected the refused outcome to be recorded once, got %v", got)
+	}
+
+	allowed := buildServer(newRoleMapper(pod, nil, nil, nil, "arn:aws:iam::123456789012:role/", "", false), &iam.Client{})
+	annotations = outcome("annotation")
+	if _, err := allowed.getRoleMapping("10.0.0.5", 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := outcome("annotation") - annotations; got != 1 {
+		t.Errorf("expected the annotation outcome to be recorded once, got %v", got)
+	}
+}
+
+func TestRoleMapperOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(s *Server)
+		expectErr bool
+	}{
+		{name: "defaults", configure: func(s *Server) {}},
+		{name: "valid template and selector", configure: func(s *Server) {
+			s.RoleTemplate = "{{.Namespace}}-{{.ServiceAccount}}"
+			s.StrictNamespaceSelector = "kube2iam.io/strict=true"
+		}},
+		{name: "invalid template", configure: func(s *Server) { s.RoleTemplate = "{{.Namespace" }, expectErr: true},
+		{name: "invalid selector", configure: func(s *Server) { s.StrictNamespaceSelector = "a in (" }, expectErr: true},
+		{name: "hostNetwork attribution", configure: func(s *Server) {
+			s.HostNetworkAttribution = true
+			s.HostIP = "192.168.0.10"
+		}},
+		{name: "valid namespace selector", configure: func(s *Server) { s.NamespaceSelector = "team in (a, b)" }},
+		{name: "invalid namespace selector", configure: func(s *Server) { s.NamespaceSelector = "team in (" }, expectErr: true},
+		{name: "hostNetwork attribution without host IP", configure: func(s *Server) { s.HostNetworkAttribution = true }, expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			tt.configure(s)
+			_, err := s.roleMapperOptions()
+			if tt.expectErr && err == nil {
+				t.Error("expected error, got nil")
+			}
+			if !tt.expectErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
 func TestRoleHandlerMappingError(t *testing.T) {
 	roleMapper := newRoleMapper(nil, errors.New("pod not found"), nil, nil, "", "", false)
 	s := buildServer(roleMapper, &iam.Client{})
@@ -422,6 +786,59 @@ func TestRoleHandlerSTSError(t *testing.T) {
 	}
 }
 
+func TestRoleHandlerAuthorizer(t *testing.T) {
+	const baseARN = "arn:aws:iam::123456789012:role/"
+	const roleName = "authz-role"
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pod",
+			Namespace: "default",
+			Annotations: map[string]string{
+				defaultIAMRoleKey:    roleName,
+				defaultIAMExternalID: "tenant-a",
+			},
+		},
+		Spec:   v1.PodSpec{ServiceAccountName: "billing", NodeName: "node-1"},
+		Status: v1.PodStatus{PodIP: "10.0.0.13", Phase: v1.PodRunning},
+	}
+
+	for _, allowed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("allowed=%t", allowed), func(t *testing.T) {
+			roleMapper := newRoleMapper(pod, nil, nil, nil, baseARN, "", false)
+			iamClient := newTestIAMClient(baseARN, &iam.Credentials{AccessKeyID: "AKIATEST"}, nil)
+			s := buildServer(roleMapper, iamClient)
+			authorizer := &mockAuthorizer{decision: authz.Decision{Allowed: allowed, Reason: "decided"}}
+			s.authorizer = authorizer
+
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/latest/meta-data/iam/security-credentials/%s", roleName), nil)
+			req.RemoteAddr = "10.0.0.13:9999"
+			req = setMuxVars(req, map[string]string{"role": roleName})
+			rw := httptest.NewRecorder()
+			s.roleHandler(newLogger(), rw, req)
+
+			expectedCode := http.StatusOK
+			if !allowed {
+				expectedCode = http.StatusForbidden
+			}
+			if rw.Code != expectedCode {
+				t.Errorf("expected %d, got %d: %s", expectedCode, rw.Code, rw.Body.String())
+			}
+			expectedRequest := authz.Request{
+				Pod:            "my-pod",
+				Namespace:      "default",
+				ServiceAccount: "billing",
+				Role:           baseARN + roleName,
+				ExternalID:     "tenant-a",
+				Node:           "node-1",
+			}
+			if authorizer.request != expectedRequest {
+				t.Errorf("expected authorization request %+v, got %+v", expectedRequest, authorizer.request)
+			}
+		})
+	}
+}
+
 // ---- reverseProxyHandler ----------------------------------------------------
 
 func TestReverseProxyHandlerIMDSv2TokenRoute(t *testing.T) {
@@ -490,6 +907,38 @@ func TestReverseProxyHandlerStandardRequest(t *testing.T) {
 	}
 }
 
+func TestReverseProxyHandlerIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	var capturedXFF string
+	backend := &httptest.Server{
+		Listener: listener,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			capturedXFF = r.Header.Get("X-Forwarded-For")
+			w.WriteHeader(http.StatusOK)
+		})},
+	}
+	backend.Start()
+	defer backend.Close()
+
+	s := NewServer()
+	s.MetadataAddress = strings.TrimPrefix(backend.URL, "http://")
+
+	req := httptest.NewRequest(http.MethodGet, "/latest/meta-data/ami-id", nil)
+	req.RemoteAddr = "[fd00:10::5]:9999"
+	rw := httptest.NewRecorder()
+	s.reverseProxyHandler(newLogger(), rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rw.Code)
+	}
+	if capturedXFF != "fd00:10::5" {
+		t.Errorf("expected X-Forwarded-For fd00:10::5, got %q", capturedXFF)
+	}
+}
+
 // ---- debugStoreHandler ------------------------------------------------------
 
 func TestDebugStoreHandler(t *testing.T) {
@@ -534,6 +983,454 @@ func TestDebugStoreHandler(t *testing.T) {
 	}
 }
 
+// ---- serve ------------------------------------------------------------------
+
+// freeAddr returns a local address with a free port.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return addr
+}
+
+// waitListening waits until the address accepts connections.
+func waitListening(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server not listening on %s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	s := NewServer()
+	s.ShutdownDelay = 0
+	started := make(chan struct{})
+	addr := freeAddr(t)
+	srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("credentials"))
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.serve(ctx, srv) }()
+	waitListening(t, addr)
+
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/latest/meta-data/iam/security-credentials/role")
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, _ := io.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+	<-started
+	cancel()
+
+	if err := <-served; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+	if body := <-responses; body != "credentials" {
+		t.Errorf("expected the in-flight request to complete, got %q", body)
+	}
+
+	rw := httptest.NewRecorder()
+	s.healthHandler(newLogger(), rw, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the healthcheck to fail once shutting down, got %d", rw.Code)
+	}
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	s := NewServer()
+	s.ShutdownTimeout = 50 * time.Millisecond
+	s.ShutdownDelay = 0
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	addr := freeAddr(t)
+	srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.serve(ctx, srv) }()
+	waitListening(t, addr)
+	go func() {
+		if resp, err := http.Get("http://" + addr + "/"); err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-started
+	cancel()
+
+	if err := <-served; err == nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the shutdown to time out, got %v", err)
+	}
+}
+
+func TestServeShutdownDelay(t *testing.T) {
+	s := NewServer()
+	s.ShutdownDelay = 500 * time.Millisecond
+	s.HealthcheckFailReason = ""
+	addr := freeAddr(t)
+	srv := &http.Server{Addr: addr, Handler: s.Handler()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.serve(ctx, srv) }()
+	waitListening(t, addr)
+	cancel()
+
+	// The failing healthcheck is served until the delay is over
+	deadline := time.Now().Add(s.ShutdownDelay / 2)
+	for {
+		resp, err := http.Get("http://" + addr + "/healthz")
+		if err != nil {
+			t.Fatalf("expected requests to be served during the shutdown delay, got %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the healthcheck to fail during the shutdown delay, got %d", resp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+}
+
+func TestServeListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	s := NewServer()
+	err = s.serve(context.Background(), &http.Server{Addr: l.Addr().String()})
+	if err == nil || !strings.Contains(err.Error(), l.Addr().String()) {
+		t.Errorf("expected an error for the address in use, got %v", err)
+	}
+}
+
+// ---- Handler ----------------------------------------------------------------
+
+func TestHandlerRoutes(t *testing.T) {
+	s := NewServer()
+	s.HealthcheckFailReason = ""
+
+	rw := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("expected /healthz to be served, got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("expected /metrics to be served on the app port, got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/debug/store", nil))
+	if strings.Contains(rw.Body.String(), "rolesByIP") {
+		t.Error("expected /debug/store not to be served without --debug")
+	}
+}
+
+// ---- readiness and liveness -------------------------------------------------
+
+func TestReadinessAndLivenessChecks(t *testing.T) {
+	s := NewServer()
+	s.k8s = &k8s.Client{}
+	s.iam = &iam.Client{
+		STS:    &mockSTSClient{identity: &sts.GetCallerIdentityOutput{Arn: aws.String("arn:aws:sts::123456789012:assumed-role/node/i-0123")}},
+		Region: &mockRegionClient{},
+		IMDS:   &mockIMDSClient{instanceID: "i-0123"},
+	}
+	synced := false
+	s.cacheSynced = []cache.InformerSynced{func() bool { return synced }}
+	s.registerChecks()
+	s.readiness.Start(t.Context())
+	s.liveness.Start(t.Context())
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, target, nil))
+		return rw
+	}
+
+	if rw := serve("/readyz"); rw.Code != http.StatusServiceUnavailable || !strings.Contains(rw.Body.String(), "cache-synced") {
+		t.Errorf("expected readiness to fail until caches are synced, got %d: %q", rw.Code, rw.Body.String())
+	}
+	synced = true
+	deadline := time.Now().Add(5 * time.Second)
+	for serve("/readyz").Code != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected readiness to pass, got %q", serve("/readyz").Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rw := serve("/readyz?verbose")
+	var resp health.Response
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	var names []string
+	for _, check := range resp.Checks {
+		names = append(names, check.Name)
+	}
+	if strings.Join(names, ",") != "shutdown,cache-synced,informers-fresh,sts,imds" {
+		t.Errorf("unexpected readiness checks %v", names)
+	}
+
+	s.shuttingDown.Store(true)
+	if rw := serve("/readyz"); rw.Code != http.StatusServiceUnavailable || !strings.Contains(rw.Body.String(), "shutting down") {
+		t.Errorf("expected readiness to fail when shutting down, got %d: %q", rw.Code, rw.Body.String())
+	}
+	if rw := serve("/livez"); rw.Code != http.StatusOK {
+		t.Errorf("expected liveness to pass when shutting down, got %d", rw.Code)
+	}
+}
+
+// ---- Preflight --------------------------------------------------------------
+
+func TestPreflight(t *testing.T) {
+	nodeIdentity := &sts.GetCallerIdentityOutput{Arn: aws.String("arn:aws:sts::123456789012:assumed-role/node/i-0123")}
+	tests := []struct {
+		name          string
+		baseARN       string
+		canaryRole    string
+		strict        bool
+		identity      *sts.GetCallerIdentityOutput
+		stsErr        error
+		expectedError string
+	}{
+		{"identity only", "", "", false, nodeIdentity, nil, ""},
+		{"base role ARN in the node account", "arn:aws:iam::123456789012:role/", "", false, nodeIdentity, nil, ""},
+		{"base role ARN in another account", "arn:aws:iam::210987654321:role/", "", false, nodeIdentity, nil, ""},
+		{"base role ARN in another account when strict", "arn:aws:iam::210987654321:role/", "", true, nodeIdentity, nil, "not in the account 210987654321"},
+		{"canary role assumed", "arn:aws:iam::123456789012:role/", "canary", false, nodeIdentity, nil, ""},
+		{"canary role denied", "arn:aws:iam::123456789012:role/", "canary", false, nodeIdentity, errors.New("AccessDenied"), "error assuming the canary role arn:aws:iam::123456789012:role/canary"},
+		{"sts unreachable", "arn:aws:iam::123456789012:role/", "", false, nil, errors.New("no route to host"), "error getting the node identity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(WithBaseRoleARN(tt.baseARN))
+			s.PreflightCanaryRole = tt.canaryRole
+			s.PreflightStrict = tt.strict
+			s.iam = newTestIAMClient(tt.baseARN, &iam.Credentials{AccessKeyID: "AKID"}, tt.stsErr)
+			s.iam.STS.(*mockSTSClient).identity = tt.identity
+			s.iam.IMDS = &mockIMDSClient{}
+
+			err := s.Preflight(t.Context())
+			if tt.expectedError == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.expectedError != "" && (err == nil || !strings.Contains(err.Error(), tt.expectedError)) {
+				t.Fatalf("expected error containing %q, got %v", tt.expectedError, err)
+			}
+
+			expectedStatus := 1.0
+			if tt.identity == nil {
+				expectedStatus = 0
+			}
+			if status := testutil.ToFloat64(metrics.PreflightCheckStatus.WithLabelValues("caller_identity")); status != expectedStatus {
+				t.Errorf("expected caller_identity status %v, got %v", expectedStatus, status)
+			}
+		})
+	}
+}
+
+func TestPreflightReadinessRecovers(t *testing.T) {
+	s := NewServer(WithBaseRoleARN("arn:aws:iam::123456789012:role/"))
+	s.iam = newTestIAMClient(s.BaseRoleARN, nil, errors.New("no route to host"))
+	s.iam.IMDS = &mockIMDSClient{}
+	if err := s.Preflight(t.Context()); err == nil {
+		t.Fatal("expected the preflight checks to fail while STS is unreachable")
+	}
+
+	// STS is reachable again by the time the readiness check runs
+	s.iam.STS.(*mockSTSClient).identity = &sts.GetCallerIdentityOutput{Arn: aws.String("arn:aws:sts::123456789012:assumed-role/node/i-0123")}
+	s.readiness.Start(t.Context())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		statuses := s.readiness.Statuses(t.Context())
+		if len(statuses) != 1 || statuses[0].Name != "preflight" {
+			t.Fatalf("expected the preflight readiness check, got %+v", statuses)
+		}
+		if statuses[0].Healthy {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the preflight readiness check to recover, got %+v", statuses[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunAgain(t *testing.T) {
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sendInitialEvents") == "true" {
+			http.Error(w, "streaming lists are not supported", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("watch") == "true" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"kind":"PodList","apiVersion":"v1","metadata":{"resourceVersion":"1"},"items":[]}`))
+	}))
+	defer func() {
+		apiServer.CloseClientConnections()
+		apiServer.Close()
+	}()
+	k8sClient, err := k8s.NewClient(k8s.ClientOptions{Host: apiServer.URL, Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	iamClient := newTestIAMClient("", nil, nil)
+	iamClient.STS.(*mockSTSClient).identity = &sts.GetCallerIdentityOutput{Arn: aws.String("arn:aws:sts::123456789012:assumed-role/node/i-0123")}
+	iamClient.IMDS = &mockIMDSClient{instanceID: "i-0123"}
+	addr := freeAddr(t)
+	_, port, _ := net.SplitHostPort(addr)
+	s := NewServer(WithAppPort(port), WithKubernetesClient(k8sClient), WithIAMClient(iamClient))
+	s.ShutdownDelay = 0
+
+	for run := 1; run <= 2; run++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- s.Run(ctx) }()
+
+		deadline := time.Now().Add(10 * time.Second)
+		var resp health.Response
+		for {
+			if r, err := http.Get("http://" + addr + "/readyz?verbose"); err == nil {
+				resp = health.Response{}
+				_ = json.NewDecoder(r.Body).Decode(&resp)
+				_ = r.Body.Close()
+				if resp.Healthy {
+					break
+				}
+			}
+			if time.Now().After(deadline) {
+				cancel()
+				t.Fatalf("run %d: expected the server to become ready, got %+v", run, resp)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if len(resp.Checks) != 5 {
+			t.Errorf("run %d: expected the checks to be registered once, got %+v", run, resp.Checks)
+		}
+
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatalf("run %d: expected a clean shutdown, got %v", run, err)
+		}
+	}
+}
+
+func TestRunIndexesPodsDuringShutdownDelay(t *testing.T) {
+	podEvents := make(chan string, 1)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sendInitialEvents") == "true" {
+			http.Error(w, "streaming lists are not supported", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("watch") == "true" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case event := <-podEvents:
+					_, _ = w.Write([]byte(event + "\n"))
+					w.(http.Flusher).Flush()
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"kind":"PodList","apiVersion":"v1","metadata":{"resourceVersion":"1"},"items":[]}`))
+	}))
+	defer func() {
+		apiServer.CloseClientConnections()
+		apiServer.Close()
+	}()
+	k8sClient, err := k8s.NewClient(k8s.ClientOptions{Host: apiServer.URL, Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	iamClient := newTestIAMClient("", nil, nil)
+	iamClient.STS.(*mockSTSClient).identity = &sts.GetCallerIdentityOutput{Arn: aws.String("arn:aws:sts::123456789012:assumed-role/node/i-0123")}
+	iamClient.IMDS = &mockIMDSClient{instanceID: "i-0123"}
+	addr := freeAddr(t)
+	_, port, _ := net.SplitHostPort(addr)
+	s := NewServer(WithAppPort(port), WithKubernetesClient(k8sClient), WithIAMClient(iamClient))
+	s.ShutdownDelay = 2 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if r, err := http.Get("http://" + addr + "/readyz"); err == nil {
+			_ = r.Body.Close()
+			if r.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			cancel()
+			t.Fatal("expected the server to become ready")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	cancel()
+	podEvents <- `{"type":"ADDED","object":{"kind":"Pod","apiVersion":"v1","metadata":{"name":"late","namespace":"default","uid":"late","resourceVersion":"2"},"status":{"phase":"Running","podIP":"10.0.0.9","podIPs":[{"ip":"10.0.0.9"}]}}}`
+	deadline = time.Now().Add(s.ShutdownDelay)
+	for {
+		if _, err := k8sClient.PodByIP("10.0.0.9"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected a pod added during the shutdown delay to be indexed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+}
+
 // ---- doHealthcheck ----------------------------------------------------------
 
 func TestDoHealthcheckSuccess(t *testing.T) {
@@ -567,6 +1464,47 @@ func TestDoHealthcheckFailure(t *testing.T) {
 
 // ---- NewServer defaults -----------------------------------------------------
 
+func TestNewServerOptions(t *testing.T) {
+	iamClient := iam.NewClient("", false)
+	authorizer := &mockAuthorizer{}
+	s := NewServer(
+		WithAppPort("9191"),
+		WithNode("node-1", "10.0.0.1"),
+		WithKubeconfig("/etc/kubeconfig", "admin"),
+		WithBaseRoleARN("arn:aws:iam::123456789012:role/"),
+		WithDefaultRole("default"),
+		WithRoleKey("example.com/role"),
+		WithNamespaceRestriction("example.com/allowed-roles"),
+		WithIAMClient(iamClient),
+		WithAuthorizer(authorizer),
+	)
+
+	if s.AppPort != "9191" || s.MetricsPort != "9191" {
+		t.Errorf("expected app and metrics ports 9191, got %q and %q", s.AppPort, s.MetricsPort)
+	}
+	if s.NodeName != "node-1" || s.HostIP != "10.0.0.1" {
+		t.Errorf("expected node node-1 with host IP 10.0.0.1, got %q and %q", s.NodeName, s.HostIP)
+	}
+	if s.KubeconfigPath != "/etc/kubeconfig" || s.KubeconfigContext != "admin" {
+		t.Errorf("expected kubeconfig /etc/kubeconfig with context admin, got %q and %q", s.KubeconfigPath, s.KubeconfigContext)
+	}
+	if s.BaseRoleARN != "arn:aws:iam::123456789012:role/" || s.DefaultIAMRole != "default" || s.IAMRoleKey != "example.com/role" {
+		t.Errorf("unexpected role settings %q, %q and %q", s.BaseRoleARN, s.DefaultIAMRole, s.IAMRoleKey)
+	}
+	if !s.NamespaceRestriction || s.NamespaceKey != "example.com/allowed-roles" {
+		t.Errorf("expected namespace restriction with key example.com/allowed-roles, got %t and %q", s.NamespaceRestriction, s.NamespaceKey)
+	}
+	if s.iam != iamClient || s.authorizer != authorizer {
+		t.Error("expected the IAM client and authorizer to be used")
+	}
+	if s.credentialsProvider() != iamClient {
+		t.Error("expected the IAM client to issue credentials by default")
+	}
+	if s.LogLevel != defaultLogLevel {
+		t.Errorf("expected defaults to be kept, got log level %q", s.LogLevel)
+	}
+}
+
 func TestNewServerDefaults(t *testing.T) {
 	s := NewServer()
 	if s.AppPort != defaultAppPort {